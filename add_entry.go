@@ -1,9 +1,14 @@
 package main
 
+import (
+	"log"
+)
+
 type AddEntry struct {
 	schemaMap  *SchemaMap
 	dn         *DN
 	attributes map[string]*SchemaValue
+	creator    *DN // The bound DN which adds the entry, it's stored as creatorsName
 }
 
 type MemberEntry struct {
@@ -33,12 +38,11 @@ func (j *AddEntry) HasAttr(attrName string) bool {
 
 func (j *AddEntry) SetDN(dn *DN) {
 	j.dn = dn
+}
 
-	rdn := dn.RDN()
-	for k, v := range rdn {
-		// rdn is validated already
-		j.attributes[k], _ = NewSchemaValue(k, []string{v})
-	}
+// SetCreator sets the bound DN which adds the entry.
+func (j *AddEntry) SetCreator(dn *DN) {
+	j.creator = dn
 }
 
 func (j *AddEntry) IsRoot() bool {
@@ -87,11 +91,48 @@ func (j *AddEntry) Validate() error {
 	if !j.HasAttr("objectClass") {
 		return NewObjectClassViolation()
 	}
+	if err := j.ValidateRDN(); err != nil {
+		return err
+	}
 	// TODO more validation
 
 	return nil
 }
 
+// ValidateRDN checks the attribute type and value of the RDN are present in the attributes.
+// The missing ones are added to the attributes. Each component of multi-valued RDN is checked.
+// It returns namingViolation if the value can't be added because the attribute is single-valued.
+func (j *AddEntry) ValidateRDN() error {
+	if len(j.dn.RDNs) == 0 {
+		return NewInvalidDNSyntax()
+	}
+
+	for _, attr := range j.dn.RDNs[0].Attributes {
+		sv, err := NewSchemaValue(attr.TypeOrig, []string{attr.ValueOrig})
+		if err != nil {
+			log.Printf("warn: Invalid RDN. rdn: %s, err: %v", j.dn.RDNOrigStr(), err)
+			return NewInvalidDNSyntax()
+		}
+
+		current, ok := j.attributes[sv.Name()]
+		if !ok {
+			j.attributes[sv.Name()] = sv
+			continue
+		}
+		if current.HasDuplicate(sv) {
+			continue
+		}
+		if current.IsSingle() {
+			return NewNamingViolation(sv.Name())
+		}
+		if err := current.Add(sv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Append to current value(s).
 func (j *AddEntry) Add(attrName string, attrValue []string) error {
 	if len(attrValue) == 0 {
@@ -0,0 +1,99 @@
+// +build !integration
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateRDN(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+
+	testcases := []struct {
+		DN           string
+		Attrs        map[string][]string
+		ExpectedCode int
+		ExpectedAttr string
+		ExpectedOrig []string
+	}{
+		{
+			"cn=Foo,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"person"}, "sn": {"foo"}},
+			0,
+			"cn",
+			[]string{"Foo"},
+		},
+		{
+			"cn=Foo,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"person"}, "cn": {"foo"}},
+			0,
+			"cn",
+			[]string{"foo"},
+		},
+		{
+			"cn=Foo,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"person"}, "cn": {"bar"}},
+			0,
+			"cn",
+			[]string{"bar", "Foo"},
+		},
+		{
+			"cn=Foo+uid=bar,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"inetOrgPerson"}, "cn": {"Foo"}},
+			0,
+			"uid",
+			[]string{"bar"},
+		},
+		{
+			"displayName=Foo,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"inetOrgPerson"}, "displayName": {"Bar"}},
+			64,
+			"",
+			nil,
+		},
+		{
+			"displayName=Foo,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"inetOrgPerson"}, "displayName": {"foo"}},
+			0,
+			"displayName",
+			[]string{"foo"},
+		},
+	}
+
+	for i, tc := range testcases {
+		dn, err := NormalizeDN(tc.DN)
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+		entry := NewAddEntry(dn)
+		for k, v := range tc.Attrs {
+			if err := entry.Add(k, v); err != nil {
+				t.Errorf("Unexpected error on %d: %+v", i, err)
+				continue
+			}
+		}
+
+		err = entry.Validate()
+		if tc.ExpectedCode != 0 {
+			ldapErr, ok := err.(*LDAPError)
+			if !ok || ldapErr.Code != tc.ExpectedCode {
+				t.Errorf("Unexpected error on %d:\n%d expected, got %v", i, tc.ExpectedCode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+
+		_, orig := entry.Attrs()
+		if !reflect.DeepEqual(orig[tc.ExpectedAttr], tc.ExpectedOrig) {
+			t.Errorf("Unexpected attribute on %d:\n%v expected, got %v", i, tc.ExpectedOrig, orig[tc.ExpectedAttr])
+		}
+	}
+}
@@ -25,6 +25,7 @@ type FetchedDN struct {
 type FetchedEntry struct {
 	FetchedDN
 	AttrsOrig types.JSONText `db:"attrs_orig"`
+	Rev       int64          `db:"rev"`
 }
 
 func (e *FetchedEntry) GetAttrsOrig() map[string][]string {
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exposed via /debug/vars when the pprof server is enabled.
+var dnCacheMetrics = expvar.NewMap("dnCache")
+
+// DNCache is a LRU cache with TTL which holds the fetched DN by the normalized DN.
+// It's used for resolving the parent entry when inserting new entry.
+// All methods are nil-safe, nil means the cache is disabled.
+type DNCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type dnCacheItem struct {
+	key     string
+	value   FetchedDN
+	expires time.Time
+}
+
+func NewDNCache(size int, ttl time.Duration) *DNCache {
+	if size <= 0 {
+		return nil
+	}
+	return &DNCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *DNCache) Get(dn *DN) (*FetchedDN, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := dn.DNNormStr()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		dnCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+	item := e.Value.(*dnCacheItem)
+	if c.ttl > 0 && time.Now().After(item.expires) {
+		c.removeElement(e)
+		dnCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	dnCacheMetrics.Add("hits", 1)
+
+	// Return a copy to avoid sharing the cached value
+	v := item.value
+	return &v, true
+}
+
+func (c *DNCache) Put(dn *DN, value *FetchedDN) {
+	if c == nil {
+		return
+	}
+	key := dn.DNNormStr()
+	expires := time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*dnCacheItem)
+		item.value = *value
+		item.expires = expires
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	e := c.ll.PushFront(&dnCacheItem{
+		key:     key,
+		value:   *value,
+		expires: expires,
+	})
+	c.items[key] = e
+
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+		dnCacheMetrics.Add("evictions", 1)
+	}
+}
+
+// Remove removes the DN from the cache.
+func (c *DNCache) Remove(dn *DN) {
+	if c == nil {
+		return
+	}
+	key := dn.DNNormStr()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// RemoveSubtree removes the DN and all descendants of the DN from the cache.
+// It must be called when the DN is renamed or moved since the cached descendants become stale.
+func (c *DNCache) RemoveSubtree(dn *DN) {
+	if c == nil {
+		return
+	}
+	key := dn.DNNormStr()
+	suffix := "," + key
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.items {
+		if k == key || strings.HasSuffix(k, suffix) {
+			c.removeElement(e)
+		}
+	}
+}
+
+func (c *DNCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *DNCache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*dnCacheItem).key)
+}
+
+func dnCacheHitRatio() interface{} {
+	var hits, misses int64
+	if v, ok := dnCacheMetrics.Get("hits").(*expvar.Int); ok {
+		hits = v.Value()
+	}
+	if v, ok := dnCacheMetrics.Get("misses").(*expvar.Int); ok {
+		misses = v.Value()
+	}
+	if hits+misses == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func init() {
+	dnCacheMetrics.Set("hitRatio", expvar.Func(dnCacheHitRatio))
+}
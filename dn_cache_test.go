@@ -0,0 +1,62 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDNCache(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+
+	mustDN := func(s string) *DN {
+		dn, err := NormalizeDN(s)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return dn
+	}
+
+	c := NewDNCache(2, 60*time.Second)
+
+	c.Put(mustDN("dc=example,dc=com"), &FetchedDN{ID: 2, Path: "1.2"})
+	c.Put(mustDN("ou=Users,dc=example,dc=com"), &FetchedDN{ID: 3, Path: "1.2.3"})
+
+	if v, ok := c.Get(mustDN("DC=Example,DC=com")); !ok || v.ID != 2 {
+		t.Errorf("Unexpected cache value. want: 2, got: %v", v)
+	}
+
+	// The least recently used entry is evicted
+	c.Put(mustDN("ou=Groups,dc=example,dc=com"), &FetchedDN{ID: 4, Path: "1.2.4"})
+	if _, ok := c.Get(mustDN("ou=Users,dc=example,dc=com")); ok {
+		t.Errorf("Unexpected cache hit. The entry should be evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Unexpected cache size. want: 2, got: %d", c.Len())
+	}
+
+	// Remove the subtree
+	c.RemoveSubtree(mustDN("dc=example,dc=com"))
+	if c.Len() != 0 {
+		t.Errorf("Unexpected cache size. want: 0, got: %d", c.Len())
+	}
+
+	// Expired
+	c = NewDNCache(10, 1*time.Millisecond)
+	c.Put(mustDN("dc=example,dc=com"), &FetchedDN{ID: 2, Path: "1.2"})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get(mustDN("dc=example,dc=com")); ok {
+		t.Errorf("Unexpected cache hit. The entry should be expired")
+	}
+
+	// Disabled
+	c = NewDNCache(0, 60*time.Second)
+	c.Put(mustDN("dc=example,dc=com"), &FetchedDN{ID: 2, Path: "1.2"})
+	if _, ok := c.Get(mustDN("dc=example,dc=com")); ok {
+		t.Errorf("Unexpected cache hit. The cache should be disabled")
+	}
+}
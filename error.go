@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"io"
+	"net"
 
+	"github.com/lib/pq"
 	ldap "github.com/openstandia/ldapserver"
+	"golang.org/x/xerrors"
 )
 
 type LDAPError struct {
@@ -14,6 +21,9 @@ type LDAPError struct {
 }
 
 func (e *LDAPError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("LDAPError: %d %s, err: %v", e.Code, e.Msg, e.err)
+	}
 	return fmt.Sprintf("LDAPError: %d %s", e.Code, e.Msg)
 }
 
@@ -66,6 +76,20 @@ func NewNoUserModificationAllowedConstraintViolation(attr string) *LDAPError {
 	}
 }
 
+func NewPasswordInHistory() *LDAPError {
+	return &LDAPError{
+		Code: 19,
+		Msg:  "Password is in history of old passwords",
+	}
+}
+
+func NewPasswordTooYoung() *LDAPError {
+	return &LDAPError{
+		Code: 19,
+		Msg:  "Password is too young to change",
+	}
+}
+
 func NewTypeOrValueExists(op, attr string, valueidx int) *LDAPError {
 	return &LDAPError{
 		Code: 20,
@@ -87,6 +111,13 @@ func NewInvalidPerSyntax(attr string, valueidx int) *LDAPError {
 	}
 }
 
+func NewOperationsError(err error) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultOperationsError,
+		err:  err,
+	}
+}
+
 func NewNoSuchObjectWithMatchedDN(dn string) *LDAPError {
 	return &LDAPError{
 		Code:      ldap.LDAPResultNoSuchObject,
@@ -107,6 +138,13 @@ func NewInvalidDNSyntax() *LDAPError {
 	}
 }
 
+func NewNamingViolation(attr string) *LDAPError {
+	return &LDAPError{
+		Code: 64,
+		Msg:  fmt.Sprintf("value of naming attribute '%s' is not present in entry", attr),
+	}
+}
+
 func NewInvalidCredentials() *LDAPError {
 	return &LDAPError{
 		Code: 49,
@@ -119,6 +157,20 @@ func NewInsufficientAccess() *LDAPError {
 	}
 }
 
+func NewInsufficientAccessWithMsg(msg string) *LDAPError {
+	return &LDAPError{
+		Code: 50,
+		Msg:  msg,
+	}
+}
+
+func NewUnwillingToPerform(msg string) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultUnwillingToPerform,
+		Msg:  msg,
+	}
+}
+
 func NewObjectClassViolation() *LDAPError {
 	return &LDAPError{
 		Code: 65,
@@ -126,6 +178,41 @@ func NewObjectClassViolation() *LDAPError {
 	}
 }
 
+func NewObjectClassViolationUnrecognized(oc string) *LDAPError {
+	return &LDAPError{
+		Code: 65,
+		Msg:  fmt.Sprintf("unrecognized objectClass '%s'", oc),
+	}
+}
+
+func NewObjectClassViolationNoStructural() *LDAPError {
+	return &LDAPError{
+		Code: 65,
+		Msg:  fmt.Sprintf("no structural object class provided"),
+	}
+}
+
+func NewObjectClassViolationInvalidStructural(oc1, oc2 string) *LDAPError {
+	return &LDAPError{
+		Code: 65,
+		Msg:  fmt.Sprintf("invalid structural object class chain (%s/%s)", oc1, oc2),
+	}
+}
+
+func NewObjectClassViolationRequiresAttr(oc, attr string) *LDAPError {
+	return &LDAPError{
+		Code: 65,
+		Msg:  fmt.Sprintf("object class '%s' requires attribute '%s'", oc, attr),
+	}
+}
+
+func NewObjectClassViolationNotAllowed(attr string) *LDAPError {
+	return &LDAPError{
+		Code: 65,
+		Msg:  fmt.Sprintf("attribute '%s' not allowed", attr),
+	}
+}
+
 func NewNotAllowedOnNonLeaf() *LDAPError {
 	return &LDAPError{
 		Code: ldap.LDAPResultNotAllowedOnNonLeaf,
@@ -133,14 +220,106 @@ func NewNotAllowedOnNonLeaf() *LDAPError {
 	}
 }
 
+// NewNotAllowedOnReferenced returns notAllowedOnNonLeaf when the deleting entry is referenced by the others
+// in restrict mode of the referential integrity.
+func NewNotAllowedOnReferenced() *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultNotAllowedOnNonLeaf,
+		Msg:  "the entry is referenced by other entries, the references must be removed first",
+	}
+}
+
 func NewAlreadyExists() *LDAPError {
 	return &LDAPError{
 		Code: 68,
 	}
 }
 
+// NewRevisionConflict returns assertionFailed (RFC 4528) when the entry was modified by others.
+func NewRevisionConflict(expected, actual int64) *LDAPError {
+	return &LDAPError{
+		Code: 122,
+		Msg:  fmt.Sprintf("entryRev is %d, but expected %d", actual, expected),
+	}
+}
+
+func NewBusy(err error) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultBusy,
+		Msg:  "the server is busy, try again",
+		err:  err,
+	}
+}
+
 func NewUnavailable() *LDAPError {
 	return &LDAPError{
 		Code: ldap.LDAPResultUnavailable,
 	}
 }
+
+func NewOther(err error) *LDAPError {
+	return &LDAPError{
+		Code: ldap.LDAPResultOther,
+		err:  err,
+	}
+}
+
+// responseCode returns the LDAP result code of the error which is sent to the client by the handlers.
+// The errors other than LDAPError are sent as operationsError.
+func responseCode(err error) int {
+	if err == nil {
+		return ldap.LDAPResultSuccess
+	}
+	var ldapErr *LDAPError
+	if ok := xerrors.As(err, &ldapErr); ok {
+		return ldapErr.Code
+	}
+	return ldap.LDAPResultOperationsError
+}
+
+// NewDBError maps the error returned by the database to LDAPError.
+// Serialization failures and deadlocks are mapped to busy so that clients can retry,
+// only the connection problems are mapped to unavailable.
+func NewDBError(err error) *LDAPError {
+	var ldapErr *LDAPError
+	if ok := xerrors.As(err, &ldapErr); ok {
+		return ldapErr
+	}
+
+	if xerrors.Is(err, context.Canceled) || xerrors.Is(err, context.DeadlineExceeded) {
+		return NewOperationsError(err)
+	}
+
+	var pqErr *pq.Error
+	if ok := xerrors.As(err, &pqErr); ok {
+		// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+		switch pqErr.Code {
+		case "40001", "40P01": // serialization_failure, deadlock_detected
+			return NewBusy(err)
+		case "23505": // unique_violation
+			e := NewAlreadyExists()
+			e.err = err
+			return e
+		case "57P01", "57P02", "57P03": // admin_shutdown, crash_shutdown, cannot_connect_now
+			e := NewUnavailable()
+			e.err = err
+			return e
+		}
+		if pqErr.Code.Class() == "08" { // connection_exception
+			e := NewUnavailable()
+			e.err = err
+			return e
+		}
+		return NewOther(err)
+	}
+
+	var netErr net.Error
+	if xerrors.Is(err, driver.ErrBadConn) || xerrors.Is(err, sql.ErrConnDone) ||
+		xerrors.Is(err, io.EOF) || xerrors.Is(err, io.ErrUnexpectedEOF) || xerrors.As(err, &netErr) {
+		e := NewUnavailable()
+		e.err = err
+		return e
+	}
+
+	return NewOther(err)
+}
@@ -0,0 +1,72 @@
+// +build !integration
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/lib/pq"
+	ldap "github.com/openstandia/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+func TestNewDBError(t *testing.T) {
+	testcases := []struct {
+		Err          error
+		ExpectedCode int
+	}{
+		{
+			&pq.Error{Code: "40001"},
+			ldap.LDAPResultBusy,
+		},
+		{
+			&pq.Error{Code: "40P01"},
+			ldap.LDAPResultBusy,
+		},
+		{
+			&pq.Error{Code: "23505"},
+			ldap.LDAPResultEntryAlreadyExists,
+		},
+		{
+			&pq.Error{Code: "08006"},
+			ldap.LDAPResultUnavailable,
+		},
+		{
+			&pq.Error{Code: "57P01"},
+			ldap.LDAPResultUnavailable,
+		},
+		{
+			&pq.Error{Code: "23503"},
+			ldap.LDAPResultOther,
+		},
+		{
+			context.Canceled,
+			ldap.LDAPResultOperationsError,
+		},
+		{
+			driver.ErrBadConn,
+			ldap.LDAPResultUnavailable,
+		},
+		{
+			xerrors.Errorf("Failed to commit. err: %w", &pq.Error{Code: "40001"}),
+			ldap.LDAPResultBusy,
+		},
+		{
+			xerrors.Errorf("Failed to commit. err: %w", NewNoSuchObject()),
+			ldap.LDAPResultNoSuchObject,
+		},
+	}
+
+	for i, tc := range testcases {
+		err := NewDBError(tc.Err)
+		if err.Code != tc.ExpectedCode {
+			t.Errorf("Unexpected error on %d:\n'%v' -> %d expected, got %d\n", i, tc.Err, tc.ExpectedCode, err.Code)
+			continue
+		}
+		if tc.ExpectedCode != ldap.LDAPResultNoSuchObject && !xerrors.Is(err, tc.Err) {
+			t.Errorf("Unexpected error on %d:\nThe original error should be wrapped, got '%v'\n", i, err)
+		}
+	}
+}
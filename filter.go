@@ -30,6 +30,7 @@ type Query struct {
 	PendingParams   map[*DN]string   // dn => paramsKey
 	IdToDNOrigCache map[int64]string // id => dn_orig
 	DNNormToIdCache map[string]int64 // dn_norm => id
+	SortKeys        []*SortKey       // server side sorting
 }
 
 func (q *Query) nextParamKey(name string) string {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"strings"
 
@@ -26,9 +27,83 @@ func (t *FullJsonQueryTranslator) Translate(schemaMap SchemaMap, packet message.
 
 	q.Params[paramKey] = jsonpath.String()
 
+	// The jsonpath can't use the expression indexes of the indexed attributes,
+	// so add the containment predicates which are implied by the filter for the planner.
+	if pred := t.indexPredicate(schemaMap, packet, q); pred != "" {
+		q.Query += " AND " + pred
+	}
+
 	return nil
 }
 
+// indexPredicate returns the predicate using the expression indexes for the equality matches of the indexed attributes,
+// and adds its params to q.
+// It returns empty if there is no predicate implied by the filter, e.g. under NOT or OR with not indexed attributes.
+func (t *FullJsonQueryTranslator) indexPredicate(schemaMap SchemaMap, packet message.Filter, q *Query) string {
+	switch f := packet.(type) {
+	case message.FilterAnd:
+		// Any of the children can be used since all of them must be matched
+		return t.joinIndexPredicates(schemaMap, f, q, " AND ", false)
+	case message.FilterOr:
+		// All of the children must have the predicate
+		return t.joinIndexPredicates(schemaMap, f, q, " OR ", true)
+	case message.FilterEqualityMatch:
+		s, ok := schemaMap.Get(string(f.AttributeDesc()))
+		if !ok || !s.IsIndexed() {
+			return ""
+		}
+		sv, err := NewSchemaValue(s.Name, []string{string(f.AssertionValue())})
+		if err != nil {
+			return ""
+		}
+		b, err := json.Marshal(sv.Norm())
+		if err != nil {
+			return ""
+		}
+
+		// e.attrs_norm->'mail' @> '["foo@example.com"]'
+		paramKey := q.nextParamKey(s.Name)
+		q.Params[paramKey] = string(b)
+		return "e.attrs_norm->'" + s.Name + "' @> :" + paramKey + "::::jsonb"
+	}
+	return ""
+}
+
+func (t *FullJsonQueryTranslator) joinIndexPredicates(schemaMap SchemaMap, children []message.Filter, q *Query, sep string, requireAll bool) string {
+	var before map[string]struct{}
+	if requireAll {
+		before = make(map[string]struct{}, len(q.Params))
+		for k := range q.Params {
+			before[k] = struct{}{}
+		}
+	}
+
+	var preds []string
+	for _, child := range children {
+		pred := t.indexPredicate(schemaMap, child, q)
+		if pred == "" {
+			if requireAll {
+				// Remove the params of the other children which aren't used
+				for k := range q.Params {
+					if _, ok := before[k]; !ok {
+						delete(q.Params, k)
+					}
+				}
+				return ""
+			}
+			continue
+		}
+		preds = append(preds, pred)
+	}
+	if len(preds) == 0 {
+		return ""
+	}
+	if len(preds) == 1 {
+		return preds[0]
+	}
+	return "(" + strings.Join(preds, sep) + ")"
+}
+
 func (t *FullJsonQueryTranslator) internalTranslate(schemaMap SchemaMap, packet message.Filter, q *Query, jsonpath *strings.Builder) (err error) {
 	err = nil
 
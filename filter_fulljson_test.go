@@ -198,5 +198,126 @@ func getToQueryByFullTestData() (ret []ToQueryTestByFullJsonData) {
 				DNNormToIdCache: map[string]int64{},
 			},
 		},
+
+		{
+			label: "(mail=Foo@example.com) with index",
+			schemaMap: map[string]*Schema{
+				"mail": {
+					Name:      "mail",
+					IndexType: "gin",
+				},
+			},
+			filter: message.NewFilterEqualityMatch("mail", "Foo@example.com"),
+			out: &Query{
+				Query: "e.attrs_norm @@ :filter AND e.attrs_norm->'mail' @> :1_mail::::jsonb",
+				Params: map[string]interface{}{
+					"filter": `$.mail == "foo@example\.com"`,
+					"1_mail": `["foo@example.com"]`,
+				},
+				PendingParams:   map[*DN]string{},
+				IdToDNOrigCache: map[int64]string{},
+				DNNormToIdCache: map[string]int64{},
+			},
+		},
+
+		{
+			label: "(&(mail=foo@example.com)(cn=foo)) with index",
+			schemaMap: map[string]*Schema{
+				"mail": {
+					Name:      "mail",
+					IndexType: "gin",
+				},
+				"cn": {
+					Name: "cn",
+				},
+			},
+			filter: message.FilterAnd{
+				message.NewFilterEqualityMatch("mail", "foo@example.com"),
+				message.NewFilterEqualityMatch("cn", "foo"),
+			},
+			out: &Query{
+				Query: "e.attrs_norm @@ :filter AND e.attrs_norm->'mail' @> :1_mail::::jsonb",
+				Params: map[string]interface{}{
+					"filter": `($.mail == "foo@example\.com" && $.cn == "foo")`,
+					"1_mail": `["foo@example.com"]`,
+				},
+				PendingParams:   map[*DN]string{},
+				IdToDNOrigCache: map[int64]string{},
+				DNNormToIdCache: map[string]int64{},
+			},
+		},
+
+		{
+			label: "(|(mail=foo@example.com)(mail=bar@example.com)) with index",
+			schemaMap: map[string]*Schema{
+				"mail": {
+					Name:      "mail",
+					IndexType: "gin",
+				},
+			},
+			filter: message.FilterOr{
+				message.NewFilterEqualityMatch("mail", "foo@example.com"),
+				message.NewFilterEqualityMatch("mail", "bar@example.com"),
+			},
+			out: &Query{
+				Query: "e.attrs_norm @@ :filter AND (e.attrs_norm->'mail' @> :1_mail::::jsonb OR e.attrs_norm->'mail' @> :2_mail::::jsonb)",
+				Params: map[string]interface{}{
+					"filter": `($.mail == "foo@example\.com" || $.mail == "bar@example\.com")`,
+					"1_mail": `["foo@example.com"]`,
+					"2_mail": `["bar@example.com"]`,
+				},
+				PendingParams:   map[*DN]string{},
+				IdToDNOrigCache: map[int64]string{},
+				DNNormToIdCache: map[string]int64{},
+			},
+		},
+
+		{
+			label: "(|(mail=foo@example.com)(cn=foo)) with index",
+			schemaMap: map[string]*Schema{
+				"mail": {
+					Name:      "mail",
+					IndexType: "gin",
+				},
+				"cn": {
+					Name: "cn",
+				},
+			},
+			filter: message.FilterOr{
+				message.NewFilterEqualityMatch("mail", "foo@example.com"),
+				message.NewFilterEqualityMatch("cn", "foo"),
+			},
+			out: &Query{
+				Query: "e.attrs_norm @@ :filter",
+				Params: map[string]interface{}{
+					"filter": `($.mail == "foo@example\.com" || $.cn == "foo")`,
+				},
+				PendingParams:   map[*DN]string{},
+				IdToDNOrigCache: map[int64]string{},
+				DNNormToIdCache: map[string]int64{},
+			},
+		},
+
+		{
+			label: "(!(mail=foo@example.com)) with index",
+			schemaMap: map[string]*Schema{
+				"mail": {
+					Name:      "mail",
+					IndexType: "gin",
+				},
+			},
+			filter: message.FilterNot{
+				Filter: message.NewFilterEqualityMatch("mail", "foo@example.com"),
+			},
+			out: &Query{
+				Query: "e.attrs_norm @@ :filter",
+				Params: map[string]interface{}{
+					"filter": `(!($.mail == "foo@example\.com"))`,
+				},
+				PendingParams:   map[*DN]string{},
+				IdToDNOrigCache: map[int64]string{},
+				DNNormToIdCache: map[string]int64{},
+			},
+		},
 	}
 }
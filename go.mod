@@ -12,9 +12,10 @@ require (
 	github.com/openstandia/goldap/message v0.0.0-20191227184744-b5528a3af20f
 	github.com/openstandia/ldapserver v0.0.0-20191024053314-fcdfef78a11c
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.0
 	github.com/videxio/goldap/message v0.0.0-20200117101650-30a10442bdf5 // indirect
 	github.com/videxio/ldapserver v0.0.0-20200117101538-bbdfd3e1b8dc // indirect
-	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897 // indirect
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
 	golang.org/x/tools v0.0.0-20201111224557-41a3a589386c // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d
@@ -29,10 +29,14 @@ func handleAdd(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		responseAddError(w, err)
 		return
 	}
+	addEntry.SetCreator(getAuthSession(m)["dn"])
 
 	log.Printf("info: Adding entry: %s", r.Entry())
 
-	id, err := s.Repo().Insert(addEntry)
+	ctx, cancel := abandonContext(m)
+	defer cancel()
+
+	id, err := s.Repo().InsertContext(ctx, addEntry)
 	if err != nil {
 		responseAddError(w, err)
 		return
@@ -62,8 +66,7 @@ func responseAddError(w ldap.ResponseWriter, err error) {
 	} else {
 		log.Printf("error: Add error. err: %+v", err)
 
-		// TODO
-		res := ldap.NewAddResponse(ldap.LDAPResultProtocolError)
+		res := ldap.NewAddResponse(responseCode(err))
 		w.Write(res)
 	}
 }
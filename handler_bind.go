@@ -4,9 +4,6 @@ import (
 	"log"
 	"strings"
 
-	"github.com/jsimonetti/pwscheme/ssha"
-	"github.com/jsimonetti/pwscheme/ssha256"
-	"github.com/jsimonetti/pwscheme/ssha512"
 	ldap "github.com/openstandia/ldapserver"
 	"golang.org/x/xerrors"
 )
@@ -40,6 +37,7 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 			log.Printf("info: Bind ok. DN: %s", name)
 
 			saveAuthencatedDN(m, dn)
+			savePasswordReset(m, false)
 
 			w.Write(res)
 			return
@@ -55,7 +53,7 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 
 		log.Printf("info: Find bind user. DN: %s", dn.DNNormStr())
 
-		bindUserCred, err := s.Repo().FindCredByDN(dn)
+		fetchedCred, err := s.Repo().FindCredByDN(dn)
 		if err != nil {
 			var lerr *LDAPError
 			if ok := xerrors.As(err, &lerr); ok {
@@ -78,6 +76,7 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		}
 
 		// If the user doesn't have credentials, always return 'invalid credential'.
+		bindUserCred := fetchedCred.Cred
 		if len(bindUserCred) == 0 {
 			log.Printf("info: Bind failed - Not found credentials. DN: %s, err: %s", name, err)
 
@@ -97,6 +96,7 @@ func handleBind(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		}
 
 		saveAuthencatedDN(m, dn)
+		savePasswordReset(m, fetchedCred.PwdReset)
 
 		// Success
 		log.Printf("info: Bind ok. DN: %s", name)
@@ -124,28 +124,22 @@ func validateCreds(s *Server, input string, cred []string) bool {
 func validateCred(s *Server, input, cred string) bool {
 	var ok bool
 	var err error
-	if len(cred) > 7 && string(cred[0:6]) == "{SSHA}" {
-		ok, err = ssha.Validate(input, cred)
-
-	} else if len(cred) > 10 && string(cred[0:9]) == "{SSHA256}" {
-		ok, err = ssha256.Validate(input, cred)
-
-	} else if len(cred) > 10 && string(cred[0:9]) == "{SSHA512}" {
-		ok, err = ssha512.Validate(input, cred)
-
-	} else if len(cred) > 7 && string(cred[0:6]) == "{SASL}" {
+	if len(cred) > 7 && string(cred[0:6]) == "{SASL}" {
 		ok, err = doPassThrough(s, input, cred[6:])
+
+	} else if isHashedPassword(cred) {
+		ok, err = verifyPassword(input, cred)
+		if err == errUnsupportedPasswordScheme {
+			// Plain
+			ok, err = input == cred, nil
+		}
 	} else {
 		// Plain
 		ok = input == cred
 	}
 
 	if err != nil {
-		if err.Error() == "hash does not match password" {
-			log.Printf("info: Invalid bindDN/credential. err: %+v", err)
-		} else {
-			log.Printf("error: Failed to authenticate. err: %+v", err)
-		}
+		log.Printf("error: Failed to authenticate. err: %+v", err)
 	}
 
 	return ok
@@ -191,3 +185,19 @@ func saveAuthencatedDN(m *ldap.Message, dn *DN) {
 	session["dn"] = dn
 	log.Printf("Saved authenticated DN: %s", dn.DNNormStr())
 }
+
+const passwordResetRequiredMsg = "Operations are restricted to bind/unbind/abandon/StartTLS/modify password"
+
+// savePasswordReset saves whether the authenticated user must change the password.
+func savePasswordReset(m *ldap.Message, reset bool) {
+	session := getSession(m)
+	if reset {
+		log.Printf("info: The password must be changed. DN: %s", getAuthSession(m)["dn"].DNNormStr())
+	}
+	session["pwdReset"] = reset
+}
+
+func isPasswordResetRequired(m *ldap.Message) bool {
+	reset, ok := getSession(m)["pwdReset"].(bool)
+	return ok && reset
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 
 	ldap "github.com/openstandia/ldapserver"
+	"golang.org/x/xerrors"
 )
 
 // The resultCode is set to compareTrue, compareFalse, or an appropriate
@@ -14,14 +15,55 @@ import (
 // subtype did not match.  Other result codes indicate either that the
 // result of the comparison was Undefined, or that
 // some error occurred.
-func handleCompare(w ldap.ResponseWriter, m *ldap.Message) {
+func handleCompare(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetCompareRequest()
-	log.Printf("[INFO] Comparing entry: %s", r.Entry())
-	//attributes values
-	log.Printf(" attribute name to compare : \"%s\"", r.Ava().AttributeDesc())
-	log.Printf(" attribute value expected : \"%s\"", r.Ava().AssertionValue())
+	dn, err := s.NormalizeDN(string(r.Entry()))
+	if err != nil {
+		log.Printf("warn: Invalid dn: %s err: %s", r.Entry(), err)
+		responseCompareError(w, NewInvalidDNSyntax())
+		return
+	}
 
-	res := ldap.NewCompareResponse(ldap.LDAPResultCompareTrue)
+	attr := string(r.Ava().AttributeDesc())
+	value := string(r.Ava().AssertionValue())
 
-	w.Write(res)
+	// Check the access before touching the entry not to reveal the existence.
+	// Note: Compare inherits the TODO authorization of requiredAuthz. Any bound user can compare the attributes
+	// of any entry except userPassword of the others, and can learn the existence of the entry by them.
+	if !requiredReadAttrAuthz(s, m, dn, attr) {
+		responseCompareError(w, NewInsufficientAccess())
+		return
+	}
+
+	log.Printf("info: Comparing entry: %s, attribute: %s", dn.DNNormStr(), attr)
+
+	matched, err := s.Repo().Compare(dn, attr, value)
+	if err != nil {
+		responseCompareError(w, err)
+		return
+	}
+
+	if matched {
+		w.Write(ldap.NewCompareResponse(ldap.LDAPResultCompareTrue))
+	} else {
+		w.Write(ldap.NewCompareResponse(ldap.LDAPResultCompareFalse))
+	}
+}
+
+func responseCompareError(w ldap.ResponseWriter, err error) {
+	var ldapErr *LDAPError
+	if ok := xerrors.As(err, &ldapErr); ok {
+		log.Printf("warn: Compare LDAP error. err: %+v", err)
+
+		res := ldap.NewCompareResponse(ldapErr.Code)
+		if ldapErr.Msg != "" {
+			res.SetDiagnosticMessage(ldapErr.Msg)
+		}
+		w.Write(res)
+	} else {
+		log.Printf("error: Compare error. err: %+v", err)
+
+		res := ldap.NewCompareResponse(responseCode(err))
+		w.Write(res)
+	}
 }
@@ -7,6 +7,21 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// See https://tools.ietf.org/html/draft-armijo-ldap-treedelete-02
+const treeDeleteControlOID = "1.2.840.113556.1.4.805"
+
+func hasTreeDeleteControl(m *ldap.Message) bool {
+	if m.Controls() == nil {
+		return false
+	}
+	for _, con := range *m.Controls() {
+		if string(con.ControlType()) == treeDeleteControlOID {
+			return true
+		}
+	}
+	return false
+}
+
 func handleDelete(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetDeleteRequest()
 	dn, err := s.NormalizeDN(string(r))
@@ -26,7 +41,12 @@ func handleDelete(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 
 	log.Printf("info: Deleting entry: %s", dn.DNNormStr())
 
-	err = s.Repo().DeleteByDN(dn)
+	if hasTreeDeleteControl(m) {
+		log.Printf("info: Deleting the subtree by tree delete control: %s", dn.DNNormStr())
+		err = s.Repo().DeleteTree(dn)
+	} else {
+		err = s.Repo().DeleteByDN(dn)
+	}
 	if err != nil {
 		log.Printf("info: Failed to delete entry: %#v", err)
 
@@ -52,8 +72,7 @@ func responseDeleteError(w ldap.ResponseWriter, err error) {
 		w.Write(res)
 	} else {
 		log.Printf("error: Delete error. err: %+v", err)
-		// TODO
-		res := ldap.NewDeleteResponse(ldap.LDAPResultProtocolError)
+		res := ldap.NewDeleteResponse(responseCode(err))
 		w.Write(res)
 	}
 }
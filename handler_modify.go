@@ -1,8 +1,8 @@
 package main
 
 import (
-	"database/sql"
 	"log"
+	"strconv"
 
 	ldap "github.com/openstandia/ldapserver"
 	"golang.org/x/xerrors"
@@ -28,20 +28,8 @@ func handleModify(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 
 	log.Printf("info: Modify entry: %s", dn.DNNormStr())
 
-	tx := s.Repo().db.MustBegin()
-
-	oldEntry, err := s.Repo().FindEntryByDN(tx, dn, true)
-	if err != nil {
-		rollback(tx)
-		if err == sql.ErrNoRows {
-			responseModifyError(w, NewNoSuchObject())
-			return
-		}
-		responseModifyError(w, xerrors.Errorf("Failed to fetch the current entry for modification. dn: %s, err: %w", dn.DNNormStr(), err))
-		return
-	}
-
-	newEntry := oldEntry.Clone()
+	var mods []*Modification
+	var expectedRev int64
 
 	for _, change := range r.Changes() {
 		modification := change.Modification()
@@ -55,50 +43,67 @@ func handleModify(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 			log.Printf("--> value: %s", attributeValue)
 		}
 
-		var err error
-
-		switch change.Operation() {
-		case ldap.ModifyRequestChangeOperationAdd:
-			err = newEntry.Add(attrName, values)
-
-		case ldap.ModifyRequestChangeOperationDelete:
-			err = newEntry.Delete(attrName, values)
-
-		case ldap.ModifyRequestChangeOperationReplace:
-			err = newEntry.Replace(attrName, values)
+		// Deleting the current entryRev means the precondition for optimistic concurrency control
+		if change.Operation() == ldap.ModifyRequestChangeOperationDelete && isEntryRevAttr(attrName) {
+			if len(values) != 1 {
+				responseModifyError(w, NewMultipleValuesProvidedError(attrName))
+				return
+			}
+			expectedRev, err = strconv.ParseInt(values[0], 10, 64)
+			if err != nil || expectedRev < 1 {
+				responseModifyError(w, NewInvalidPerSyntax(attrName, 0))
+				return
+			}
+			continue
 		}
 
-		if err != nil {
-			rollback(tx)
-
-			responseModifyError(w, xerrors.Errorf("Failed to modify the entry. dn: %s, err: %w", dn.DNNormStr(), err))
-			return
-		}
+		mods = append(mods, &Modification{
+			Op:     int(change.Operation()),
+			Attr:   attrName,
+			Values: values,
+		})
 	}
 
-	log.Printf("Update entry. oldEntry: %v, newEntry: %v", oldEntry, newEntry)
-
-	err = s.Repo().Update(tx, oldEntry, newEntry)
+	requester := getAuthSession(m)["dn"]
 
-	if err != nil {
-		rollback(tx)
-
-		// TODO error code
-		responseModifyError(w, xerrors.Errorf("Failed to modify the entry. dn: %s, entry: %v, err: %w", dn.DNNormStr(), newEntry, err))
+	// Only the own password can be changed until the reset password is changed
+	if isPasswordResetRequired(m) && !isPasswordChangeOnly(requester, dn, mods) {
+		responseModifyError(w, NewInsufficientAccessWithMsg(passwordResetRequiredMsg))
 		return
 	}
 
-	err = tx.Commit()
+	err = s.Repo().ModifyWithExpectedRev(dn, mods, expectedRev, requester)
 	if err != nil {
-		rollback(tx)
-		responseModifyError(w, xerrors.Errorf("Failed to commit of modify entry operation. dn: %s, err: %w", dn.DNNormStr(), err))
+		responseModifyError(w, err)
 		return
 	}
 
+	if isPasswordResetRequired(m) {
+		savePasswordReset(m, false)
+	}
+
 	res := ldap.NewModifyResponse(ldap.LDAPResultSuccess)
 	w.Write(res)
 }
 
+func isPasswordChangeOnly(requester, dn *DN, mods []*Modification) bool {
+	if requester == nil || !requester.Equal(dn) {
+		return false
+	}
+	for _, mod := range mods {
+		s, ok := schemaMap.Get(mod.Attr)
+		if !ok || s.Name != "userPassword" {
+			return false
+		}
+	}
+	return true
+}
+
+func isEntryRevAttr(attrName string) bool {
+	s, ok := schemaMap.Get(attrName)
+	return ok && s.Name == "entryRev"
+}
+
 func responseModifyError(w ldap.ResponseWriter, err error) {
 	var ldapErr *LDAPError
 	if ok := xerrors.As(err, &ldapErr); ok {
@@ -112,8 +117,7 @@ func responseModifyError(w ldap.ResponseWriter, err error) {
 	} else {
 		log.Printf("error: Modify error. err: %+v", err)
 
-		// TODO
-		res := ldap.NewModifyResponse(ldap.LDAPResultProtocolError)
+		res := ldap.NewModifyResponse(responseCode(err))
 		w.Write(res)
 	}
 }
@@ -24,27 +24,12 @@ func handleModifyDN(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
-	newDN, oldRDN, err := dn.ModifyRDN(string(r.NewRDN()), bool(r.DeleteOldRDN()))
-
-	if err != nil {
-		// TODO return correct error
-		log.Printf("info: Invalid newrdn. dn: %s newrdn: %s err: %#v", dn.DNNormStr(), r.NewRDN(), err)
-		responseModifyDNError(w, err)
-		return
-	}
-
 	log.Printf("info: Modify DN entry: %s", dn.DNNormStr())
 
+	var newParentDN *DN
 	if r.NewSuperior() != nil {
 		sup := string(*r.NewSuperior())
-		newParentDN, err := s.NormalizeDN(sup)
-		if err != nil {
-			// TODO return correct error
-			responseModifyDNError(w, NewInvalidDNSyntax())
-			return
-		}
-
-		newDN, err = newDN.Move(newParentDN)
+		newParentDN, err = s.NormalizeDN(sup)
 		if err != nil {
 			// TODO return correct error
 			responseModifyDNError(w, NewInvalidDNSyntax())
@@ -52,10 +37,9 @@ func handleModifyDN(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		}
 	}
 
-	err = s.Repo().UpdateDN(dn, newDN, oldRDN)
+	err = s.Repo().ModDN(dn, string(r.NewRDN()), newParentDN, bool(r.DeleteOldRDN()), getAuthSession(m)["dn"])
 	if err != nil {
 		log.Printf("warn: Failed to modify dn: %s err: %+v", dn.DNNormStr(), err)
-		// TODO error code
 		responseModifyDNError(w, err)
 		return
 	}
@@ -77,8 +61,7 @@ func responseModifyDNError(w ldap.ResponseWriter, err error) {
 	} else {
 		log.Printf("error: ModifyDN error. err: %+v", err)
 
-		// TODO
-		res := ldap.NewModifyDNResponse(ldap.LDAPResultProtocolError)
+		res := ldap.NewModifyDNResponse(responseCode(err))
 		w.Write(res)
 	}
 }
@@ -7,6 +7,46 @@ import (
 	ldap "github.com/openstandia/ldapserver"
 )
 
+// supportedControls are the request controls which this server implements.
+var supportedControls = []string{
+	string(message.PagedResultsControlOID),
+	treeDeleteControlOID,
+	sortRequestControlOID,
+	vlvRequestControlOID,
+}
+
+// namingContexts returns the contexts held by the server from the root entries.
+// The suffix is advertised for the root entry which contains it, since the entries above the suffix
+// can't be reached. The suffix is returned if there is no root entry yet.
+func namingContexts(suffix *DN, roots []*DN) []string {
+	var suffixRoot *DN
+	if suffix != nil && len(suffix.RDNs) > 0 {
+		suffixRoot = &DN{RDNs: suffix.RDNs[len(suffix.RDNs)-1:]}
+	}
+
+	contexts := []string{}
+	seen := map[string]struct{}{}
+	add := func(dn *DN) {
+		if _, ok := seen[dn.DNNormStr()]; ok {
+			return
+		}
+		seen[dn.DNNormStr()] = struct{}{}
+		contexts = append(contexts, dn.DNOrigStr())
+	}
+
+	for _, root := range roots {
+		if suffixRoot != nil && root.Equal(suffixRoot) {
+			add(suffix)
+		} else {
+			add(root)
+		}
+	}
+	if len(contexts) == 0 && suffix != nil {
+		add(suffix)
+	}
+	return contexts
+}
+
 func handleSearchDSE(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
 
@@ -17,23 +57,28 @@ func handleSearchDSE(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 	log.Printf("info: Request Attributes=%s", r.Attributes())
 	log.Printf("info: Request TimeLimit=%d", r.TimeLimit().Int())
 
+	contexts := []string{s.GetSuffix()}
+	suffix, err := s.NormalizeDN(s.GetSuffix())
+	if err != nil {
+		log.Printf("warn: Failed to normalize the suffix. suffix: %s, err: %v", s.GetSuffix(), err)
+	} else if roots, err := s.Repo().FindRootDNs(); err != nil {
+		// The root DSE should be returned for the discovery even if the DB is unavailable
+		log.Printf("warn: Failed to find the naming contexts, use the suffix. err: %v", err)
+	} else {
+		contexts = namingContexts(suffix, roots)
+	}
+
 	e := ldap.NewSearchResultEntry("")
-	// e.AddAttribute("vendorName", "OpenStandia")
-	// e.AddAttribute("vendorVersion", "0.0.1")
-	// e.AddAttribute("objectClass", "top")
-	// e.AddAttribute("namingContexts", "ou=system", "ou=schema", "dc=example,dc=com", "ou=config")
 
 	searchEntry := NewSearchEntry(nil, map[string][]string{
 		"objectClass":          {"top"},
 		"subschemaSubentry":    {"cn=Subschema"},
-		"namingContexts":       {s.GetSuffix()},
+		"namingContexts":       contexts,
 		"supportedLDAPVersion": {"3"},
 		"supportedFeatures": {
 			"1.3.6.1.4.1.4203.1.5.1",
 		},
-		"supportedControl": {
-			"1.2.840.113556.1.4.319",
-		},
+		"supportedControl": supportedControls,
 	})
 
 	sentAttrs := map[string]struct{}{}
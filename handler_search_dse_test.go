@@ -0,0 +1,45 @@
+// +build !integration
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNamingContexts(t *testing.T) {
+	mustDN := func(s string) *DN {
+		dn, err := NormalizeDN(s)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return dn
+	}
+
+	suffix := mustDN("dc=Example,dc=com")
+
+	testcases := []struct {
+		roots  []*DN
+		expect []string
+	}{
+		{
+			nil,
+			[]string{"dc=Example,dc=com"},
+		},
+		{
+			[]*DN{mustDN("dc=com")},
+			[]string{"dc=Example,dc=com"},
+		},
+		{
+			[]*DN{mustDN("dc=COM"), mustDN("o=Test"), mustDN("dc=com")},
+			[]string{"dc=Example,dc=com", "o=Test"},
+		},
+	}
+
+	for i, tc := range testcases {
+		got := namingContexts(suffix, tc.roots)
+		if !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("#%d: Unexpected naming contexts. want: %v, got: %v", i, tc.expect, got)
+		}
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"log"
+	"math"
 	"strconv"
 	"strings"
 
-	"github.com/google/uuid"
 	"github.com/openstandia/goldap/message"
 	ldap "github.com/openstandia/ldapserver"
 	"golang.org/x/xerrors"
@@ -91,30 +91,163 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
-	// Phase 4: execute SQL and return entries
+	// Phase 4: server side sorting
+	var controls message.Controls
+	searchKey := pageSearchKey(baseDN, r)
+	if sortControl, ok := getSortControl(m); ok {
+		var value string
+		if sortControl.ControlValue() != nil {
+			value = string(*sortControl.ControlValue())
+		}
+		keys, err := parseSortKeys(value)
+		if err != nil {
+			log.Printf("info: Invalid sort control. err: %v", err)
+			res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultProtocolError)
+			w.Write(res)
+			return
+		}
+
+		code, attr := ldap.LDAPResultSuccess, ""
+		if err := resolveSortKeys(schemaMap, keys); err != nil {
+			var sortErr *SortKeyError
+			xerrors.As(err, &sortErr)
+			log.Printf("info: Can't sort. err: %v", err)
+			code, attr = sortErr.Code, sortErr.AttributeType
+		} else {
+			q.SortKeys = keys
+			searchKey += "\x00" + value
+		}
+
+		control, err := newSortResultControl(code, attr)
+		if err != nil {
+			responseSearchError(w, err)
+			return
+		}
+		controls = append(controls, control)
+
+		// https://tools.ietf.org/html/rfc2891#section-1.1
+		// Return the unsorted results if the control is not critical
+		if code != ldap.LDAPResultSuccess && bool(sortControl.Criticality()) {
+			res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultUnavailableCriticalExtension)
+			w.WriteControls(res, &controls)
+			return
+		}
+	}
+
+	// Phase 5: virtual list view, it requires the sorted results
+	var vlv *VLVRequest
+	if vlvControl, ok := getVLVControl(m); ok {
+		var value string
+		if vlvControl.ControlValue() != nil {
+			value = string(*vlvControl.ControlValue())
+		}
+		vlv, err = parseVLVRequest(value)
+		if err != nil {
+			log.Printf("info: Invalid VLV control. err: %v", err)
+			res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultProtocolError)
+			w.Write(res)
+			return
+		}
+
+		code := ldap.LDAPResultSuccess
+		if len(q.SortKeys) == 0 {
+			code = vlvResultSortControlMissing
+		} else if vlv.GreaterThanOrEqual {
+			code = ldap.LDAPResultUnwillingToPerform
+		}
+		if code != ldap.LDAPResultSuccess {
+			responseVLVError(w, code, vlv.ContextID, controls)
+			return
+		}
+
+		if pageControl != nil {
+			log.Printf("info: Ignore paged results control with VLV control")
+			pageControl = nil
+		}
+	}
+
+	// Phase 6: execute SQL and return entries
 	// TODO configurable default pageSize
 	var pageSize int32 = 500
+
+	// The position is the last-seen id, or the offset for sorting
+	var position int64
+	var reqCookie string
 	if pageControl != nil {
+		// https://www.ietf.org/rfc/rfc2696.txt
+		// Size zero means the client abandons the paged search
+		if pageControl.Size() == 0 {
+			responseSearchDone(w, pageControl, 0, "", controls)
+			return
+		}
 		pageSize = pageControl.Size()
-	}
 
-	sessionMap := getPageSession(m)
-	var offset int32
-	if pageControl != nil {
-		reqCookie := pageControl.Cookie()
+		reqCookie = pageControl.Cookie()
 		if reqCookie != "" {
-			offset = sessionMap[reqCookie]
-			// clear
-			delete(sessionMap, reqCookie)
+			position, err = decodePageCookie(s.cookieKey, searchKey, reqCookie)
+			if err != nil {
+				log.Printf("warn: Invalid paged results cookie. err: %v", err)
+				responseSearchError(w, NewUnwillingToPerform("invalid paged results cookie"))
+				return
+			}
+		}
+	}
+
+	where, err := s.Repo().SearchWhere(baseDN, scope, q)
+	if err != nil {
+		responseSearchError(w, err)
+		return
+	}
+
+	// The total count is returned in the paged results and VLV response controls.
+	// The estimate is enough for the size of the paged results, but VLV needs the exact count
+	// to compute the target position and the window. The following pages of the paged results
+	// return 0 as unknown not to count on every page.
+	var total int64
+	if vlv != nil || (pageControl != nil && reqCookie == "") {
+		total, _, err = s.Repo().Count(where, q, vlv != nil)
+		if err != nil {
+			responseSearchError(w, err)
+			return
 		}
 	}
 
+	if vlv != nil {
+		target, offset, limit, err := vlv.window(total)
+		if err != nil {
+			log.Printf("info: Invalid VLV target. err: %v", err)
+			responseVLVError(w, vlvResultOffsetRangeError, vlv.ContextID, controls)
+			return
+		}
+		control, err := newVLVResponseControl(target, total, ldap.LDAPResultSuccess, vlv.ContextID)
+		if err != nil {
+			responseSearchError(w, err)
+			return
+		}
+		controls = append(controls, control)
+
+		if limit == 0 {
+			responseSearchDone(w, nil, 0, "", controls)
+			return
+		}
+		if limit > math.MaxInt32 {
+			limit = math.MaxInt32
+		}
+		position, pageSize = offset, int32(limit)
+	}
+
 	q.Params["pageSize"] = pageSize
-	q.Params["offset"] = offset
+	if len(q.SortKeys) > 0 {
+		q.Params["offset"] = position
+	} else {
+		q.Params["lastID"] = position
+	}
 
-	maxCount, limittedCount, err := s.Repo().Search(baseDN, scope, q,
+	var lastSentID int64
+	count, hasMore, err := s.Repo().Search(where, q,
 		getRequestedMemberAttrs(r), isMemberOfRequested(r), isHasSubOrdinatesRequested(r), func(searchEntry *SearchEntry) error {
 			responseEntry(s, w, r, searchEntry)
+			lastSentID = searchEntry.dbEntryID
 			return nil
 		})
 	if err != nil {
@@ -122,36 +255,58 @@ func handleSearch(s *Server, w ldap.ResponseWriter, m *ldap.Message) {
 		return
 	}
 
-	if maxCount == 0 {
+	if count == 0 {
 		log.Printf("debug: Not found")
-
-		// Must return success if no hit
-		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
-		w.Write(res)
-		return
 	}
 
+	// The remaining entries are fetched by keyset pagination with the last-seen id.
+	// An empty cookie means the final page.
 	var nextCookie string
+	if hasMore {
+		if len(q.SortKeys) > 0 {
+			nextCookie = encodePageCookie(s.cookieKey, searchKey, position+int64(count))
+		} else {
+			nextCookie = encodePageCookie(s.cookieKey, searchKey, lastSentID)
+		}
+	}
 
-	if limittedCount+offset < maxCount {
-		uuid, _ := uuid.NewRandom()
-		nextCookie = uuid.String()
+	// Must return success if no hit
+	responseSearchDone(w, pageControl, total, nextCookie, controls)
+}
 
-		sessionMap := getPageSession(m)
-		sessionMap[nextCookie] = offset + pageSize
+// responseSearchDone returns success with the response controls.
+// The paged results control is added with the total count if it's requested.
+func responseSearchDone(w ldap.ResponseWriter, pageControl *message.SimplePagedResultsControl, total int64, cookie string, controls message.Controls) {
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+
+	if pageControl != nil {
+		// https://www.ietf.org/rfc/rfc2696.txt
+		// The size of the response is the estimate of the total count
+		if total > math.MaxInt32 {
+			total = math.MaxInt32
+		}
+		controls = append(controls, message.NewSimplePagedResultsControl(int32(total), false, cookie))
+	}
+	if len(controls) == 0 {
+		w.Write(res)
+		return
 	}
 
-	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.WriteControls(res, &controls)
+}
 
-	// https://www.ietf.org/rfc/rfc2696.txt
-	if nextCookie != "" {
-		control := message.NewSimplePagedResultsControl(pageSize, false, nextCookie)
-		var controls message.Controls = []message.Control{control}
+// responseVLVError returns the error of the virtual list view with the response control.
+func responseVLVError(w ldap.ResponseWriter, code int, contextID string, controls message.Controls) {
+	res := ldap.NewSearchResultDoneResponse(code)
 
-		w.WriteControls(res, &controls)
-	} else {
-		w.Write(res)
+	control, err := newVLVResponseControl(0, 0, code, contextID)
+	if err != nil {
+		responseSearchError(w, err)
+		return
 	}
+	controls = append(controls, control)
+
+	w.WriteControls(res, &controls)
 }
 
 func responseEntry(s *Server, w ldap.ResponseWriter, r message.SearchRequest, searchEntry *SearchEntry) {
@@ -231,8 +386,7 @@ func responseSearchError(w ldap.ResponseWriter, err error) {
 	} else {
 		log.Printf("error: Search error. err: %+v", err)
 
-		// TODO
-		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultProtocolError)
+		res := ldap.NewSearchResultDoneResponse(responseCode(err))
 		w.Write(res)
 	}
 }
@@ -8,6 +8,44 @@ import (
 	ldap "github.com/openstandia/ldapserver"
 )
 
+var subschemaObjectClasses = []string{"top", "subentry", "subschema", "extensibleObject"}
+
+// matchSubschemaFilter returns true if the subschema entry matches the filter.
+// Only objectClass is evaluated since clients find the subschema by it,
+// the assertions of the other attributes don't match.
+func matchSubschemaFilter(f message.Filter) bool {
+	switch f := f.(type) {
+	case message.FilterAnd:
+		for _, c := range f {
+			if !matchSubschemaFilter(c) {
+				return false
+			}
+		}
+		return true
+	case message.FilterOr:
+		for _, c := range f {
+			if matchSubschemaFilter(c) {
+				return true
+			}
+		}
+		return false
+	case message.FilterNot:
+		return !matchSubschemaFilter(f.Filter)
+	case message.FilterPresent:
+		return strings.EqualFold(string(f), "objectClass")
+	case message.FilterEqualityMatch:
+		if !strings.EqualFold(string(f.AttributeDesc()), "objectClass") {
+			return false
+		}
+		for _, oc := range subschemaObjectClasses {
+			if strings.EqualFold(string(f.AssertionValue()), oc) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func handleSearchSubschema(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
 
@@ -26,10 +64,17 @@ func handleSearchSubschema(w ldap.ResponseWriter, m *ldap.Message) {
 	default:
 	}
 
+	// The base search which doesn't match returns no entry
+	if !matchSubschemaFilter(r.Filter()) {
+		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+		w.Write(res)
+		return
+	}
+
 	e := ldap.NewSearchResultEntry(string(r.BaseObject()))
 
 	searchEntry := NewSearchEntry(nil, map[string][]string{
-		"objectClass": {"top", "subentry", "subschema", "extensibleObject"},
+		"objectClass": subschemaObjectClasses,
 		"cn":          {"Subschema"},
 	})
 
@@ -0,0 +1,34 @@
+//go:build !integration
+// +build !integration
+
+package main
+
+import (
+	"testing"
+
+	"github.com/openstandia/goldap/message"
+)
+
+func TestMatchSubschemaFilter(t *testing.T) {
+	testcases := []struct {
+		filter message.Filter
+		expect bool
+	}{
+		{message.FilterPresent("objectClass"), true},
+		{message.FilterPresent("objectclass"), true},
+		{message.NewFilterEqualityMatch("objectClass", "subschema"), true},
+		{message.NewFilterEqualityMatch("objectClass", "subSchema"), true},
+		{message.NewFilterEqualityMatch("objectClass", "person"), false},
+		{message.NewFilterEqualityMatch("cn", "Subschema"), false},
+		{message.FilterPresent("cn"), false},
+		{message.FilterAnd{message.FilterPresent("objectClass"), message.NewFilterEqualityMatch("objectClass", "person")}, false},
+		{message.FilterOr{message.NewFilterEqualityMatch("objectClass", "person"), message.NewFilterEqualityMatch("objectClass", "subentry")}, true},
+		{message.FilterNot{Filter: message.NewFilterEqualityMatch("objectClass", "person")}, true},
+	}
+
+	for i, tc := range testcases {
+		if got := matchSubschemaFilter(tc.filter); got != tc.expect {
+			t.Errorf("#%d: Unexpected result. filter: %v, want: %v, got: %v", i, tc.filter, tc.expect, got)
+		}
+	}
+}
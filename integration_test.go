@@ -3,8 +3,12 @@
 package main
 
 import (
+	"context"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 )
@@ -106,7 +110,26 @@ func TestRootDSE(t *testing.T) {
 						"namingContexts":       A{server.GetSuffix()},
 						"supportedLDAPVersion": A{"3"},
 						"supportedFeatures":    A{"1.3.6.1.4.1.4203.1.5.1"},
-						"supportedControl":     A{"1.2.840.113556.1.4.319"},
+						"supportedControl":     A{"1.2.840.113556.1.4.319", "1.2.840.113556.1.4.805", "1.2.840.113556.1.4.473", "2.16.840.1.113730.3.4.9"},
+					},
+				},
+			},
+		},
+		// The suffix is advertised for the root entry which contains it
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		Search{
+			"",
+			"objectClass=*",
+			ldap.ScopeBaseObject,
+			A{"namingContexts"},
+			&AssertEntries{
+				ExpectEntry{
+					"",
+					"",
+					M{
+						"namingContexts": A{server.GetSuffix()},
 					},
 				},
 			},
@@ -139,6 +162,29 @@ func TestSearchSchema(t *testing.T) {
 				},
 			},
 		},
+		Search{
+			"cn=Subschema",
+			"objectClass=subschema",
+			ldap.ScopeBaseObject,
+			A{"objectClass"},
+			&AssertEntries{
+				ExpectEntry{
+					"",
+					"cn=Subschema",
+					M{
+						"objectClass": A{"top", "subentry", "subschema", "extensibleObject"},
+					},
+				},
+			},
+		},
+		// The filter which doesn't match the subschema entry
+		Search{
+			"cn=Subschema",
+			"objectClass=person",
+			ldap.ScopeBaseObject,
+			A{"objectClass"},
+			&AssertEntries{},
+		},
 	}
 
 	runTestCases(t, tcs)
@@ -765,6 +811,181 @@ func TestBasicCRUD(t *testing.T) {
 			true,
 			&AssertRename{},
 		},
+		// Move onto the subordinate case
+		ModifyDN{
+			"ou=Groups", "",
+			"ou=Groups",
+			true,
+			"ou=Users,ou=Groups",
+			true,
+			&AssertLDAPError{53},
+		},
+		Add{
+			"uid=user2", "ou=Users,ou=Groups",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user2"},
+			},
+			&AssertEntry{},
+		},
+		// Rename onto the existing sibling case
+		ModifyDN{
+			"uid=user1", "ou=Users,ou=Groups",
+			"uid=user2",
+			true,
+			"",
+			false,
+			&AssertLDAPError{68},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestInsertBatch(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		// Children first, it should be sorted by the depth
+		InsertBatch{
+			[]Add{
+				{"uid=user1", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user1"}}, nil},
+				{"uid=user2", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user2"}}, nil},
+				{"ou=Users", "", M{"objectClass": A{"organizationalUnit"}}, nil},
+				{"dc=example", "dc=com", M{"objectClass": A{"top", "dcObject", "organization"}, "o": A{"example"}}, nil},
+				{"dc=com", "", M{"objectClass": A{"top", "dcObject", "organization"}, "o": A{"com"}}, nil},
+			},
+			false,
+			nil,
+		},
+		Search{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeSingleLevel,
+			A{"uid"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"uid": A{"user1"}}},
+				ExpectEntry{"uid=user2", "ou=Users", M{"uid": A{"user2"}}},
+			},
+		},
+		// Rollback all when an entry fails
+		InsertBatch{
+			[]Add{
+				{"uid=user3", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user3"}}, nil},
+				{"uid=user1", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user1"}}, nil},
+			},
+			false,
+			[]int{1},
+		},
+		Search{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeSingleLevel,
+			A{"uid"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"uid": A{"user1"}}},
+				ExpectEntry{"uid=user2", "ou=Users", M{"uid": A{"user2"}}},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+
+	tcs = []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		InsertBatch{
+			[]Add{
+				{"uid=user1", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user1"}}, nil},
+				{"uid=user1", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user1"}}, nil},
+				{"uid=user2", "ou=NotFound", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user2"}}, nil},
+				{"uid=user3", "ou=Users", M{"objectClass": A{"inetOrgPerson"}, "sn": A{"user3"}}, nil},
+			},
+			true,
+			[]int{1, 2},
+		},
+		Search{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeSingleLevel,
+			A{"uid"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"uid": A{"user1"}}},
+				ExpectEntry{"uid=user3", "ou=Users", M{"uid": A{"user3"}}},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestDeleteTree(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		AddOU("Sub", "ou=Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Sub,ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user2"},
+			},
+			&AssertEntry{},
+		},
+		AddOU("Groups"),
+		Add{
+			"cn=group1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"uid=user1,ou=Users," + server.GetSuffix(), "uid=user2,ou=Sub,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		DeleteTree{
+			"ou=Users", "",
+			&AssertNoEntry{},
+		},
+		Search{
+			server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			nil,
+			&AssertEntries{},
+		},
+		// Leaf entry
+		DeleteTree{
+			"cn=group1", "ou=Groups",
+			&AssertNoEntry{},
+		},
+		Search{
+			"ou=Groups," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeWholeSubtree,
+			nil,
+			&AssertEntries{
+				ExpectEntry{"ou=Groups", "", nil},
+			},
+		},
 	}
 
 	runTestCases(t, tcs)
@@ -910,3 +1131,946 @@ func TestMemberOf(t *testing.T) {
 
 	runTestCases(t, tcs)
 }
+
+func TestSearchWithPaging(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+	}
+	expected := AssertEntries{}
+	for i := 1; i <= 5; i++ {
+		uid := "user" + strconv.Itoa(i)
+		tcs = append(tcs, Add{
+			"uid=" + uid, "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{uid},
+			},
+			&AssertEntry{},
+		})
+		expected = append(expected, ExpectEntry{"uid=" + uid, "ou=Users", M{"sn": A{uid}}})
+	}
+	tcs = append(tcs,
+		SearchWithPaging{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			A{"sn"},
+			2,
+			&expected,
+		},
+		// Page size is bigger than the result
+		SearchWithPaging{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			A{"sn"},
+			10,
+			&expected,
+		},
+	)
+
+	runTestCases(t, tcs)
+}
+
+func TestSearchWithSort(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":    A{"inetOrgPerson"},
+				"sn":             A{"Charlie"},
+				"givenName":      A{"b"},
+				"employeeNumber": A{"100"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass":    A{"inetOrgPerson"},
+				"sn":             A{"alice"},
+				"employeeNumber": A{"9"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user3", "ou=Users",
+			M{
+				"objectClass":    A{"inetOrgPerson"},
+				"sn":             A{"Bob"},
+				"givenName":      A{"a"},
+				"employeeNumber": A{"10"},
+			},
+			&AssertEntry{},
+		},
+		SearchWithSort{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			[]string{"sn"},
+			[]string{"uid=user2", "uid=user3", "uid=user1"},
+		},
+		SearchWithSort{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			[]string{"-sn"},
+			[]string{"uid=user1", "uid=user3", "uid=user2"},
+		},
+		// The entry without the attribute sorts last
+		SearchWithSort{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			[]string{"givenName"},
+			[]string{"uid=user3", "uid=user1", "uid=user2"},
+		},
+		// The numeric strings of the different lengths are sorted as the numbers
+		SearchWithSort{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			[]string{"employeeNumber:numericStringOrderingMatch"},
+			[]string{"uid=user2", "uid=user3", "uid=user1"},
+		},
+		SearchWithSort{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			ldap.ScopeWholeSubtree,
+			[]string{"-employeeNumber:2.5.13.9"},
+			[]string{"uid=user1", "uid=user3", "uid=user2"},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestSearchWithVLV(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+	}
+	for i, sn := range []string{"e", "d", "c", "b", "a"} {
+		tcs = append(tcs, Add{
+			"uid=user" + strconv.Itoa(i+1), "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{sn},
+			},
+			&AssertEntry{},
+		})
+	}
+	tcs = append(tcs,
+		SearchWithVLV{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			[]string{"sn"},
+			1, 1, 3, 0,
+			[]string{"uid=user4", "uid=user3", "uid=user2"},
+			3, 5,
+		},
+		// The window is clipped at the first entry
+		SearchWithVLV{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			[]string{"sn"},
+			2, 1, 1, 0,
+			[]string{"uid=user5", "uid=user4"},
+			1, 5,
+		},
+		// The offset is scaled by the content count of the client
+		SearchWithVLV{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			[]string{"sn"},
+			0, 0, 5, 10,
+			[]string{"uid=user3"},
+			3, 5,
+		},
+		SearchWithVLV{
+			"ou=Users," + server.GetSuffix(),
+			"objectclass=inetOrgPerson",
+			[]string{"-sn"},
+			1, 0, 10, 10,
+			[]string{"uid=user4", "uid=user5"},
+			5, 5,
+		},
+	)
+
+	runTestCases(t, tcs)
+}
+
+func TestModifyWithRev(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		Search{
+			"uid=user1,ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeBaseObject,
+			A{"entryRev"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"entryRev": A{"1"}}},
+			},
+		},
+		ModifyReplaceWithRev{
+			"uid=user1", "ou=Users",
+			"1",
+			M{
+				"sn": A{"user1-1"},
+			},
+			&AssertEntry{},
+		},
+		Search{
+			"uid=user1,ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeBaseObject,
+			A{"entryRev"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"entryRev": A{"2"}}},
+			},
+		},
+		// Stale rev
+		ModifyReplaceWithRev{
+			"uid=user1", "ou=Users",
+			"1",
+			M{
+				"sn": A{"user1-2"},
+			},
+			&AssertLDAPError{122},
+		},
+		// Without rev
+		ModifyReplace{
+			"uid=user1", "ou=Users",
+			M{
+				"sn": A{"user1-3"},
+			},
+			&AssertEntry{},
+		},
+		Search{
+			"uid=user1,ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeBaseObject,
+			A{"entryRev"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"entryRev": A{"3"}}},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	config := *server.config
+	defer func() {
+		*server.config = config
+	}()
+	server.config.PasswordHashScheme = "SSHA"
+	server.config.PasswordHistory = 2
+	server.config.PasswordMustChange = true
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"sn":           A{"user1"},
+				"userPassword": A{"password1"},
+			},
+			nil,
+		},
+		Search{
+			"uid=user1,ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeBaseObject,
+			A{"pwdReset"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{"pwdReset": A{"TRUE"}}},
+			},
+		},
+		// The hashed password can be used
+		Bind{"uid=user1,ou=Users", "password1", &AssertResponse{}},
+		// The current password can't be reused
+		ModifyPassword{"uid=user1", "ou=Users", "password1", &AssertResponse{19}},
+		ModifyPassword{"uid=user1", "ou=Users", "password2", &AssertResponse{}},
+		ModifyPassword{"uid=user1", "ou=Users", "password1", &AssertResponse{19}},
+		ModifyPassword{"uid=user1", "ou=Users", "password3", &AssertResponse{}},
+		ModifyPassword{"uid=user1", "ou=Users", "password4", &AssertResponse{}},
+		// Only the last 2 passwords are kept in the history
+		ModifyPassword{"uid=user1", "ou=Users", "password2", &AssertResponse{19}},
+		Bind{"uid=user1,ou=Users", "password4", &AssertResponse{}},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		Search{
+			"uid=user1,ou=Users," + server.GetSuffix(),
+			"objectclass=*",
+			ldap.ScopeBaseObject,
+			A{"pwdReset"},
+			&AssertEntries{
+				ExpectEntry{"uid=user1", "ou=Users", M{}},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestChangeNotification(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := server.Repo().Subscribe(ctx)
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		// The rolled back transaction doesn't publish
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertLDAPError{
+				expectErrorCode: ldap.LDAPResultEntryAlreadyExists,
+			},
+		},
+		ModifyReplace{
+			"uid=user1", "ou=Users",
+			M{
+				"givenName": A{"hoge"},
+			},
+			&AssertEntry{},
+		},
+		ModifyDN{
+			"uid=user1", "ou=Users",
+			"uid=user2",
+			true,
+			"",
+			false,
+			&AssertRename{},
+		},
+		Delete{
+			"uid=user2", "ou=Users",
+			&AssertNoEntry{},
+		},
+	}
+
+	runTestCases(t, tcs)
+
+	users := "ou=Users," + server.GetSuffix()
+	expect := []ChangeEvent{
+		{DN: users, Type: ChangeTypeAdd, Rev: 1},
+		{DN: "uid=user1," + users, Type: ChangeTypeAdd, Rev: 1},
+		{DN: "uid=user1," + users, Type: ChangeTypeModify, Rev: 2},
+		{DN: "uid=user2," + users, OldDN: "uid=user1," + users, Type: ChangeTypeModDN, Rev: 3},
+		{DN: "uid=user2," + users, Type: ChangeTypeDelete, Rev: 3},
+	}
+
+	var got []ChangeEvent
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(expect) {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("Unexpected closed subscription")
+			}
+			if !strings.HasSuffix(strings.ToLower(ev.DN), strings.ToLower(users)) {
+				continue
+			}
+			got = append(got, ev)
+		case <-timeout:
+			t.Fatalf("Timeout to receive the change events. got: %v", got)
+		}
+	}
+
+	for i, ev := range got {
+		e := expect[i]
+		if !strings.EqualFold(ev.DN, e.DN) || !strings.EqualFold(ev.OldDN, e.OldDN) || ev.Type != e.Type || ev.Rev != e.Rev {
+			t.Errorf("#%d: Unexpected change event. want: %v, got: %v", i, e, ev)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		AddOU("Groups"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"sn":           A{"user1"},
+				"cn":           A{"User One"},
+				"userPassword": A{"password1"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"sn":           A{"user2"},
+				"userPassword": A{"password2"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=group1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"uid=user1,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		// caseIgnoreMatch
+		Compare{"uid=user1", "ou=Users", "CN", "user one", true, &AssertResponse{}},
+		Compare{"uid=user1", "ou=Users", "cn", "User  One ", true, &AssertResponse{}},
+		Compare{"uid=user1", "ou=Users", "cn", "User Two", false, &AssertResponse{}},
+		// The attribute which the entry doesn't have
+		Compare{"uid=user1", "ou=Users", "description", "foo", false, &AssertResponse{}},
+		// octetStringMatch
+		Compare{"uid=user1", "ou=Users", "userPassword", "password1", true, &AssertResponse{}},
+		Compare{"uid=user1", "ou=Users", "userPassword", "PASSWORD1", false, &AssertResponse{}},
+		// member/memberOf
+		Compare{"cn=group1", "ou=Groups", "member", "UID=user1,ou=users," + server.GetSuffix(), true, &AssertResponse{}},
+		Compare{"cn=group1", "ou=Groups", "member", "uid=user2,ou=Users," + server.GetSuffix(), false, &AssertResponse{}},
+		Compare{"uid=user1", "ou=Users", "memberOf", "cn=group1,ou=Groups," + server.GetSuffix(), true, &AssertResponse{}},
+		Compare{"uid=user2", "ou=Users", "memberOf", "cn=group1,ou=Groups," + server.GetSuffix(), false, &AssertResponse{}},
+		Compare{"uid=notfound", "ou=Users", "cn", "foo", false, &AssertResponse{ldap.LDAPResultNoSuchObject}},
+		Compare{"uid=user1", "ou=Users", "undefined", "foo", false, &AssertResponse{ldap.LDAPResultUndefinedAttributeType}},
+		// The other user can't compare the password
+		Bind{"uid=user2,ou=Users", "password2", &AssertResponse{}},
+		Compare{"uid=user1", "ou=Users", "cn", "User One", true, &AssertResponse{}},
+		Compare{"uid=user1", "ou=Users", "userPassword", "password1", false, &AssertResponse{ldap.LDAPResultInsufficientAccessRights}},
+		Compare{"uid=notfound", "ou=Users", "userPassword", "password1", false, &AssertResponse{ldap.LDAPResultInsufficientAccessRights}},
+		Compare{"uid=user2", "ou=Users", "userPassword", "password2", true, &AssertResponse{}},
+		// The other attributes inherit the TODO authorization, any bound user can compare them
+		Compare{"cn=group1", "ou=Groups", "member", "uid=user1,ou=Users," + server.GetSuffix(), true, &AssertResponse{}},
+		Compare{"uid=notfound", "ou=Users", "cn", "foo", false, &AssertResponse{ldap.LDAPResultNoSuchObject}},
+		// The anonymous can't compare anything
+		Conn{},
+		Compare{"uid=user1", "ou=Users", "cn", "User One", false, &AssertResponse{ldap.LDAPResultInsufficientAccessRights}},
+		Compare{"uid=notfound", "ou=Users", "cn", "foo", false, &AssertResponse{ldap.LDAPResultInsufficientAccessRights}},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestSoftDelete(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	server.config.SoftDelete = true
+	defer func() {
+		server.config.SoftDelete = false
+	}()
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		AddOU("Groups"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=group1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"uid=user1,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		// The tombstone is excluded from the search
+		Delete{
+			"uid=user1", "ou=Users",
+			&AssertNoEntry{},
+		},
+		Compare{"cn=group1", "ou=Groups", "member", "uid=user1,ou=Users," + server.GetSuffix(), false, &AssertResponse{}},
+		// The parent which has only the tombstone can be deleted
+		Delete{
+			"ou=Users", "",
+			&AssertNoEntry{},
+		},
+		// The parent must be live to undelete
+		Undelete{"uid=user1", "ou=Users", ldap.LDAPResultNoSuchObject},
+		Undelete{"ou=Users", "", 0},
+		Undelete{"uid=user1", "ou=Users", 0},
+		Undelete{"uid=user1", "ou=Users", ldap.LDAPResultNoSuchObject},
+		ModifyReplace{
+			"uid=user1", "ou=Users",
+			M{
+				"givenName": A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		// Adding the same DN revives the tombstone
+		Delete{
+			"uid=user1", "ou=Users",
+			&AssertNoEntry{},
+		},
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		// Purge the subtree
+		DeleteTree{
+			"ou=Users", "",
+			&AssertNoEntry{},
+		},
+		Purge{time.Hour, 0},
+		Purge{0, 2},
+		AddOU("Users"),
+		// Renaming onto the DN of the tombstone purges it
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user2"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user3", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user3"},
+			},
+			&AssertEntry{},
+		},
+		Delete{
+			"uid=user2", "ou=Users",
+			&AssertNoEntry{},
+		},
+		ModifyDN{
+			"uid=user3", "ou=Users",
+			"uid=user2",
+			true,
+			"",
+			false,
+			&AssertRename{},
+		},
+		Undelete{"uid=user2", "ou=Users", ldap.LDAPResultNoSuchObject},
+		// Moving onto the DN of the tombstone purges it too
+		Add{
+			"uid=user4", "ou=Groups",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user4"},
+			},
+			&AssertEntry{},
+		},
+		Delete{
+			"uid=user2", "ou=Users",
+			&AssertNoEntry{},
+		},
+		ModifyDN{
+			"uid=user4", "ou=Groups",
+			"uid=user2",
+			true,
+			"ou=Users",
+			false,
+			&AssertRename{},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestModifyDNRoot(t *testing.T) {
+	server.config.SoftDelete = true
+	defer func() {
+		server.config.SoftDelete = false
+	}()
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("org"),
+		AddDC("io"),
+		// The root entries have the same RDN
+		ModifyDN{
+			"dc=org", "",
+			"dc=com",
+			true,
+			"",
+			false,
+			&AssertLDAPError{
+				expectErrorCode: ldap.LDAPResultEntryAlreadyExists,
+			},
+		},
+		// Renaming onto the DN of the root tombstone purges it
+		Delete{
+			"dc=io", "",
+			&AssertNoEntry{},
+		},
+		ModifyDN{
+			"dc=org", "",
+			"dc=io",
+			true,
+			"",
+			false,
+			&AssertRename{},
+		},
+		Undelete{"dc=io", "", ldap.LDAPResultNoSuchObject},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestCreatorsAndModifiersName(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	server.config.MigrationEnabled = false
+	server.LoadSchema()
+
+	manager := "cn=Manager," + server.GetSuffix()
+	user1 := "uid=user1,ou=Users," + server.GetSuffix()
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"sn":           A{"user1"},
+				"userPassword": A{"password1"},
+			},
+			&AssertEntry{},
+		},
+		// The client can't write them
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass":  A{"inetOrgPerson"},
+				"sn":           A{"user2"},
+				"creatorsName": A{"uid=user1,ou=Users," + server.GetSuffix()},
+			},
+			&AssertLDAPError{
+				expectErrorCode: ldap.LDAPResultConstraintViolation,
+			},
+		},
+		// Not returned unless requested
+		Search{
+			"ou=Users," + server.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"*"},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"sn":            A{"user1"},
+						"creatorsName":  A{},
+						"modifiersName": A{},
+					},
+				},
+			},
+		},
+		Search{
+			"ou=Users," + server.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"+"},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"creatorsName":  A{manager},
+						"modifiersName": A{manager},
+					},
+				},
+			},
+		},
+		// The modifier is the bound DN
+		Bind{"uid=user1,ou=Users", "password1", &AssertResponse{}},
+		ModifyReplace{
+			"uid=user1", "ou=Users",
+			M{
+				"givenName": A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		Search{
+			"ou=Users," + server.GetSuffix(),
+			"uid=user1",
+			ldap.ScopeWholeSubtree,
+			A{"creatorsName", "modifiersName"},
+			&AssertEntries{
+				ExpectEntry{
+					"uid=user1",
+					"ou=Users",
+					M{
+						"creatorsName":  A{manager},
+						"modifiersName": A{user1},
+					},
+				},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestRefint(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	server.config.RefintAttrs = "owner"
+	server.LoadSchema()
+	defer func() {
+		server.config.RefintAttrs = ""
+		server.LoadSchema()
+	}()
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		AddOU("Groups"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user2"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=group1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"uid=user1,ou=Users," + server.GetSuffix(), "uid=user2,ou=Users," + server.GetSuffix()},
+				// The case variant is matched by the normalized DN
+				"owner": A{"UID=User1,ou=Users," + server.GetSuffix(), "uid=user2,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		Delete{
+			"uid=user1", "ou=Users",
+			&AssertNoEntry{},
+		},
+		Search{
+			"cn=group1,ou=Groups," + server.GetSuffix(),
+			"objectClass=*",
+			ldap.ScopeBaseObject,
+			A{"member", "owner"},
+			&AssertEntries{
+				ExpectEntry{
+					"cn=group1",
+					"ou=Groups",
+					M{
+						"member": A{"uid=user2,ou=Users," + server.GetSuffix()},
+						"owner":  A{"uid=user2,ou=Users," + server.GetSuffix()},
+					},
+				},
+			},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
+
+func TestRefintRestrict(t *testing.T) {
+	type A []string
+	type M map[string][]string
+
+	server.config.RefintAttrs = "owner"
+	server.LoadSchema()
+	server.Repo().refintMode = refintRestrict
+	defer func() {
+		server.config.RefintAttrs = ""
+		server.LoadSchema()
+		server.Repo().refintMode = refintRemove
+	}()
+
+	tcs := []Command{
+		Conn{},
+		Bind{"cn=Manager", "secret", &AssertResponse{}},
+		AddDC("com"),
+		AddDC("example", "dc=com"),
+		AddOU("Users"),
+		AddOU("Groups"),
+		Add{
+			"uid=user1", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user1"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"uid=user2", "ou=Users",
+			M{
+				"objectClass": A{"inetOrgPerson"},
+				"sn":          A{"user2"},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=group1", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"uid=user1,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		Add{
+			"cn=group2", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"cn=group1,ou=Groups," + server.GetSuffix()},
+				"owner":       A{"uid=User2,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		// The reference to the non-existent entry is rejected
+		Add{
+			"cn=group3", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"cn=group1,ou=Groups," + server.GetSuffix()},
+				"owner":       A{"uid=user3,ou=Users," + server.GetSuffix()},
+			},
+			&AssertLDAPError{
+				expectErrorCode: ldap.LDAPResultInvalidAttributeSyntax,
+			},
+		},
+		// The dangling reference written before restrict mode doesn't block the modification of the other attributes
+		SetRefintMode{refintRemove},
+		Add{
+			"cn=group4", "ou=Groups",
+			M{
+				"objectClass": A{"groupOfNames"},
+				"member":      A{"cn=group1,ou=Groups," + server.GetSuffix()},
+				"owner":       A{"uid=user3,ou=Users," + server.GetSuffix()},
+			},
+			&AssertEntry{},
+		},
+		SetRefintMode{refintRestrict},
+		ModifyReplace{
+			"cn=group4", "ou=Groups",
+			M{
+				"description": A{"legacy"},
+			},
+			&AssertEntry{},
+		},
+		DeleteWithError{
+			"uid=user1", "ou=Users",
+			ldap.LDAPResultNotAllowedOnNonLeaf,
+		},
+		DeleteWithError{
+			"uid=user2", "ou=Users",
+			ldap.LDAPResultNotAllowedOnNonLeaf,
+		},
+		// The references from the deleting subtree itself don't block the deletion
+		DeleteTree{
+			"ou=Groups", "",
+			&AssertNoEntry{},
+		},
+		Delete{
+			"uid=user1", "ou=Users",
+			&AssertNoEntry{},
+		},
+		Delete{
+			"uid=user2", "ou=Users",
+			&AssertNoEntry{},
+		},
+	}
+
+	runTestCases(t, tcs)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/sqlx/types"
+	"golang.org/x/xerrors"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLogLevel returns the level by the name, one of: debug, info, warn, error.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "warn":
+		return LogWarn, nil
+	case "error":
+		return LogError, nil
+	}
+	return LogWarn, xerrors.Errorf("Invalid log level: %s", s)
+}
+
+// Logger is a structured logger used by Repository.
+// It's small enough to adapt other logging libraries like zap or logrus.
+// keysAndValues are alternating key and value pairs.
+type Logger interface {
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, keysAndValues ...interface{})
+}
+
+// stdLogger is the default Logger which writes into the standard logger with level prefix.
+type stdLogger struct {
+	minLevel LogLevel
+}
+
+func NewStdLogger(minLevel LogLevel) Logger {
+	return &stdLogger{
+		minLevel: minLevel,
+	}
+}
+
+func (l *stdLogger) Enabled(level LogLevel) bool {
+	return level >= l.minLevel
+}
+
+func (l *stdLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		b.WriteString(fmt.Sprintf(" %v=", keysAndValues[i]))
+		if i+1 < len(keysAndValues) {
+			b.WriteString(fmt.Sprintf("%v", keysAndValues[i+1]))
+		}
+	}
+	log.Print(b.String())
+}
+
+const redacted = "[REDACTED]"
+
+// Redactor replaces the values of the sensitive attributes in the query params for logging.
+type Redactor struct {
+	attrs map[string]struct{}
+}
+
+func NewRedactor(attrs []string) *Redactor {
+	m := make(map[string]struct{}, len(attrs))
+	for _, v := range attrs {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			m[strings.ToLower(v)] = struct{}{}
+		}
+	}
+	return &Redactor{
+		attrs: m,
+	}
+}
+
+// RedactParams returns a copy of the params whose JSON attributes are redacted.
+func (r *Redactor) RedactParams(params map[string]interface{}) map[string]interface{} {
+	redactedParams := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		switch vv := v.(type) {
+		case types.JSONText:
+			redactedParams[k] = r.redactJSON(vv)
+		case []byte:
+			redactedParams[k] = r.redactJSON(vv)
+		default:
+			redactedParams[k] = v
+		}
+	}
+	return redactedParams
+}
+
+func (r *Redactor) redactJSON(b []byte) string {
+	if len(r.attrs) == 0 {
+		return string(b)
+	}
+
+	var attrs map[string]interface{}
+	if err := json.Unmarshal(b, &attrs); err != nil {
+		// Not JSON object, hide it since we can't know whether it contains sensitive values
+		return redacted
+	}
+	for k := range attrs {
+		if _, ok := r.attrs[strings.ToLower(k)]; ok {
+			attrs[k] = redacted
+		}
+	}
+	rb, err := json.Marshal(attrs)
+	if err != nil {
+		return redacted
+	}
+	return string(rb)
+}
@@ -0,0 +1,47 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+func TestRedactParams(t *testing.T) {
+	r := NewRedactor([]string{"userPassword", " pwdHistory "})
+
+	params := map[string]interface{}{
+		"rdn_norm":   "uid=user1",
+		"attrs_norm": types.JSONText(`{"uid":["user1"],"userpassword":["secret"]}`),
+		"attrs_orig": types.JSONText(`{"uid":["user1"],"userPassword":["secret"],"pwdHistory":["old"]}`),
+	}
+
+	got := r.RedactParams(params)
+
+	if got["rdn_norm"] != "uid=user1" {
+		t.Errorf("Unexpected rdn_norm. got: %v", got["rdn_norm"])
+	}
+	if got["attrs_norm"] != `{"uid":["user1"],"userpassword":"[REDACTED]"}` {
+		t.Errorf("Unexpected attrs_norm. got: %v", got["attrs_norm"])
+	}
+	if got["attrs_orig"] != `{"pwdHistory":"[REDACTED]","uid":["user1"],"userPassword":"[REDACTED]"}` {
+		t.Errorf("Unexpected attrs_orig. got: %v", got["attrs_orig"])
+	}
+
+	// The original params must not be changed
+	if string(params["attrs_orig"].(types.JSONText)) != `{"uid":["user1"],"userPassword":["secret"],"pwdHistory":["old"]}` {
+		t.Errorf("Unexpected change of the original params. got: %s", params["attrs_orig"])
+	}
+}
+
+func TestStdLoggerEnabled(t *testing.T) {
+	l := NewStdLogger(LogWarn)
+
+	if l.Enabled(LogDebug) || l.Enabled(LogInfo) {
+		t.Errorf("Unexpected enabled level under warn")
+	}
+	if !l.Enabled(LogWarn) || !l.Enabled(LogError) {
+		t.Errorf("Unexpected disabled level over warn")
+	}
+}
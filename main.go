@@ -54,6 +54,81 @@ var (
 		2,
 		"DB max idle connections",
 	)
+	dbRetryMaxAttempts = fs.Int(
+		"db-retry-max-attempts",
+		3,
+		"DB retry: Max attempts of the transaction when it fails by serialization failure or deadlock. 1 disables the retry",
+	)
+	dbRetryBaseDelay = fs.Int(
+		"db-retry-base-delay",
+		10,
+		"DB retry: Base delay milliseconds of the exponential backoff",
+	)
+	dbIsolationLevel = fs.String(
+		"db-isolation-level",
+		"read-committed",
+		"DB transaction: Isolation level of the write operations, one of: read-committed, repeatable-read, serializable",
+	)
+	dbHealthCheckInterval = fs.Int(
+		"db-health-check-interval",
+		10,
+		"DB health check: Interval seconds of pinging the DB. 0 disables the health check",
+	)
+	dbHealthCheckMaxBackoff = fs.Int(
+		"db-health-check-max-backoff",
+		60,
+		"DB health check: Max backoff seconds of pinging the DB while it's unhealthy",
+	)
+	changelogRetention = fs.Int(
+		"changelog-retention",
+		86400,
+		"Changelog: Retention seconds of the change events for the subscribers to resync. 0 keeps them forever",
+	)
+	softDelete = fs.Bool(
+		"soft-delete",
+		false,
+		"Soft delete: Keep the deleted entry as a tombstone instead of deleting it",
+	)
+	softDeleteRetention = fs.Int(
+		"soft-delete-retention",
+		2592000,
+		"Soft delete: Retention seconds of the tombstones before purging them. 0 keeps them forever",
+	)
+	countEstimateThreshold = fs.Int(
+		"count-estimate-threshold",
+		10000,
+		"Count: Min number of the entries estimated by the planner to return the estimate as the total count for paged results instead of counting them exactly. Virtual list view and 0 always count exactly",
+	)
+	refintMode = fs.String(
+		"refint-mode",
+		"remove",
+		"Referential integrity: Behavior when deleting the entry referenced by the DN attributes of the others, one of: remove, restrict. remove deletes the references in the same transaction, restrict rejects the deletion and the reference to the non-existent entry",
+	)
+	refintAttrs = fs.String(
+		"refint-attrs",
+		"",
+		"Referential integrity: Comma separated DN attributes to maintain in addition to member and uniqueMember, e.g. owner,seeAlso",
+	)
+	normalizationRules = fs.String(
+		"normalization-rules",
+		"",
+		"Normalization: Comma separated attribute=matchingRule pairs overriding the EQUALITY matching rule used for normalizing the values, e.g. mail=caseExactIA5Match. The existing entries aren't migrated, reindex them after changing the rule",
+	)
+	dnCacheSize = fs.Int(
+		"dn-cache-size",
+		10000,
+		"DN cache: Max entries for resolving parent DN when adding entry. 0 disables the cache",
+	)
+	dnCacheTTL = fs.Int(
+		"dn-cache-ttl",
+		60,
+		"DN cache: TTL seconds",
+	)
+	stmtCacheSize = fs.Int(
+		"stmt-cache-size",
+		1000,
+		"Statement cache: Max prepared statements of the generated queries. 0 disables the cache",
+	)
 	suffix = fs.String(
 		"suffix",
 		"",
@@ -79,6 +154,76 @@ var (
 		"info",
 		"Log level, on of: debug, info, warn, error, alert",
 	)
+	repoLogLevel = fs.String(
+		"repo-log-level",
+		"warn",
+		"Log level of the repository, on of: debug, info, warn, error. The queries are logged with debug",
+	)
+	logRedactAttrs = fs.String(
+		"log-redact-attrs",
+		"userPassword",
+		"Comma separated attributes whose values are redacted in the logs",
+	)
+	indexedAttrs = fs.String(
+		"indexed-attrs",
+		"",
+		"Comma separated attributes which have the index for equality searches. The indexes are created concurrently in background at startup (ex. mail,uid)",
+	)
+	passwordHashScheme = fs.String(
+		"password-hash-scheme",
+		"",
+		"Password policy: Hash scheme of the plaintext userPassword, one of: SSHA, SSHA256, SSHA512, PBKDF2-SHA256, BCRYPT, ARGON2ID. The values already hashed by these schemes and the {SASL} pass-through values are stored as they are (Store the plaintext as it is with default)",
+	)
+	passwordBcryptCost = fs.Int(
+		"password-bcrypt-cost",
+		10,
+		"Password policy: Cost of BCRYPT",
+	)
+	passwordArgon2Time = fs.Int(
+		"password-argon2-time",
+		2,
+		"Password policy: Iterations of ARGON2ID",
+	)
+	passwordArgon2Memory = fs.Int(
+		"password-argon2-memory",
+		65536,
+		"Password policy: Memory KiB of ARGON2ID",
+	)
+	passwordArgon2Threads = fs.Int(
+		"password-argon2-threads",
+		1,
+		"Password policy: Parallelism of ARGON2ID",
+	)
+	passwordPBKDF2Iter = fs.Int(
+		"password-pbkdf2-iterations",
+		10000,
+		"Password policy: Iterations of PBKDF2-SHA256",
+	)
+	passwordHistory = fs.Int(
+		"password-history",
+		0,
+		"Password policy: Number of the previous passwords which can't be reused. 0 disables the history",
+	)
+	passwordMinAge = fs.Int(
+		"password-min-age",
+		0,
+		"Password policy: Min seconds before the user can change the own password again. 0 disables the check",
+	)
+	passwordMustChange = fs.Bool(
+		"password-must-change",
+		false,
+		"Password policy: The user must change the password after it's set by the other user. It's surfaced as pwdReset",
+	)
+	healthServer = fs.String(
+		"health-server",
+		"",
+		"Bind address of health check server which serves /readyz. It returns 503 while the DB is unhealthy (Don't start the server with default)",
+	)
+	metricsServer = fs.String(
+		"metrics-server",
+		"",
+		"Bind address of metrics server which serves /metrics for Prometheus. The latency and the result codes of the operations and the open transactions are exported (Don't start the server with default)",
+	)
 	pprofServer = fs.String(
 		"pprof",
 		"",
@@ -129,6 +274,11 @@ var (
 		10,
 		"Pass-through/LDAP: Timeout seconds (Default: 10)",
 	)
+	schemaCheckEnabled = fs.Bool(
+		"schema-check",
+		false,
+		"Enable schema check which validates the structural objectClass, MUST and allowed attributes of the entry when adding",
+	)
 	migrationEnabled = fs.Bool(
 		"migration",
 		false,
@@ -184,23 +334,53 @@ func main() {
 	}
 
 	NewServer(&ServerConfig{
-		DBHostName:        *dbHostName,
-		DBPort:            *dbPort,
-		DBName:            *dbName,
-		DBSchema:          *dbSchema,
-		DBUser:            *dbUser,
-		DBPassword:        *dbPassword,
-		DBMaxOpenConns:    *dbMaxOpenConns,
-		DBMaxIdleConns:    *dbMaxIdleConns,
-		Suffix:            *suffix,
-		RootDN:            *rootdn,
-		RootPW:            rootPW,
-		BindAddress:       *bindAddress,
-		PassThroughConfig: passThroughConfig,
-		LogLevel:          *logLevel,
-		PProfServer:       *pprofServer,
-		GoMaxProcs:        *gomaxprocs,
-		MigrationEnabled:  *migrationEnabled,
-		QueryTranslator:   "default",
+		DBHostName:              *dbHostName,
+		DBPort:                  *dbPort,
+		DBName:                  *dbName,
+		DBSchema:                *dbSchema,
+		DBUser:                  *dbUser,
+		DBPassword:              *dbPassword,
+		DBMaxOpenConns:          *dbMaxOpenConns,
+		DBMaxIdleConns:          *dbMaxIdleConns,
+		DNCacheSize:             *dnCacheSize,
+		DNCacheTTL:              *dnCacheTTL,
+		StmtCacheSize:           *stmtCacheSize,
+		DBRetryMaxAttempts:      *dbRetryMaxAttempts,
+		DBRetryBaseDelay:        *dbRetryBaseDelay,
+		DBHealthCheckInterval:   *dbHealthCheckInterval,
+		DBHealthCheckMaxBackoff: *dbHealthCheckMaxBackoff,
+		DBIsolationLevel:        *dbIsolationLevel,
+		HealthServer:            *healthServer,
+		MetricsServer:           *metricsServer,
+		Suffix:                  *suffix,
+		RootDN:                  *rootdn,
+		RootPW:                  rootPW,
+		BindAddress:             *bindAddress,
+		PassThroughConfig:       passThroughConfig,
+		LogLevel:                *logLevel,
+		RepoLogLevel:            *repoLogLevel,
+		LogRedactAttrs:          *logRedactAttrs,
+		PProfServer:             *pprofServer,
+		GoMaxProcs:              *gomaxprocs,
+		MigrationEnabled:        *migrationEnabled,
+		SchemaCheckEnabled:      *schemaCheckEnabled,
+		QueryTranslator:         "default",
+		IndexedAttrs:            *indexedAttrs,
+		PasswordHashScheme:      *passwordHashScheme,
+		PasswordBcryptCost:      *passwordBcryptCost,
+		PasswordArgon2Time:      *passwordArgon2Time,
+		PasswordArgon2Memory:    *passwordArgon2Memory,
+		PasswordArgon2Threads:   *passwordArgon2Threads,
+		PasswordPBKDF2Iter:      *passwordPBKDF2Iter,
+		PasswordHistory:         *passwordHistory,
+		PasswordMinAge:          *passwordMinAge,
+		PasswordMustChange:      *passwordMustChange,
+		ChangelogRetention:      *changelogRetention,
+		SoftDelete:              *softDelete,
+		SoftDeleteRetention:     *softDeleteRetention,
+		RefintMode:              *refintMode,
+		RefintAttrs:             *refintAttrs,
+		NormalizationRules:      *normalizationRules,
+		CountEstimateThreshold:  *countEstimateThreshold,
 	}).Start()
 }
@@ -4,6 +4,7 @@ import (
 	// "fmt"
 	"encoding/json"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -48,11 +49,18 @@ func (m *Mapper) LDAPMessageToAddEntry(dn *DN, ldapAttrs message.AttributeList)
 		return nil, err
 	}
 
+	if m.server.config.SchemaCheckEnabled {
+		err = entry.ValidateObjectClass(objectClassMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return entry, nil
 }
 
 // AddEntryToDBEntry converts LDAP entry object to DB entry object.
-// It handles metadata such as createTimistamp, modifyTimestamp and entryUUID.
+// It handles metadata such as createTimistamp, modifyTimestamp, creatorsName, modifiersName and entryUUID.
 // Also, it handles member and uniqueMember attributes.
 func (m *Mapper) AddEntryToDBEntry(tx *sqlx.Tx, entry *AddEntry) (*DBEntry, error) {
 	norm, orig := entry.Attrs()
@@ -73,6 +81,16 @@ func (m *Mapper) AddEntryToDBEntry(tx *sqlx.Tx, entry *AddEntry) (*DBEntry, erro
 	norm["modifyTimestamp"] = []int64{updated.Unix()}
 	orig["modifyTimestamp"] = []string{updated.In(time.UTC).Format(TIMESTAMP_FORMAT)}
 
+	// The names can be given only in migration mode like the timestamps
+	if entry.creator != nil {
+		if _, ok := norm["creatorsName"]; !ok {
+			setNormAndOrig(norm, orig, "creatorsName", entry.creator.DNOrigStr())
+		}
+		if _, ok := norm["modifiersName"]; !ok {
+			setNormAndOrig(norm, orig, "modifiersName", entry.creator.DNOrigStr())
+		}
+	}
+
 	// TODO strict mode
 	if _, ok := norm["entryUUID"]; !ok {
 		u, _ := uuid.NewRandom()
@@ -80,6 +98,23 @@ func (m *Mapper) AddEntryToDBEntry(tx *sqlx.Tx, entry *AddEntry) (*DBEntry, erro
 		orig["entryUUID"] = []string{u.String()}
 	}
 
+	// Password policy
+	if _, ok := orig["userPassword"]; ok {
+		if err := validateHashedPasswords(orig["userPassword"]); err != nil {
+			return nil, err
+		}
+		if err := m.server.hashPasswords(norm, orig); err != nil {
+			return nil, err
+		}
+		if _, ok := norm["pwdChangedTime"]; !ok {
+			setNormAndOrig(norm, orig, "pwdChangedTime", created.In(time.UTC).Format(TIMESTAMP_FORMAT))
+		}
+		// The password is always set by the other user when adding
+		if m.server.config.PasswordMustChange {
+			setNormAndOrig(norm, orig, "pwdReset", "TRUE")
+		}
+	}
+
 	// Remove attributes to reduce attrs_orig column size
 	removeComputedAttrs(orig)
 
@@ -90,6 +125,9 @@ func (m *Mapper) AddEntryToDBEntry(tx *sqlx.Tx, entry *AddEntry) (*DBEntry, erro
 	if err := m.dnArrayToIDArray(tx, norm, "uniqueMember"); err != nil {
 		return nil, err
 	}
+	if err := m.server.repo.lockReferenced(tx, orig); err != nil {
+		return nil, err
+	}
 
 	bNorm, _ := json.Marshal(norm)
 	bOrig, _ := json.Marshal(orig)
@@ -97,6 +135,10 @@ func (m *Mapper) AddEntryToDBEntry(tx *sqlx.Tx, entry *AddEntry) (*DBEntry, erro
 	dbEntry := &DBEntry{
 		DNNorm:    entry.DN().DNNormStr(),
 		DNOrig:    entry.DN().DNOrigStr(),
+		Created:   created,
+		Creator:   firstValue(orig, "creatorsName"),
+		Updated:   updated,
+		Modifier:  firstValue(orig, "modifiersName"),
 		AttrsNorm: types.JSONText(string(bNorm)),
 		AttrsOrig: types.JSONText(string(bOrig)),
 	}
@@ -104,6 +146,23 @@ func (m *Mapper) AddEntryToDBEntry(tx *sqlx.Tx, entry *AddEntry) (*DBEntry, erro
 	return dbEntry, nil
 }
 
+func firstValue(orig map[string][]string, attrName string) string {
+	if v, ok := orig[attrName]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func setNormAndOrig(norm map[string]interface{}, orig map[string][]string, attrName, value string) {
+	sv, err := NewSchemaValue(attrName, []string{value})
+	if err != nil {
+		log.Printf("warn: Failed to set %s. err: %+v", attrName, err)
+		return
+	}
+	norm[sv.Name()] = sv.GetForJSON()
+	orig[sv.Name()] = sv.Orig()
+}
+
 // TODO move to schema?
 func removeComputedAttrs(orig map[string][]string) {
 	delete(orig, "member")
@@ -148,6 +207,14 @@ func (m *Mapper) dnArrayToIDArray(tx *sqlx.Tx, norm map[string]interface{}, attr
 func (m *Mapper) ModifyEntryToDBEntry(tx *sqlx.Tx, entry *ModifyEntry) (*DBEntry, error) {
 	norm, orig := entry.GetAttrs()
 
+	// Validate only the changed values not to reject the modification of the entry which has the legacy hash
+	if err := validateHashedPasswords(entry.ChangedPasswords()); err != nil {
+		return nil, err
+	}
+	if err := m.server.hashPasswords(norm, orig); err != nil {
+		return nil, err
+	}
+
 	// Remove attributes to reduce attrs_orig column size
 	removeComputedAttrs(orig)
 
@@ -158,17 +225,27 @@ func (m *Mapper) ModifyEntryToDBEntry(tx *sqlx.Tx, entry *ModifyEntry) (*DBEntry
 	if err := m.dnArrayToIDArray(tx, norm, "uniqueMember"); err != nil {
 		return nil, err
 	}
+	// The existing references aren't checked not to reject the modification by the legacy dangling reference
+	if err := m.server.repo.lockReferenced(tx, entry.ChangedValues()); err != nil {
+		return nil, err
+	}
 
 	updated := time.Now()
 	norm["modifyTimestamp"] = []int64{updated.Unix()}
 	orig["modifyTimestamp"] = []string{updated.In(time.UTC).Format(TIMESTAMP_FORMAT)}
 
+	// Keep the previous modifiersName if it's modified by the anonymous
+	if entry.modifier != nil {
+		setNormAndOrig(norm, orig, "modifiersName", entry.modifier.DNOrigStr())
+	}
+
 	bNorm, _ := json.Marshal(norm)
 	bOrig, _ := json.Marshal(orig)
 
 	dbEntry := &DBEntry{
 		ID:        entry.dbEntryID,
 		Updated:   updated,
+		Modifier:  firstValue(orig, "modifiersName"),
 		AttrsNorm: types.JSONText(string(bNorm)),
 		AttrsOrig: types.JSONText(string(bOrig)),
 	}
@@ -196,8 +273,20 @@ func (m *Mapper) FetchedDBEntryToSearchEntry(dbEntry *FetchedDBEntry, IdToDNOrig
 	}
 	orig := dbEntry.AttrsOrig()
 	// orig["entryUUID"] = []string{dbEntry.EntryUUID}
-	// orig["createTimestamp"] = []string{dbEntry.Created.In(time.UTC).Format(TIMESTAMP_FORMAT)}
-	// orig["modifyTimestamp"] = []string{dbEntry.Updated.In(time.UTC).Format(TIMESTAMP_FORMAT)}
+
+	// The columns are the source of the operational attributes
+	if !dbEntry.CreatedAt.IsZero() {
+		orig["createTimestamp"] = []string{dbEntry.CreatedAt.In(time.UTC).Format(TIMESTAMP_FORMAT)}
+	}
+	if !dbEntry.ModifiedAt.IsZero() {
+		orig["modifyTimestamp"] = []string{dbEntry.ModifiedAt.In(time.UTC).Format(TIMESTAMP_FORMAT)}
+	}
+	if dbEntry.Creator != "" {
+		orig["creatorsName"] = []string{dbEntry.Creator}
+	}
+	if dbEntry.Modifier != "" {
+		orig["modifiersName"] = []string{dbEntry.Modifier}
+	}
 
 	// member
 	members, err := dbEntry.Member(m.server.repo, IdToDNOrigCache)
@@ -222,12 +311,16 @@ func (m *Mapper) FetchedDBEntryToSearchEntry(dbEntry *FetchedDBEntry, IdToDNOrig
 	}
 	orig["memberOf"] = memberOfs
 
+	// entryRev
+	orig["entryRev"] = []string{strconv.FormatInt(dbEntry.Rev, 10)}
+
 	// hasSubordinates
 	if dbEntry.HasSubordinates != "" {
 		orig["hasSubordinates"] = []string{dbEntry.HasSubordinates}
 	}
 
 	readEntry := NewSearchEntry(dn, orig)
+	readEntry.dbEntryID = dbEntry.ID
 
 	return readEntry, nil
 }
@@ -247,6 +340,7 @@ func (m *Mapper) FetchedEntryToModifyEntry(dbEntry *FetchedEntry) (*ModifyEntry,
 	entry.dbParentID = dbEntry.ParentID
 	entry.hasSub = dbEntry.HasSub
 	entry.path = dbEntry.Path
+	entry.dbRev = dbEntry.Rev
 
 	return entry, nil
 }
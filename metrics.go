@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+)
+
+// Metrics records the metrics of the repository operations, e.g. with PrometheusMetrics.
+// The implementation must be safe for concurrent use. The default is no-op.
+type Metrics interface {
+	// ObserveOperation records the latency and the LDAP result code of the operation.
+	// The latency of the write operation includes the whole transaction with the retries and the commit.
+	ObserveOperation(op string, latency time.Duration, code int)
+	// TxBegan and TxEnded track the number of the open transactions.
+	TxBegan()
+	TxEnded()
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOperation(op string, latency time.Duration, code int) {}
+func (noopMetrics) TxBegan()                                                   {}
+func (noopMetrics) TxEnded()                                                   {}
+
+// SetMetrics replaces the metrics of the repository.
+func (r *Repository) SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	r.metrics = m
+}
+
+// observe records the operation started at the time with the result of the error.
+func (r *Repository) observe(op string, start time.Time, err error) {
+	r.metrics.ObserveOperation(op, time.Since(start), responseCode(err))
+}
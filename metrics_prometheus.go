@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics is the implementation of Metrics with Prometheus.
+type PrometheusMetrics struct {
+	latency *prometheus.HistogramVec
+	results *prometheus.CounterVec
+	openTx  prometheus.Gauge
+}
+
+// NewPrometheusMetrics returns the metrics registered to the registerer.
+func NewPrometheusMetrics(reg prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ldap_pg",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of the repository operations. The write operation includes the whole transaction.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		results: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ldap_pg",
+			Name:      "operations_total",
+			Help:      "Number of the repository operations by the LDAP result code.",
+		}, []string{"operation", "code"}),
+		openTx: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ldap_pg",
+			Name:      "open_transactions",
+			Help:      "Number of the open transactions.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.latency, m.results, m.openTx} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *PrometheusMetrics) ObserveOperation(op string, latency time.Duration, code int) {
+	m.latency.WithLabelValues(op).Observe(latency.Seconds())
+	m.results.WithLabelValues(op, strconv.Itoa(code)).Inc()
+}
+
+func (m *PrometheusMetrics) TxBegan() {
+	m.openTx.Inc()
+}
+
+func (m *PrometheusMetrics) TxEnded() {
+	m.openTx.Dec()
+}
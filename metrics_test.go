@@ -0,0 +1,78 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	ldap "github.com/openstandia/ldapserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/xerrors"
+)
+
+func TestResponseCode(t *testing.T) {
+	testcases := []struct {
+		err  error
+		code int
+	}{
+		{nil, ldap.LDAPResultSuccess},
+		{NewAlreadyExists(), ldap.LDAPResultEntryAlreadyExists},
+		{xerrors.Errorf("wrapped. err: %w", NewUnavailable()), ldap.LDAPResultUnavailable},
+		{xerrors.New("unknown"), ldap.LDAPResultOperationsError},
+	}
+
+	for i, tc := range testcases {
+		if code := responseCode(tc.err); code != tc.code {
+			t.Errorf("Unexpected result code [%d]. want: %d, got: %d", i, tc.code, code)
+		}
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := NewPrometheusMetrics(reg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	r := &Repository{metrics: noopMetrics{}}
+	r.SetMetrics(m)
+
+	r.observe("insert", time.Now(), nil)
+	r.observe("insert", time.Now(), NewAlreadyExists())
+	r.observe("insert", time.Now(), NewAlreadyExists())
+	r.observe("modify", time.Now(), NewUnavailable())
+
+	if v := testutil.ToFloat64(m.results.WithLabelValues("insert", "0")); v != 1 {
+		t.Errorf("Unexpected success count. want: 1, got: %v", v)
+	}
+	if v := testutil.ToFloat64(m.results.WithLabelValues("insert", "68")); v != 2 {
+		t.Errorf("Unexpected alreadyExists count. want: 2, got: %v", v)
+	}
+	if v := testutil.ToFloat64(m.results.WithLabelValues("modify", "52")); v != 1 {
+		t.Errorf("Unexpected unavailable count. want: 1, got: %v", v)
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 2 {
+		t.Errorf("Unexpected latency series. want: 2, got: %d", n)
+	}
+
+	m.TxBegan()
+	m.TxBegan()
+	m.TxEnded()
+	if v := testutil.ToFloat64(m.openTx); v != 1 {
+		t.Errorf("Unexpected open transactions. want: 1, got: %v", v)
+	}
+
+	// Registering twice to the same registry fails
+	if _, err := NewPrometheusMetrics(reg); err == nil {
+		t.Errorf("Expected the registration error")
+	}
+
+	// nil restores no-op
+	r.SetMetrics(nil)
+	if _, ok := r.metrics.(noopMetrics); !ok {
+		t.Errorf("Expected noopMetrics, got: %T", r.metrics)
+	}
+}
@@ -12,6 +12,8 @@ type ModifyEntry struct {
 	dbParentID int64
 	hasSub     bool
 	path       string
+	dbRev      int64
+	modifier   *DN // The bound DN which modifies the entry, it's stored as modifiersName
 	add        []*SchemaValue
 	replace    []*SchemaValue
 	del        []*SchemaValue
@@ -57,13 +59,11 @@ func (j *ModifyEntry) HasAttr(attrName string) bool {
 
 func (j *ModifyEntry) SetDN(dn *DN) {
 	j.dn = dn
+}
 
-	rdn := dn.RDN()
-	for k, v := range rdn {
-		// rdn is validated already, ignore error
-		sv, _ := NewSchemaValue(k, []string{v})
-		j.attributes[sv.Name()] = sv
-	}
+// SetModifier sets the bound DN which modifies the entry.
+func (j *ModifyEntry) SetModifier(dn *DN) {
+	j.modifier = dn
 }
 
 func (j *ModifyEntry) DN() *DN {
@@ -152,6 +152,21 @@ func (j *ModifyEntry) Replace(attrName string, attrValue []string) error {
 	return nil
 }
 
+func (j *ModifyEntry) ReplaceNoCheck(attrName string, attrValue []string) error {
+	sv, err := NewSchemaValue(attrName, attrValue)
+	if err != nil {
+		return err
+	}
+	if err := j.replacesv(sv); err != nil {
+		return err
+	}
+
+	// Record changelog
+	j.replace = append(j.replace, sv)
+
+	return nil
+}
+
 func (j *ModifyEntry) replacesv(value *SchemaValue) error {
 	name := value.Name()
 
@@ -230,6 +245,22 @@ func (j *ModifyEntry) GetAttrNorm(attrName string) ([]string, bool) {
 	return v.Norm(), true
 }
 
+// ChangedPasswords returns the userPassword values added or replaced by the modification.
+func (j *ModifyEntry) ChangedPasswords() []string {
+	return j.ChangedValues()["userPassword"]
+}
+
+// ChangedValues returns the values added or replaced by the modification, keyed by the attribute name.
+func (j *ModifyEntry) ChangedValues() map[string][]string {
+	values := map[string][]string{}
+	for _, changes := range [][]*SchemaValue{j.add, j.replace} {
+		for _, sv := range changes {
+			values[sv.Name()] = append(values[sv.Name()], sv.Orig()...)
+		}
+	}
+	return values
+}
+
 func (j *ModifyEntry) GetAttrsOrig() map[string][]string {
 	orig := make(map[string][]string, len(j.attributes))
 	for k, v := range j.attributes {
@@ -254,6 +285,7 @@ func (e *ModifyEntry) Clone() *ModifyEntry {
 		dn:         e.dn,
 		attributes: map[string]*SchemaValue{},
 		dbEntryID:  e.dbEntryID,
+		dbRev:      e.dbRev,
 	}
 	for k, v := range e.attributes {
 		clone.attributes[k] = v.Clone()
@@ -262,9 +294,50 @@ func (e *ModifyEntry) Clone() *ModifyEntry {
 	return clone
 }
 
-func (e *ModifyEntry) ModifyRDN(newDN *DN) *ModifyEntry {
+// ModifyRDN returns the renamed entry. The attribute values of the new RDN are added if missing.
+// When deleteOldRDN is true, the attribute values of the old RDN are deleted unless they are also in the new RDN.
+func (e *ModifyEntry) ModifyRDN(newDN *DN, deleteOldRDN bool) (*ModifyEntry, error) {
 	m := e.Clone()
 	m.SetDN(newDN)
 
-	return m
+	newRDN := map[string]*SchemaValue{}
+	for _, attr := range newDN.RDNs[0].Attributes {
+		sv, err := NewSchemaValue(attr.TypeOrig, []string{attr.ValueOrig})
+		if err != nil {
+			log.Printf("warn: Invalid new RDN. rdn: %s, err: %v", newDN.RDNOrigStr(), err)
+			return nil, NewInvalidDNSyntax()
+		}
+		newRDN[sv.Name()+"="+sv.Norm()[0]] = sv
+	}
+
+	if deleteOldRDN {
+		for _, attr := range e.dn.RDNs[0].Attributes {
+			sv, err := NewSchemaValue(attr.TypeOrig, []string{attr.ValueOrig})
+			if err != nil {
+				return nil, NewInvalidDNSyntax()
+			}
+			if _, ok := newRDN[sv.Name()+"="+sv.Norm()[0]]; ok {
+				continue
+			}
+			current, ok := m.attributes[sv.Name()]
+			if !ok || !current.HasDuplicate(sv) {
+				// Already missing
+				continue
+			}
+			if err := m.deletesv(sv); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, sv := range newRDN {
+		if current, ok := m.attributes[sv.Name()]; ok && current.HasDuplicate(sv) {
+			continue
+		}
+		if err := m.addsv(sv); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
 }
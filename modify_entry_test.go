@@ -0,0 +1,144 @@
+// +build !integration
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModifyRDN(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+
+	testcases := []struct {
+		DN           string
+		NewDN        string
+		DeleteOldRDN bool
+		Attrs        map[string][]string
+		ExpectedCode int
+		Expected     map[string][]string
+	}{
+		{
+			"cn=foo,ou=Users,dc=example,dc=com",
+			"cn=bar,ou=Users,dc=example,dc=com",
+			true,
+			map[string][]string{"cn": {"foo", "alias"}},
+			0,
+			map[string][]string{"cn": {"alias", "bar"}},
+		},
+		{
+			"cn=foo,ou=Users,dc=example,dc=com",
+			"cn=bar,ou=Users,dc=example,dc=com",
+			false,
+			map[string][]string{"cn": {"foo", "alias"}},
+			0,
+			map[string][]string{"cn": {"foo", "alias", "bar"}},
+		},
+		{
+			"cn=foo,ou=Users,dc=example,dc=com",
+			"uid=bar,ou=Users,dc=example,dc=com",
+			true,
+			map[string][]string{"cn": {"foo"}, "sn": {"foo"}},
+			0,
+			map[string][]string{"sn": {"foo"}, "uid": {"bar"}},
+		},
+		{
+			"cn=foo,ou=Users,dc=example,dc=com",
+			"uid=bar,ou=Users,dc=example,dc=com",
+			false,
+			map[string][]string{"cn": {"foo"}},
+			0,
+			map[string][]string{"cn": {"foo"}, "uid": {"bar"}},
+		},
+		{
+			"cn=foo,ou=Users,dc=example,dc=com",
+			"cn=FOO,ou=Users,dc=example,dc=com",
+			true,
+			map[string][]string{"cn": {"foo"}},
+			0,
+			map[string][]string{"cn": {"foo"}},
+		},
+		{
+			"cn=foo,ou=Users,dc=example,dc=com",
+			"displayName=bar,ou=Users,dc=example,dc=com",
+			false,
+			map[string][]string{"cn": {"foo"}, "displayName": {"foo"}},
+			19,
+			nil,
+		},
+	}
+
+	for i, tc := range testcases {
+		dn, err := NormalizeDN(tc.DN)
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+		newDN, err := NormalizeDN(tc.NewDN)
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+		entry, err := NewModifyEntry(dn, tc.Attrs)
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+
+		newEntry, err := entry.ModifyRDN(newDN, tc.DeleteOldRDN)
+		if tc.ExpectedCode != 0 {
+			ldapErr, ok := err.(*LDAPError)
+			if !ok || ldapErr.Code != tc.ExpectedCode {
+				t.Errorf("Unexpected error on %d:\n%d expected, got %v", i, tc.ExpectedCode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+
+		if newEntry.DN().DNNormStr() != newDN.DNNormStr() {
+			t.Errorf("Unexpected DN on %d:\n%s expected, got %s", i, newDN.DNNormStr(), newEntry.DN().DNNormStr())
+		}
+		orig := newEntry.GetAttrsOrig()
+		if !reflect.DeepEqual(orig, tc.Expected) {
+			t.Errorf("Unexpected attributes on %d:\n%v expected, got %v", i, tc.Expected, orig)
+		}
+	}
+}
+
+func TestChangedPasswords(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+
+	dn, err := NormalizeDN("uid=user1,ou=Users,dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	entry, err := NewModifyEntry(dn, map[string][]string{"userPassword": {"old"}, "sn": {"user1"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	// The loaded values aren't changes
+	m := entry.Clone()
+	if got := m.ChangedPasswords(); len(got) != 0 {
+		t.Errorf("Unexpected changed passwords: %v", got)
+	}
+
+	m.Replace("sn", []string{"user1-1"})
+	m.Delete("userPassword", []string{"old"})
+	m.Add("userPassword", []string{"new"})
+	if got := m.ChangedPasswords(); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("Unexpected changed passwords: %v", got)
+	}
+	if got := m.ChangedValues(); !reflect.DeepEqual(got, map[string][]string{"sn": {"user1-1"}, "userPassword": {"new"}}) {
+		t.Errorf("Unexpected changed values: %v", got)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// NormalizeFunc returns the normalized value which is compared with the others by the matching rule.
+type NormalizeFunc func(value string) (string, error)
+
+// The registry of the normalization by the lower-cased matching rule name. The defaults follow RFC 4517.
+// The normalized value is stored into the columns, so changing the function of the rule requires reindexing
+// the existing entries which have the attributes using the rule:
+//   - attrs_norm of the entry, and the normalized DN in attrs_norm of the DN attributes referencing the entry
+//   - rdn_norm of the entry if the attribute is used in the RDN, e.g. cn, ou and uid with caseIgnoreMatch
+//
+// The search filter and the compare request are normalized by the same function when translating them,
+// so they don't match the entries which aren't reindexed.
+var (
+	equalityMatchingRules = map[string]NormalizeFunc{}
+
+	// Used for the attribute which doesn't have the known EQUALITY matching rule
+	substringsMatchingRules = map[string]NormalizeFunc{
+		"caseexactsubstringsmatch":     normalizeCaseExact,
+		"caseignoresubstringsmatch":    normalizeCaseIgnore,
+		"caseexactia5substringsmatch":  normalizeCaseExact,
+		"caseignoreia5substringsmatch": normalizeCaseIgnore,
+	}
+)
+
+// The DN rules are registered in init since the DN normalization refers to the registry recursively.
+func init() {
+	for name, f := range map[string]NormalizeFunc{
+		"caseExactMatch":         normalizeCaseExact,
+		"caseIgnoreMatch":        normalizeCaseIgnore,
+		"caseExactIA5Match":      normalizeCaseExact,
+		"caseIgnoreIA5Match":     normalizeCaseIgnore,
+		"distinguishedNameMatch": normalizeDistinguishedName,
+		"uniqueMemberMatch":      normalizeUniqueMember,
+		"generalizedTimeMatch":   normalizeGeneralizedTime,
+		"objectIdentifierMatch":  normalizeObjectIdentifier,
+		"numericStringMatch":     normalizeNumericString,
+		"telephoneNumberMatch":   normalizeTelephoneNumber,
+		"integerMatch":           normalizeExact,
+		"octetStringMatch":       normalizeExact,
+		"UUIDMatch":              normalizeUUID,
+	} {
+		RegisterMatchingRule(name, f)
+	}
+}
+
+// RegisterMatchingRule adds or replaces the normalization of the EQUALITY matching rule.
+// The rule can be used by the custom schema or -normalization-rules. It must be called before loading the schema,
+// it isn't safe for concurrent use with the running server.
+func RegisterMatchingRule(name string, f NormalizeFunc) {
+	equalityMatchingRules[strings.ToLower(name)] = f
+}
+
+// findMatchingRule returns the registered normalization of the EQUALITY matching rule.
+func findMatchingRule(name string) (NormalizeFunc, bool) {
+	f, ok := equalityMatchingRules[strings.ToLower(name)]
+	return f, ok
+}
+
+// normalize returns the normalized value by the EQUALITY matching rule of the attribute. It falls back to
+// the SUBSTR matching rule, then the value as it is.
+func normalize(s *Schema, value string) (string, error) {
+	if f, ok := findMatchingRule(s.Equality); ok {
+		return f(value)
+	}
+	if f, ok := substringsMatchingRules[strings.ToLower(s.Substr)]; ok {
+		return f(value)
+	}
+	return value, nil
+}
+
+// parseNormalizationRules parses comma separated attribute=matchingRule pairs.
+func parseNormalizationRules(rules string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, v := range strings.Split(rules, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, xerrors.Errorf("Invalid normalization rule, it must be attribute=matchingRule: %s", v)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+// applyNormalizationRules overrides the EQUALITY matching rule of the attributes by the config.
+// The rule is applied to the attribute itself, the sub types inherited the rule of the super type
+// when resolving the schema keep it. It returns error if any rule can't be applied, the server must not
+// normalize the values by the other rule than the configured one.
+func (s *Server) applyNormalizationRules(m SchemaMap) error {
+	rules, err := parseNormalizationRules(s.config.NormalizationRules)
+	if err != nil {
+		return err
+	}
+	for attr, rule := range rules {
+		as, ok := m.Get(attr)
+		if !ok {
+			return xerrors.Errorf("Unknown attribute of normalization rule: %s", attr)
+		}
+		if as.IsIndependentColumn() || as.IsUseMemberTable || as.IsUseMemberOfTable {
+			return xerrors.Errorf("Normalization rule of the attribute which isn't stored in attrs_norm: %s", attr)
+		}
+		if _, ok := findMatchingRule(rule); !ok {
+			return xerrors.Errorf("Unknown matching rule of normalization rule: %s=%s", attr, rule)
+		}
+		if as.Equality != rule {
+			log.Printf("info: Override the matching rule of %s: %s -> %s", as.Name, as.Equality, rule)
+		}
+		as.Equality = rule
+	}
+	return nil
+}
+
+func normalizeExact(value string) (string, error) {
+	return value, nil
+}
+
+func normalizeCaseExact(value string) (string, error) {
+	return normalizeSpace(value), nil
+}
+
+func normalizeCaseIgnore(value string) (string, error) {
+	return strings.ToLower(normalizeSpace(value)), nil
+}
+
+func normalizeObjectIdentifier(value string) (string, error) {
+	return strings.ToLower(value), nil
+}
+
+func normalizeNumericString(value string) (string, error) {
+	return removeAllSpace(value), nil
+}
+
+var telephoneNumberSeparatorPattern = regexp.MustCompile(`[\s-]+`)
+
+// normalizeTelephoneNumber ignores the case, the spaces and the hyphens like RFC 4517 telephoneNumberMatch.
+func normalizeTelephoneNumber(value string) (string, error) {
+	return strings.ToLower(telephoneNumberSeparatorPattern.ReplaceAllString(value, "")), nil
+}
+
+func normalizeUniqueMember(value string) (string, error) {
+	nv, err := normalizeDistinguishedName(value)
+	if err != nil {
+		// fallback
+		return normalizeCaseIgnore(value)
+	}
+	return nv, nil
+}
@@ -0,0 +1,129 @@
+//go:build !integration
+// +build !integration
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openstandia/goldap/message"
+)
+
+func TestParseNormalizationRules(t *testing.T) {
+	rules, err := parseNormalizationRules(" mail = caseExactIA5Match ,, description=caseExactMatch")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if len(rules) != 2 || rules["mail"] != "caseExactIA5Match" || rules["description"] != "caseExactMatch" {
+		t.Errorf("Unexpected rules: %v", rules)
+	}
+
+	for _, v := range []string{"mail", "mail=", "=caseExactMatch"} {
+		if _, err := parseNormalizationRules(v); err == nil {
+			t.Errorf("Expected error: %s", v)
+		}
+	}
+}
+
+func TestInvalidNormalizationRules(t *testing.T) {
+	defer func() {
+		schemaMap = InitSchemaMap(NewServer(&ServerConfig{
+			Suffix: "dc=example,dc=com",
+		}))
+	}()
+
+	for _, rules := range []string{
+		"mail",
+		"cn=unknownMatch",
+		"unknownAttr=caseExactMatch",
+		"member=caseExactMatch",
+	} {
+		server := NewServer(&ServerConfig{
+			Suffix:             "dc=example,dc=com",
+			NormalizationRules: rules,
+		})
+		schemaMap = InitSchemaMap(server)
+		if s, ok := schemaMap.Get("member"); ok {
+			s.UseMemberTable(true)
+		}
+
+		if err := server.applyNormalizationRules(schemaMap); err == nil {
+			t.Errorf("Expected error: %s", rules)
+		}
+	}
+}
+
+func TestNormalizationRules(t *testing.T) {
+	RegisterMatchingRule("testUpperMatch", func(value string) (string, error) {
+		return strings.ToUpper(value), nil
+	})
+	defer delete(equalityMatchingRules, "testuppermatch")
+
+	server := NewServer(&ServerConfig{
+		Suffix:             "dc=example,dc=com",
+		QueryTranslator:    "default",
+		NormalizationRules: "uid=caseExactMatch,description=testUpperMatch",
+	})
+	schemaMap = InitSchemaMap(server)
+	if s, ok := schemaMap.Get("member"); ok {
+		s.UseMemberTable(true)
+	}
+	if err := server.applyNormalizationRules(schemaMap); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer func() {
+		schemaMap = InitSchemaMap(server)
+	}()
+
+	testcases := []struct {
+		Name     string
+		Value    string
+		Expected string
+	}{
+		// RFC 4517 defaults
+		{"telephoneNumber", "+1 555-0100", "+15550100"},
+		{"telephoneNumber", " +1  555 0100 ", "+15550100"},
+		{"employeeNumber", "1234", "1234"},
+		{"cn", "  A  B ", "a b"},
+		// Overridden
+		{"uid", "  Foo ", "Foo"},
+		{"description", "abc", "ABC"},
+		// Not configured
+		{"cn", "Foo", "foo"},
+	}
+
+	for i, tc := range testcases {
+		sv, err := NewSchemaValue(tc.Name, []string{tc.Value})
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+		if v := sv.Norm()[0]; v != tc.Expected {
+			t.Errorf("Unexpected normalized value on %d. want: '%s', got: '%s'", i, tc.Expected, v)
+		}
+	}
+
+	if s, _ := schemaMap.Get("member"); s.Equality != "distinguishedNameMatch" {
+		t.Errorf("Unexpected matching rule of member stored in the member table: %s", s.Equality)
+	}
+
+	// The rule is applied to rdn_norm too
+	dn, err := NormalizeDN("uid=Foo,ou=Users,dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if dn.DNNormStr() != "uid=Foo,ou=users,dc=example,dc=com" {
+		t.Errorf("Unexpected normalized DN: %s", dn.DNNormStr())
+	}
+
+	// The filter is normalized by the same rule
+	s, _ := schemaMap.Get("telephoneNumber")
+	q, err := ToQuery(server, SchemaMap{"telephonenumber": s}, message.NewFilterEqualityMatch("telephoneNumber", "+1-555-0100"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if f := q.Params["filter"]; f != `$.telephoneNumber == "+15550100"` {
+		t.Errorf("Unexpected filter: %v", f)
+	}
+}
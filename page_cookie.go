@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/openstandia/goldap/message"
+	"golang.org/x/xerrors"
+)
+
+const pageCookieMACSize = 16
+
+// pageSearchKey returns the key which identifies the search for binding the paged results cookie.
+func pageSearchKey(baseDN *DN, r message.SearchRequest) string {
+	attrs := make([]string, len(r.Attributes()))
+	for i, v := range r.Attributes() {
+		attrs[i] = strings.ToLower(string(v))
+	}
+	return strings.Join([]string{
+		baseDN.DNNormStr(),
+		strconv.Itoa(int(r.Scope())),
+		r.FilterString(),
+		strings.Join(attrs, ","),
+	}, "\x00")
+}
+
+// encodePageCookie returns the cookie which holds the last-seen entry id signed with the search key.
+func encodePageCookie(key []byte, searchKey string, lastID int64) string {
+	b := make([]byte, 8, 8+pageCookieMACSize)
+	binary.BigEndian.PutUint64(b, uint64(lastID))
+	b = append(b, pageCookieMAC(key, searchKey, b)...)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageCookie returns the last-seen entry id in the cookie.
+// It fails if the cookie is tampered or issued for another search.
+func decodePageCookie(key []byte, searchKey string, cookie string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return 0, xerrors.Errorf("Invalid page cookie encoding. err: %w", err)
+	}
+	if len(b) != 8+pageCookieMACSize {
+		return 0, xerrors.Errorf("Invalid page cookie length: %d", len(b))
+	}
+	if !hmac.Equal(b[8:], pageCookieMAC(key, searchKey, b[:8])) {
+		return 0, xerrors.Errorf("Invalid page cookie signature")
+	}
+
+	return int64(binary.BigEndian.Uint64(b[:8])), nil
+}
+
+func pageCookieMAC(key []byte, searchKey string, id []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(searchKey))
+	mac.Write(id)
+	return mac.Sum(nil)[:pageCookieMACSize]
+}
@@ -0,0 +1,66 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPageCookie(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	searchKey := "ou=users,dc=example,dc=com\x002\x00(objectClass=*)\x00"
+
+	cookie := encodePageCookie(key, searchKey, 12345)
+
+	id, err := decodePageCookie(key, searchKey, cookie)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if id != 12345 {
+		t.Errorf("Unexpected id:\n%d expected, got %d", 12345, id)
+	}
+
+	testcases := []struct {
+		Name      string
+		Key       []byte
+		SearchKey string
+		Cookie    string
+	}{
+		{
+			"Another search",
+			key,
+			"ou=groups,dc=example,dc=com\x002\x00(objectClass=*)\x00",
+			cookie,
+		},
+		{
+			"Another key",
+			[]byte("fedcba9876543210fedcba9876543210"),
+			searchKey,
+			cookie,
+		},
+		{
+			"Tampered id",
+			key,
+			searchKey,
+			encodePageCookie([]byte("other"), searchKey, 1)[:11] + cookie[11:],
+		},
+		{
+			"Invalid length",
+			key,
+			searchKey,
+			cookie[:10],
+		},
+		{
+			"Invalid encoding",
+			key,
+			searchKey,
+			"!!!",
+		},
+	}
+
+	for _, tc := range testcases {
+		if _, err := decodePageCookie(tc.Key, tc.SearchKey, tc.Cookie); err == nil {
+			t.Errorf("Expected error on %s, but got nil", tc.Name)
+		}
+	}
+}
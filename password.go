@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jsimonetti/pwscheme/ssha"
+	"github.com/jsimonetti/pwscheme/ssha256"
+	"github.com/jsimonetti/pwscheme/ssha512"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/xerrors"
+)
+
+// Supported values of password-hash-scheme.
+// The stored formats are compatible with OpenLDAP and its contrib modules.
+const (
+	PasswordSchemeSSHA         = "SSHA"
+	PasswordSchemeSSHA256      = "SSHA256"
+	PasswordSchemeSSHA512      = "SSHA512"
+	PasswordSchemePBKDF2SHA256 = "PBKDF2-SHA256" // {PBKDF2-SHA256}<iterations>$<salt>$<hash>
+	PasswordSchemeBcrypt       = "BCRYPT"        // {CRYPT}$2a$<cost>$...
+	PasswordSchemeArgon2ID     = "ARGON2ID"      // {ARGON2}$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+)
+
+const passwordSaltSize = 16
+
+// The upper limits of the cost parameters. The stored hash can be set by the user, so the parameters
+// must be bounded not to exhaust the memory or CPU on verifying it.
+const (
+	maxArgon2Time      = 10
+	maxArgon2Memory    = 256 * 1024 // KiB
+	maxArgon2Threads   = 16
+	maxPBKDF2Iter      = 1000000
+	maxBcryptCost      = 14
+	maxPasswordHashLen = 1024
+)
+
+// hashedPasswordPrefixes are the prefixes of the hashed values which verifyPassword supports.
+var hashedPasswordPrefixes = []string{
+	"{SSHA}",
+	"{SSHA256}",
+	"{SSHA512}",
+	"{PBKDF2-SHA256}",
+	"{CRYPT}$2",
+	"{ARGON2}$argon2id$",
+}
+
+var errUnsupportedPasswordScheme = xerrors.New("Unsupported password scheme")
+
+// ab64 is the adapted base64 used by the PBKDF2 scheme of OpenLDAP, '.' instead of '+' without padding.
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// isHashedPassword returns true if the value is hashed by the supported scheme. The value is stored as it is.
+// The other values prefixed by {SCHEME} are the plaintext.
+func isHashedPassword(v string) bool {
+	for _, p := range hashedPasswordPrefixes {
+		if strings.HasPrefix(v, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPassThroughPassword returns true if the value is the pass-through credential. The value is stored as it is.
+func isPassThroughPassword(v string) bool {
+	return len(v) > 7 && strings.HasPrefix(v, "{SASL}")
+}
+
+func isSupportedPasswordScheme(scheme string) bool {
+	switch strings.ToUpper(scheme) {
+	case "", PasswordSchemeSSHA, PasswordSchemeSSHA256, PasswordSchemeSSHA512,
+		PasswordSchemePBKDF2SHA256, PasswordSchemeBcrypt, PasswordSchemeArgon2ID:
+		return true
+	}
+	return false
+}
+
+// validateArgon2Params returns error if the parameters make argon2.IDKey panic or exceed the limits.
+func validateArgon2Params(time, memory, threads int) error {
+	if time < 1 || time > maxArgon2Time {
+		return xerrors.Errorf("Invalid argon2id time: %d, it must be 1 to %d", time, maxArgon2Time)
+	}
+	if memory < 1 || memory > maxArgon2Memory {
+		return xerrors.Errorf("Invalid argon2id memory: %d, it must be 1 to %d", memory, maxArgon2Memory)
+	}
+	if threads < 1 || threads > maxArgon2Threads {
+		return xerrors.Errorf("Invalid argon2id threads: %d, it must be 1 to %d", threads, maxArgon2Threads)
+	}
+	return nil
+}
+
+// validatePBKDF2Iter returns error if the iterations exceed the limits.
+func validatePBKDF2Iter(iter int) error {
+	if iter < 1 || iter > maxPBKDF2Iter {
+		return xerrors.Errorf("Invalid PBKDF2-SHA256 iterations: %d, it must be 1 to %d", iter, maxPBKDF2Iter)
+	}
+	return nil
+}
+
+// validateBcryptCost returns error if the cost exceeds the limits.
+func validateBcryptCost(cost int) error {
+	if cost < bcrypt.MinCost || cost > maxBcryptCost {
+		return xerrors.Errorf("Invalid BCRYPT cost: %d, it must be %d to %d", cost, bcrypt.MinCost, maxBcryptCost)
+	}
+	return nil
+}
+
+// validatePasswordHashConfig returns error if the parameters of the configured scheme are invalid.
+func validatePasswordHashConfig(c *ServerConfig) error {
+	switch strings.ToUpper(c.PasswordHashScheme) {
+	case PasswordSchemePBKDF2SHA256:
+		return validatePBKDF2Iter(c.PasswordPBKDF2Iter)
+	case PasswordSchemeBcrypt:
+		return validateBcryptCost(c.PasswordBcryptCost)
+	case PasswordSchemeArgon2ID:
+		return validateArgon2Params(c.PasswordArgon2Time, c.PasswordArgon2Memory, c.PasswordArgon2Threads)
+	}
+	return nil
+}
+
+// hashPassword returns the hashed password with the configured scheme.
+// The plaintext is returned as it is if the scheme isn't configured.
+func (s *Server) hashPassword(plain string) (string, error) {
+	c := s.config
+
+	switch strings.ToUpper(c.PasswordHashScheme) {
+	case "":
+		return plain, nil
+	case PasswordSchemeSSHA:
+		return ssha.Generate(plain, passwordSaltSize)
+	case PasswordSchemeSSHA256:
+		return ssha256.Generate(plain, passwordSaltSize)
+	case PasswordSchemeSSHA512:
+		return ssha512.Generate(plain, passwordSaltSize)
+	case PasswordSchemePBKDF2SHA256:
+		salt, err := newPasswordSalt()
+		if err != nil {
+			return "", err
+		}
+		dk := pbkdf2.Key([]byte(plain), salt, c.PasswordPBKDF2Iter, sha256.Size, sha256.New)
+		return fmt.Sprintf("{PBKDF2-SHA256}%d$%s$%s", c.PasswordPBKDF2Iter, ab64.EncodeToString(salt), ab64.EncodeToString(dk)), nil
+	case PasswordSchemeBcrypt:
+		b, err := bcrypt.GenerateFromPassword([]byte(plain), c.PasswordBcryptCost)
+		if err != nil {
+			return "", xerrors.Errorf("Failed to hash password by bcrypt. err: %w", err)
+		}
+		return "{CRYPT}" + string(b), nil
+	case PasswordSchemeArgon2ID:
+		salt, err := newPasswordSalt()
+		if err != nil {
+			return "", err
+		}
+		hash := argon2.IDKey([]byte(plain), salt, uint32(c.PasswordArgon2Time), uint32(c.PasswordArgon2Memory), uint8(c.PasswordArgon2Threads), 32)
+		return fmt.Sprintf("{ARGON2}$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			c.PasswordArgon2Memory, c.PasswordArgon2Time, c.PasswordArgon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+	}
+	return "", xerrors.Errorf("Unsupported password hash scheme: %s", c.PasswordHashScheme)
+}
+
+// validateHashedPasswords returns invalidAttributeSyntax if the already hashed value has invalid parameters.
+// It rejects the value which is too expensive to verify on bind or compare.
+func validateHashedPasswords(values []string) error {
+	for i, v := range values {
+		if !isHashedPassword(v) {
+			continue
+		}
+		if err := validateHashedPassword(v); err != nil {
+			log.Printf("info: Invalid hashed userPassword. err: %v", err)
+			return NewInvalidPerSyntax("userPassword", i)
+		}
+	}
+	return nil
+}
+
+func validateHashedPassword(hashed string) error {
+	switch {
+	case strings.HasPrefix(hashed, "{PBKDF2-SHA256}"):
+		_, _, _, err := parsePBKDF2SHA256(strings.TrimPrefix(hashed, "{PBKDF2-SHA256}"))
+		return err
+	case strings.HasPrefix(hashed, "{CRYPT}$2"):
+		cost, err := bcrypt.Cost([]byte(strings.TrimPrefix(hashed, "{CRYPT}")))
+		if err != nil {
+			return xerrors.Errorf("Invalid BCRYPT format. err: %w", err)
+		}
+		return validateBcryptCost(cost)
+	case strings.HasPrefix(hashed, "{ARGON2}$argon2id$"):
+		_, _, _, err := parseArgon2ID(strings.TrimPrefix(hashed, "{ARGON2}"))
+		return err
+	}
+	return nil
+}
+
+// hashPasswords replaces the plaintext userPassword values with the hashed values for storing.
+// The already hashed values and the pass-through credentials are untouched.
+func (s *Server) hashPasswords(norm map[string]interface{}, orig map[string][]string) error {
+	if s.config.PasswordHashScheme == "" {
+		return nil
+	}
+	values, ok := orig["userPassword"]
+	if !ok {
+		return nil
+	}
+
+	hashed := make([]string, len(values))
+	for i, v := range values {
+		if isHashedPassword(v) || isPassThroughPassword(v) {
+			hashed[i] = v
+			continue
+		}
+		h, err := s.hashPassword(v)
+		if err != nil {
+			return NewOther(err)
+		}
+		hashed[i] = h
+	}
+	norm["userPassword"] = hashed
+	orig["userPassword"] = hashed
+
+	return nil
+}
+
+func newPasswordSalt() ([]byte, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, xerrors.Errorf("Failed to generate salt. err: %w", err)
+	}
+	return salt, nil
+}
+
+// verifyPassword compares the input with the hashed password.
+// It returns false without error if they don't match, and returns error if the scheme isn't supported.
+func verifyPassword(input, hashed string) (bool, error) {
+	var ok bool
+	var err error
+
+	switch {
+	case strings.HasPrefix(hashed, "{SSHA}"):
+		ok, err = ssha.Validate(input, hashed)
+	case strings.HasPrefix(hashed, "{SSHA256}"):
+		ok, err = ssha256.Validate(input, hashed)
+	case strings.HasPrefix(hashed, "{SSHA512}"):
+		ok, err = ssha512.Validate(input, hashed)
+	case strings.HasPrefix(hashed, "{PBKDF2-SHA256}"):
+		return verifyPBKDF2SHA256(input, strings.TrimPrefix(hashed, "{PBKDF2-SHA256}"))
+	case strings.HasPrefix(hashed, "{CRYPT}$2"):
+		if err := validateHashedPassword(hashed); err != nil {
+			return false, err
+		}
+		err = bcrypt.CompareHashAndPassword([]byte(strings.TrimPrefix(hashed, "{CRYPT}")), []byte(input))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hashed, "{ARGON2}$argon2id$"):
+		return verifyArgon2ID(input, strings.TrimPrefix(hashed, "{ARGON2}"))
+	default:
+		return false, errUnsupportedPasswordScheme
+	}
+
+	if err != nil && err.Error() == "hash does not match password" {
+		return false, nil
+	}
+	return ok, err
+}
+
+func verifyPBKDF2SHA256(input, encoded string) (bool, error) {
+	iter, salt, expected, err := parsePBKDF2SHA256(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	dk := pbkdf2.Key([]byte(input), salt, iter, len(expected), sha256.New)
+	return subtle.ConstantTimeCompare(dk, expected) == 1, nil
+}
+
+// parsePBKDF2SHA256 parses <iterations>$<salt>$<hash> and validates the parameters.
+func parsePBKDF2SHA256(encoded string) (int, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 {
+		return 0, nil, nil, xerrors.Errorf("Invalid PBKDF2-SHA256 format")
+	}
+	iter, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, nil, xerrors.Errorf("Invalid PBKDF2-SHA256 iterations: %s", parts[0])
+	}
+	if err := validatePBKDF2Iter(iter); err != nil {
+		return 0, nil, nil, err
+	}
+	salt, err := ab64.DecodeString(parts[1])
+	if err != nil {
+		return 0, nil, nil, xerrors.Errorf("Invalid PBKDF2-SHA256 salt. err: %w", err)
+	}
+	expected, err := ab64.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, xerrors.Errorf("Invalid PBKDF2-SHA256 hash. err: %w", err)
+	}
+	if len(expected) < 1 || len(expected) > maxPasswordHashLen {
+		return 0, nil, nil, xerrors.Errorf("Invalid PBKDF2-SHA256 hash length: %d", len(expected))
+	}
+	return iter, salt, expected, nil
+}
+
+// argon2Params are the parameters of the argon2id hash.
+type argon2Params struct {
+	time    int
+	memory  int
+	threads int
+}
+
+func verifyArgon2ID(input, encoded string) (bool, error) {
+	p, salt, expected, err := parseArgon2ID(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	hash := argon2.IDKey([]byte(input), salt, uint32(p.time), uint32(p.memory), uint8(p.threads), uint32(len(expected)))
+	return subtle.ConstantTimeCompare(hash, expected) == 1, nil
+}
+
+// parseArgon2ID parses $argon2id$v=19$m=65536,t=2,p=1$<salt>$<hash> and validates the parameters.
+func parseArgon2ID(encoded string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, xerrors.Errorf("Invalid argon2id format")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, xerrors.Errorf("Unsupported argon2id version: %s", parts[2])
+	}
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, nil, nil, xerrors.Errorf("Invalid argon2id params: %s, err: %w", parts[3], err)
+	}
+	if err := validateArgon2Params(p.time, p.memory, p.threads); err != nil {
+		return nil, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("Invalid argon2id salt. err: %w", err)
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("Invalid argon2id hash. err: %w", err)
+	}
+	if len(expected) < 1 || len(expected) > maxPasswordHashLen {
+		return nil, nil, nil, xerrors.Errorf("Invalid argon2id hash length: %d", len(expected))
+	}
+	return p, salt, expected, nil
+}
@@ -0,0 +1,184 @@
+// +build !integration
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, scheme := range []string{
+		PasswordSchemeSSHA,
+		PasswordSchemeSSHA256,
+		PasswordSchemeSSHA512,
+		PasswordSchemePBKDF2SHA256,
+		PasswordSchemeBcrypt,
+		PasswordSchemeArgon2ID,
+	} {
+		server := NewServer(&ServerConfig{
+			PasswordHashScheme:    scheme,
+			PasswordBcryptCost:    4,
+			PasswordArgon2Time:    1,
+			PasswordArgon2Memory:  1024,
+			PasswordArgon2Threads: 1,
+			PasswordPBKDF2Iter:    1000,
+		})
+
+		hashed, err := server.hashPassword("secret")
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %+v", scheme, err)
+		}
+		if !isHashedPassword(hashed) {
+			t.Errorf("%s: Unexpected hashed format: %s", scheme, hashed)
+		}
+		if ok, err := verifyPassword("secret", hashed); !ok || err != nil {
+			t.Errorf("%s: Expected to match. hashed: %s, err: %v", scheme, hashed, err)
+		}
+		if ok, err := verifyPassword("invalid", hashed); ok || err != nil {
+			t.Errorf("%s: Expected not to match. hashed: %s, err: %v", scheme, hashed, err)
+		}
+	}
+}
+
+func TestHashPasswords(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		PasswordHashScheme: PasswordSchemeSSHA,
+	})
+
+	norm := map[string]interface{}{
+		"userPassword": []string{"secret", "{SSHA}5m3Cqd8Gp5SVE8ik3RIYqG2g8rWYfKPx", "{MD5}secret", "{SASL}user1@example.com"},
+	}
+	orig := map[string][]string{
+		"userPassword": {"secret", "{SSHA}5m3Cqd8Gp5SVE8ik3RIYqG2g8rWYfKPx", "{MD5}secret", "{SASL}user1@example.com"},
+	}
+
+	if err := server.hashPasswords(norm, orig); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if !strings.HasPrefix(orig["userPassword"][0], "{SSHA}") || orig["userPassword"][0] == "{SSHA}5m3Cqd8Gp5SVE8ik3RIYqG2g8rWYfKPx" {
+		t.Errorf("Expected to hash the plaintext. got: %s", orig["userPassword"][0])
+	}
+	if orig["userPassword"][1] != "{SSHA}5m3Cqd8Gp5SVE8ik3RIYqG2g8rWYfKPx" {
+		t.Errorf("Expected to keep the hashed value. got: %s", orig["userPassword"][1])
+	}
+	// The unsupported scheme is the plaintext
+	if !strings.HasPrefix(orig["userPassword"][2], "{SSHA}") {
+		t.Errorf("Expected to hash the unsupported scheme value. got: %s", orig["userPassword"][2])
+	}
+	if orig["userPassword"][3] != "{SASL}user1@example.com" {
+		t.Errorf("Expected to keep the pass-through value. got: %s", orig["userPassword"][3])
+	}
+	if norm["userPassword"].([]string)[0] != orig["userPassword"][0] {
+		t.Errorf("Expected the same value in norm. got: %v", norm["userPassword"])
+	}
+}
+
+func TestMatchPassword(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		PasswordHashScheme: PasswordSchemeSSHA256,
+	})
+	hashed, _ := server.hashPassword("secret")
+
+	testcases := []struct {
+		input  string
+		stored string
+		expect bool
+	}{
+		{"secret", "secret", true},
+		{"secret", hashed, true},
+		{"other", hashed, false},
+		{hashed, hashed, true},
+		{"secret", "{SASL}user1@example.com", false},
+	}
+
+	for i, tc := range testcases {
+		if got := matchPassword(tc.input, tc.stored); got != tc.expect {
+			t.Errorf("#%d: Unexpected result. input: %s, stored: %s, want: %v, got: %v", i, tc.input, tc.stored, tc.expect, got)
+		}
+	}
+}
+
+func TestVerifyPasswordInvalidParams(t *testing.T) {
+	testcases := []string{
+		"{ARGON2}$argon2id$v=19$m=1,t=0,p=0$AAAA$AAAA",
+		"{ARGON2}$argon2id$v=19$m=65536,t=2,p=0$AAAA$AAAA",
+		"{ARGON2}$argon2id$v=19$m=65536,t=2,p=256$AAAA$AAAA",
+		"{ARGON2}$argon2id$v=19$m=4294967295,t=2,p=1$AAAA$AAAA",
+		"{ARGON2}$argon2id$v=19$m=65536,t=100000,p=1$AAAA$AAAA",
+		"{ARGON2}$argon2id$v=19$m=65536,t=2,p=1$AAAA$",
+		"{ARGON2}$argon2id$v=19$m=1048576,t=2,p=1$AAAA$AAAA",
+		"{ARGON2}$argon2id$v=19$m=65536,t=64,p=1$AAAA$AAAA",
+		"{PBKDF2-SHA256}0$AAAA$AAAA",
+		"{PBKDF2-SHA256}2000000$AAAA$AAAA",
+		"{PBKDF2-SHA256}2000000000$AAAA$AAAA",
+		"{CRYPT}$2a$31$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+	}
+
+	for i, tc := range testcases {
+		ok, err := verifyPassword("secret", tc)
+		if ok || err == nil {
+			t.Errorf("#%d: Expected invalid hash error. stored: %s, got: %v, %v", i, tc, ok, err)
+		}
+	}
+}
+
+func TestValidatePasswordHashConfig(t *testing.T) {
+	testcases := []struct {
+		config *ServerConfig
+		valid  bool
+	}{
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeArgon2ID, PasswordArgon2Time: 2, PasswordArgon2Memory: 65536, PasswordArgon2Threads: 1}, true},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeArgon2ID, PasswordArgon2Time: 0, PasswordArgon2Memory: 65536, PasswordArgon2Threads: 1}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeArgon2ID, PasswordArgon2Time: 2, PasswordArgon2Memory: 65536, PasswordArgon2Threads: 0}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeArgon2ID, PasswordArgon2Time: 2, PasswordArgon2Memory: 65536, PasswordArgon2Threads: 256}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeArgon2ID, PasswordArgon2Time: 2, PasswordArgon2Memory: 0, PasswordArgon2Threads: 1}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemePBKDF2SHA256, PasswordPBKDF2Iter: 10000}, true},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemePBKDF2SHA256, PasswordPBKDF2Iter: 0}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemePBKDF2SHA256, PasswordPBKDF2Iter: 10000000}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeArgon2ID, PasswordArgon2Time: 2, PasswordArgon2Memory: 1048576, PasswordArgon2Threads: 1}, false},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeBcrypt, PasswordBcryptCost: 10}, true},
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeBcrypt, PasswordBcryptCost: 31}, false},
+		// The parameters of the other schemes aren't used
+		{&ServerConfig{PasswordHashScheme: PasswordSchemeSSHA}, true},
+	}
+
+	for i, tc := range testcases {
+		if err := validatePasswordHashConfig(tc.config); (err == nil) != tc.valid {
+			t.Errorf("#%d: Unexpected result. want valid: %v, got: %v", i, tc.valid, err)
+		}
+	}
+}
+
+func TestValidateHashedPasswords(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		PasswordHashScheme:    PasswordSchemeArgon2ID,
+		PasswordArgon2Time:    1,
+		PasswordArgon2Memory:  1024,
+		PasswordArgon2Threads: 1,
+	})
+	hashed, _ := server.hashPassword("secret")
+
+	testcases := []struct {
+		values []string
+		valid  bool
+	}{
+		{[]string{"secret", hashed}, true},
+		{[]string{"{MD5}secret", "{SASL}user1@example.com"}, true},
+		{[]string{hashed, "{ARGON2}$argon2id$v=19$m=1048576,t=64,p=1$AAAA$AAAA"}, false},
+		{[]string{"{PBKDF2-SHA256}10000000$AAAA$AAAA"}, false},
+		{[]string{"{CRYPT}$2a$31$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"}, false},
+	}
+
+	for i, tc := range testcases {
+		err := validateHashedPasswords(tc.values)
+		if (err == nil) != tc.valid {
+			t.Errorf("#%d: Unexpected result. want valid: %v, got: %v", i, tc.valid, err)
+		}
+		if err != nil {
+			if lerr, ok := err.(*LDAPError); !ok || lerr.Code != 21 {
+				t.Errorf("#%d: Expected invalidAttributeSyntax. got: %v", i, err)
+			}
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -18,50 +19,63 @@ var (
 	findDNByIDStmt                 *sqlx.NamedStmt
 	findContainerByPathStmt        *sqlx.NamedStmt
 	findIDByParentIDAndRDNNormStmt *sqlx.NamedStmt
-
-	filterStmtMap StmtCache
-	treeStmtCache StmtCache
+	findRootRDNsStmt               *sqlx.NamedStmt
 
 	// repo_update
-	updateAttrsByIdStmt *sqlx.NamedStmt
-	updateDNByIdStmt    *sqlx.NamedStmt
-	updateRDNByIdStmt   *sqlx.NamedStmt
+	updateAttrsByIdStmt       *sqlx.NamedStmt
+	updateAttrsByIdAndRevStmt *sqlx.NamedStmt
+	updateDNByIdStmt          *sqlx.NamedStmt
+	updateRDNByIdStmt         *sqlx.NamedStmt
+	findPwdHistoryByIdStmt    *sqlx.NamedStmt
+	updatePwdHistoryByIdStmt  *sqlx.NamedStmt
 
 	// repo_delete
 	deleteTreeByIDStmt         *sqlx.NamedStmt
 	deleteByIDStmt             *sqlx.NamedStmt
 	hasSubStmt                 *sqlx.NamedStmt
+	hasLiveSubStmt             *sqlx.NamedStmt
+	softDeleteByIDStmt         *sqlx.NamedStmt
 	removeMemberByIDStmt       *sqlx.NamedStmt
 	removeUniqueMemberByIDStmt *sqlx.NamedStmt
+
+	// repo_changelog
+	insertChangelogStmt *sqlx.NamedStmt
+
+	// repo_compare
+	compareByIDStmt         *sqlx.NamedStmt
+	compareMemberOfByIDStmt *sqlx.NamedStmt
 )
 
-// For generic filter
-type StmtCache struct {
-	sm sync.Map
-}
+type Repository struct {
+	server    *Server
+	db        *sqlx.DB
+	dnCache   *DNCache
+	stmtCache *StmtCache
+	logger    Logger
+	redactor  *Redactor
 
-func (m *StmtCache) Get(key string) (*sqlx.NamedStmt, bool) {
-	val, ok := m.sm.Load(key)
-	if !ok {
-		return nil, false
-	}
-	return val.(*sqlx.NamedStmt), true
-}
+	// health check
+	unhealthy       int32
+	stopHealthCheck chan struct{}
 
-func (m *StmtCache) Put(key string, value *sqlx.NamedStmt) {
-	m.sm.Store(key, value)
-}
+	// changelog
+	stopChangelogPruning chan struct{}
 
-type Repository struct {
-	server *Server
-	db     *sqlx.DB
+	// soft delete
+	stopTombstonePurge chan struct{}
+
+	// The options of the write transactions
+	txOptions *sql.TxOptions
+
+	// referential integrity
+	refintMode string
+
+	metrics Metrics
 }
 
 func NewRepository(server *Server) (*Repository, error) {
 	// Init DB Connection
-	db, err := sqlx.Connect("postgres", fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable search_path=%s",
-		server.config.DBHostName, server.config.DBPort, server.config.DBUser, server.config.DBName,
-		server.config.DBPassword, server.config.DBSchema))
+	db, err := sqlx.Connect("postgres", dataSourceName(server.config))
 	if err != nil {
 		log.Fatalf("alert: Connect error. host=%s, port=%d, user=%s, dbname=%s, error=%s",
 			server.config.DBHostName, server.config.DBPort, server.config.DBUser, server.config.DBName, err)
@@ -70,10 +84,40 @@ func NewRepository(server *Server) (*Repository, error) {
 	db.SetMaxIdleConns(server.config.DBMaxIdleConns)
 	// db.SetConnMaxLifetime(time.Hour)
 
+	isolation, err := parseIsolationLevel(server.config.DBIsolationLevel)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("info: Transaction isolation level: %s", isolation)
+
+	refintMode, err := parseRefintMode(server.config.RefintMode)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("info: Referential integrity mode: %s", refintMode)
+
+	logLevel, err := ParseLogLevel(server.config.RepoLogLevel)
+	if err != nil {
+		log.Printf("warn: Invalid repository log level, use warn. err: %v", err)
+	}
+
 	repo := &Repository{
-		server: server,
-		db:     db,
+		server:    server,
+		db:        db,
+		dnCache:   NewDNCache(server.config.DNCacheSize, time.Duration(server.config.DNCacheTTL)*time.Second),
+		stmtCache: NewStmtCache(db, server.config.StmtCacheSize),
+		logger:    NewStdLogger(logLevel),
+		redactor:  NewRedactor(strings.Split(server.config.LogRedactAttrs, ",")),
+		txOptions: &sql.TxOptions{
+			Isolation: isolation,
+		},
+		refintMode: refintMode,
+		metrics:    noopMetrics{},
+	}
+	if repo.dnCache != nil {
+		log.Printf("info: DN cache is enabled. size: %d, ttl: %ds", server.config.DNCacheSize, server.config.DNCacheTTL)
 	}
+	log.Printf("info: Statement cache size: %d", server.config.StmtCacheSize)
 
 	err = repo.initTables(db)
 	if err != nil {
@@ -88,6 +132,38 @@ func NewRepository(server *Server) (*Repository, error) {
 	return repo, nil
 }
 
+func dataSourceName(c *ServerConfig) string {
+	return fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=disable search_path=%s",
+		c.DBHostName, c.DBPort, c.DBUser, c.DBName, c.DBPassword, c.DBSchema)
+}
+
+// parseIsolationLevel returns the isolation level of the config. Empty means READ COMMITTED,
+// which is the default of PostgreSQL.
+func parseIsolationLevel(level string) (sql.IsolationLevel, error) {
+	switch strings.ToLower(strings.NewReplacer("_", "-", " ", "-").Replace(strings.TrimSpace(level))) {
+	case "", "read-committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable-read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	}
+	return sql.LevelDefault, xerrors.Errorf("Unsupported isolation level: %s", level)
+}
+
+// SetLogger replaces the logger of the repository, e.g. with an adapter of zap or logrus.
+func (r *Repository) SetLogger(l Logger) {
+	r.logger = l
+}
+
+// logQuery logs the query and the params at debug level. The sensitive attributes are redacted.
+func (r *Repository) logQuery(msg, q string, params map[string]interface{}) {
+	if !r.logger.Enabled(LogDebug) {
+		return
+	}
+	r.logger.Log(LogDebug, msg, "query", q, "params", r.redactor.RedactParams(params))
+}
+
 func (r *Repository) initTables(db *sqlx.DB) error {
 	_, err := db.Exec(`
 	CREATE EXTENSION IF NOT EXISTS pgcrypto;
@@ -105,14 +181,62 @@ func (r *Repository) initTables(db *sqlx.DB) error {
 		rdn_norm VARCHAR(255) NOT NULL,
 		rdn_orig VARCHAR(255) NOT NULL,
 		attrs_norm JSONB NOT NULL,
-		attrs_orig JSONB NOT NULL
+		attrs_orig JSONB NOT NULL,
+		rev BIGINT NOT NULL DEFAULT 1,
+		pwd_history JSONB NOT NULL DEFAULT '[]',
+		deleted_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		creator TEXT NOT NULL DEFAULT '',
+		modified_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		modifier TEXT NOT NULL DEFAULT ''
 	);
+	ALTER TABLE ldap_entry ADD COLUMN IF NOT EXISTS rev BIGINT NOT NULL DEFAULT 1;
+	ALTER TABLE ldap_entry ADD COLUMN IF NOT EXISTS pwd_history JSONB NOT NULL DEFAULT '[]';
+	ALTER TABLE ldap_entry ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+	-- operational attributes, the existing entries are migrated from the timestamps in attrs_orig only once
+	DO $$
+	BEGIN
+		IF NOT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'ldap_entry' AND column_name = 'created_at'
+		) THEN
+			ALTER TABLE ldap_entry
+				ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				ADD COLUMN creator TEXT NOT NULL DEFAULT '',
+				ADD COLUMN modified_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				ADD COLUMN modifier TEXT NOT NULL DEFAULT '';
+			UPDATE ldap_entry SET
+				created_at = COALESCE(to_timestamp(left(attrs_orig->'createTimestamp'->>0, 14), 'YYYYMMDDHH24MISS')::timestamp AT TIME ZONE 'UTC', created_at),
+				modified_at = COALESCE(to_timestamp(left(attrs_orig->'modifyTimestamp'->>0, 14), 'YYYYMMDDHH24MISS')::timestamp AT TIME ZONE 'UTC', modified_at);
+		END IF;
+	END $$;
 	
 	-- basic index
 	CREATE UNIQUE INDEX IF NOT EXISTS idx_ldap_entry_rdn_norm ON ldap_entry (parent_id, rdn_norm);
+	-- the index above doesn't work for NULL parent_id, the root entries need their own
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_ldap_entry_root_rdn_norm ON ldap_entry (rdn_norm) WHERE parent_id IS NULL;
 	
 	-- all json index
 	CREATE INDEX IF NOT EXISTS idx_ldap_entry_attrs ON ldap_entry USING gin (attrs_norm jsonb_path_ops);
+	
+	-- incremental read by modifyTimestamp
+	CREATE INDEX IF NOT EXISTS idx_ldap_entry_modified_at ON ldap_entry (modified_at);
+	
+	-- tombstone index for purging
+	CREATE INDEX IF NOT EXISTS idx_ldap_entry_deleted_at ON ldap_entry (deleted_at) WHERE deleted_at IS NOT NULL;
+	
+	-- changelog for the subscribers to resync
+	CREATE TABLE IF NOT EXISTS ldap_changelog (
+		seq BIGSERIAL PRIMARY KEY,
+		entry_id BIGINT NOT NULL,
+		dn_orig TEXT NOT NULL,
+		old_dn_orig TEXT NOT NULL DEFAULT '',
+		change_type VARCHAR(16) NOT NULL,
+		rev BIGINT NOT NULL,
+		created TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS idx_ldap_changelog_created ON ldap_changelog (created);
 	`)
 	return err
 }
@@ -135,6 +259,13 @@ func (r *Repository) initStmt(db *sqlx.DB) error {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
 
+	findRootRDNsStmt, err = db.PrepareNamed(`SELECT rdn_orig FROM ldap_entry
+		WHERE parent_id IS NULL AND deleted_at IS NULL
+		ORDER BY id`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
 	findContainerByPathStmt, err = db.PrepareNamed(`SELECT
 		t.id, string_agg(e.rdn_orig, ',' ORDER BY dn.ord DESC) AS dn_orig
 		FROM
@@ -153,14 +284,25 @@ func (r *Repository) initStmt(db *sqlx.DB) error {
 		FROM
 			ldap_entry e
 		WHERE
-			e.parent_id = :parent_id AND e.rdn_norm = :rdn_norm
+			e.parent_id = :parent_id AND e.rdn_norm = :rdn_norm AND e.deleted_at IS NULL
 	`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
 
-	updateAttrsByIdStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET attrs_norm = :attrs_norm, attrs_orig = :attrs_orig
-		WHERE id = :id`)
+	// The rev is incremented in the same statement to avoid read-modify-write race
+	updateAttrsByIdStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET attrs_norm = :attrs_norm, attrs_orig = :attrs_orig,
+		modified_at = :modified_at, modifier = :modifier, rev = rev + 1
+		WHERE id = :id
+		RETURNING rev`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	updateAttrsByIdAndRevStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET attrs_norm = :attrs_norm, attrs_orig = :attrs_orig,
+		modified_at = :modified_at, modifier = :modifier, rev = rev + 1
+		WHERE id = :id AND rev = :rev
+		RETURNING rev`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
@@ -168,15 +310,31 @@ func (r *Repository) initStmt(db *sqlx.DB) error {
 	updateDNByIdStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET
 		rdn_orig = :new_rdn_orig, rdn_norm = :new_rdn_norm,
 		attrs_norm = :attrs_norm, attrs_orig = :attrs_orig,
-		parent_id = :parent_id
-		WHERE id = :id`)
+		parent_id = :parent_id, modified_at = :modified_at, modifier = :modifier, rev = rev + 1
+		WHERE id = :id
+		RETURNING rev`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
 
 	updateRDNByIdStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET
 		rdn_orig = :new_rdn_orig, rdn_norm = :new_rdn_norm,
-		attrs_norm = :attrs_norm, attrs_orig = :attrs_orig
+		attrs_norm = :attrs_norm, attrs_orig = :attrs_orig,
+		modified_at = :modified_at, modifier = :modifier, rev = rev + 1
+		WHERE id = :id
+		RETURNING rev`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	// The previous password hashes are kept in the separate column not to be returned by search
+	findPwdHistoryByIdStmt, err = db.PrepareNamed(`SELECT pwd_history FROM ldap_entry
+		WHERE id = :id`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	updatePwdHistoryByIdStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET pwd_history = :pwd_history
 		WHERE id = :id`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
@@ -189,16 +347,29 @@ func (r *Repository) initStmt(db *sqlx.DB) error {
 	}
 
 	deleteByIDStmt, err = db.PrepareNamed(`DELETE FROM ldap_entry 
-		WHERE id = :id RETURNING id`)
+		WHERE id = :id RETURNING id, rev`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
 
+	// The tombstones are counted as children since they keep the tree until purging
 	hasSubStmt, err = db.PrepareNamed(`SELECT EXISTS (SELECT 1 FROM ldap_entry WHERE parent_id = :id)`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
 
+	hasLiveSubStmt, err = db.PrepareNamed(`SELECT EXISTS (SELECT 1 FROM ldap_entry WHERE parent_id = :id AND deleted_at IS NULL)`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	softDeleteByIDStmt, err = db.PrepareNamed(`UPDATE ldap_entry SET deleted_at = now(), rev = rev + 1
+		WHERE id = :id AND deleted_at IS NULL
+		RETURNING id, rev`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
 	// Don't need to update modifyTimestamp since it's overlay function
 	removeMemberByIDStmt, err = db.PrepareNamed(`UPDATE ldap_entry
 		SET attrs_norm =
@@ -207,9 +378,10 @@ func (r *Repository) initStmt(db *sqlx.DB) error {
 					attrs_norm #- '{member}'
 				ELSE
 					attrs_norm || jsonb_build_object('member', jsonb_path_query_array(attrs_norm->'member', :cond_filter))
-			END
+			END,
+			rev = rev + 1
 		WHERE attrs_norm @@ :cond_where
-		RETURNING id`)
+		RETURNING id, rev`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
@@ -222,9 +394,33 @@ func (r *Repository) initStmt(db *sqlx.DB) error {
 					attrs_norm #- '{uniqueMember}'
 				ELSE
 					attrs_norm || jsonb_build_object('uniqueMember', jsonb_path_query_array(attrs_norm->'uniqueMember', :cond_filter))
-			END
+			END,
+			rev = rev + 1
 		WHERE attrs_norm @@ :cond_where
-		RETURNING id`)
+		RETURNING id, rev`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	insertChangelogStmt, err = db.PrepareNamed(`INSERT INTO ldap_changelog (entry_id, dn_orig, old_dn_orig, change_type, rev)
+		VALUES (:entry_id, :dn_orig, :old_dn_orig, :change_type, :rev)
+		RETURNING seq`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	compareByIDStmt, err = db.PrepareNamed(`SELECT
+		COALESCE(attrs_norm->(:attr::::text) @> :value::::jsonb, false)
+		FROM ldap_entry
+		WHERE id = :id`)
+	if err != nil {
+		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
+	}
+
+	compareMemberOfByIDStmt, err = db.PrepareNamed(`SELECT
+		COALESCE(attrs_norm->'member' @> :value::::jsonb OR attrs_norm->'uniqueMember' @> :value::::jsonb, false)
+		FROM ldap_entry
+		WHERE id = :id`)
 	if err != nil {
 		return xerrors.Errorf("Failed to initialize prepared statement: %w", err)
 	}
@@ -237,10 +433,20 @@ type DBEntry struct {
 	DNNorm    string         `db:"dn_norm"`
 	DNOrig    string         `db:"dn_orig"`
 	EntryUUID string         `db:"uuid"`
-	Created   time.Time      `db:"created"`
-	Updated   time.Time      `db:"updated"`
+	Created   time.Time      `db:"created_at"`
+	Creator   string         `db:"creator"`
+	Updated   time.Time      `db:"modified_at"`
+	Modifier  string         `db:"modifier"`
 	AttrsNorm types.JSONText `db:"attrs_norm"`
 	AttrsOrig types.JSONText `db:"attrs_orig"`
 	Count     int32          `db:"count"`    // No real column in the table
 	MemberOf  types.JSONText `db:"memberof"` // No real column in the table
 }
+
+// setOperationalParams sets the params for the columns of the operational attributes.
+func (e *DBEntry) setOperationalParams(params map[string]interface{}) {
+	params["created_at"] = e.Created
+	params["creator"] = e.Creator
+	params["modified_at"] = e.Updated
+	params["modifier"] = e.Modifier
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+// changelogChannel is the channel of NOTIFY for the changes of the entries.
+const changelogChannel = "ldap_pg_changelog"
+
+type ChangeType string
+
+const (
+	ChangeTypeAdd    ChangeType = "add"
+	ChangeTypeModify ChangeType = "modify"
+	ChangeTypeModDN  ChangeType = "modrdn"
+	ChangeTypeDelete ChangeType = "delete"
+)
+
+// ChangeEvent is a change of the entry. Seq is the sequence of the changelog table,
+// it can be used as the checkpoint for resync.
+type ChangeEvent struct {
+	Seq     int64      `json:"seq" db:"seq"`
+	EntryID int64      `json:"id" db:"entry_id"`
+	DN      string     `json:"dn" db:"dn_orig"`
+	OldDN   string     `json:"old_dn,omitempty" db:"old_dn_orig"` // Only for modrdn
+	Type    ChangeType `json:"type" db:"change_type"`
+	Rev     int64      `json:"rev" db:"rev"`
+}
+
+// publishChange records the change into the changelog table and publishes it by NOTIFY in the transaction.
+// Both of them are discarded when the transaction is rolled back, NOTIFY is delivered only on commit.
+func (r *Repository) publishChange(tx *sqlx.Tx, ev *ChangeEvent) error {
+	err := namedStmt(tx, insertChangelogStmt).Get(&ev.Seq, map[string]interface{}{
+		"entry_id":    ev.EntryID,
+		"dn_orig":     ev.DN,
+		"old_dn_orig": ev.OldDN,
+		"change_type": ev.Type,
+		"rev":         ev.Rev,
+	})
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to insert changelog. event: %v, err: %w", ev, err))
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return xerrors.Errorf("Failed to marshal change event. event: %v, err: %w", ev, err)
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, changelogChannel, string(payload))
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to notify change event. event: %v, err: %w", ev, err))
+	}
+	return nil
+}
+
+// publishModifyByID publishes the modification of the entry which is changed by the other entry's operation,
+// e.g. member is removed by deleting the member entry.
+func (r *Repository) publishModifyByID(tx *sqlx.Tx, id, rev int64) error {
+	dn, err := r.FindDNByID(tx, id, false)
+	if err != nil {
+		return err
+	}
+	return r.publishChange(tx, &ChangeEvent{
+		EntryID: id,
+		DN:      dn.DNOrig,
+		Type:    ChangeTypeModify,
+		Rev:     rev,
+	})
+}
+
+// Subscribe runs a dedicated LISTEN connection and returns the change events committed after subscribing.
+// When the connection is reestablished, the missed events are resynced from the changelog table
+// using the last received seq as the checkpoint. The events can be delivered out of seq order
+// since the transactions commit in any order, use rev to order the changes of the same entry.
+// The channel is closed when the context is done or it fails to subscribe.
+func (r *Repository) Subscribe(ctx context.Context) <-chan ChangeEvent {
+	ch := make(chan ChangeEvent, 100)
+
+	listener := pq.NewListener(dataSourceName(r.server.config), 100*time.Millisecond, 10*time.Second,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("warn: Changelog listener event: %d, err: %v", ev, err)
+			}
+		})
+
+	if err := listener.Listen(changelogChannel); err != nil {
+		log.Printf("error: Failed to listen changelog. err: %+v", err)
+		listener.Close()
+		close(ch)
+		return ch
+	}
+
+	// The checkpoint starts from the latest change when subscribing
+	var lastSeq int64
+	if err := r.db.GetContext(ctx, &lastSeq, `SELECT COALESCE(MAX(seq), 0) FROM ldap_changelog`); err != nil {
+		log.Printf("error: Failed to fetch the latest changelog. err: %+v", err)
+		listener.Close()
+		close(ch)
+		return ch
+	}
+
+	s := &changeSubscriber{
+		r:        r,
+		ch:       ch,
+		startSeq: lastSeq,
+		lastSeq:  lastSeq,
+		sent:     map[int64]struct{}{},
+	}
+
+	go func() {
+		defer close(ch)
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case n := <-listener.Notify:
+				if n == nil {
+					// Reconnected, the notifications might be missed while disconnected
+					log.Printf("info: Resync changelog after reconnecting. checkpoint: %d", s.lastSeq)
+					if !s.resync(ctx) {
+						return
+					}
+					continue
+				}
+
+				var ev ChangeEvent
+				if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+					log.Printf("warn: Invalid change event. payload: %s, err: %v", n.Extra, err)
+					continue
+				}
+				if !s.send(ctx, ev) {
+					return
+				}
+
+			case <-time.After(90 * time.Second):
+				// Detect the broken connection which doesn't notify anything
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return ch
+}
+
+// changeSubscriberWindow is the range of seq to remember the sent events.
+// The events in the window are deduplicated between the notifications and the resync.
+const changeSubscriberWindow = 1000
+
+type changeSubscriber struct {
+	r        *Repository
+	ch       chan ChangeEvent
+	startSeq int64 // The events before subscribing aren't sent
+	lastSeq  int64
+	sent     map[int64]struct{}
+}
+
+func (s *changeSubscriber) send(ctx context.Context, ev ChangeEvent) bool {
+	if _, ok := s.sent[ev.Seq]; ok {
+		return true
+	}
+
+	select {
+	case s.ch <- ev:
+	case <-ctx.Done():
+		return false
+	}
+
+	s.sent[ev.Seq] = struct{}{}
+	if ev.Seq > s.lastSeq {
+		s.lastSeq = ev.Seq
+	}
+	for seq := range s.sent {
+		if seq < s.lastSeq-changeSubscriberWindow {
+			delete(s.sent, seq)
+		}
+	}
+	return true
+}
+
+func (s *changeSubscriber) resync(ctx context.Context) bool {
+	// Include the window since the earlier transaction can commit later
+	from := s.lastSeq - changeSubscriberWindow
+	if from < s.startSeq {
+		from = s.startSeq
+	}
+
+	var events []ChangeEvent
+	err := s.r.db.SelectContext(ctx, &events, `SELECT seq, entry_id, dn_orig, old_dn_orig, change_type, rev
+		FROM ldap_changelog WHERE seq > $1 ORDER BY seq`, from)
+	if err != nil {
+		// The next reconnection retries
+		log.Printf("warn: Failed to resync changelog. checkpoint: %d, err: %v", s.lastSeq, err)
+		return ctx.Err() == nil
+	}
+
+	for _, ev := range events {
+		if !s.send(ctx, ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// StartChangelogPruning deletes the changelog older than the retention in background.
+func (r *Repository) StartChangelogPruning(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	r.stopChangelogPruning = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		interval := retention / 10
+		if interval > time.Hour {
+			interval = time.Hour
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+
+			res, err := r.db.Exec(`DELETE FROM ldap_changelog WHERE created < $1`, time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("warn: Failed to prune changelog. err: %v", err)
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("info: Pruned changelog. count: %d", n)
+			}
+		}
+	}(r.stopChangelogPruning)
+}
+
+// StopChangelogPruning stops the background pruning.
+func (r *Repository) StopChangelogPruning() {
+	if r.stopChangelogPruning != nil {
+		close(r.stopChangelogPruning)
+		r.stopChangelogPruning = nil
+	}
+}
@@ -0,0 +1,74 @@
+// +build !integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestChangeEventJSON(t *testing.T) {
+	testcases := []struct {
+		ev     ChangeEvent
+		expect string
+	}{
+		{
+			ChangeEvent{Seq: 1, EntryID: 10, DN: "uid=user1,ou=Users,dc=example,dc=com", Type: ChangeTypeAdd, Rev: 1},
+			`{"seq":1,"id":10,"dn":"uid=user1,ou=Users,dc=example,dc=com","type":"add","rev":1}`,
+		},
+		{
+			ChangeEvent{Seq: 2, EntryID: 10, DN: "uid=user2,ou=Users,dc=example,dc=com", OldDN: "uid=user1,ou=Users,dc=example,dc=com", Type: ChangeTypeModDN, Rev: 2},
+			`{"seq":2,"id":10,"dn":"uid=user2,ou=Users,dc=example,dc=com","old_dn":"uid=user1,ou=Users,dc=example,dc=com","type":"modrdn","rev":2}`,
+		},
+	}
+
+	for i, tc := range testcases {
+		b, err := json.Marshal(tc.ev)
+		if err != nil {
+			t.Fatalf("#%d: Unexpected error: %+v", i, err)
+		}
+		if string(b) != tc.expect {
+			t.Errorf("#%d: Unexpected JSON. want: %s, got: %s", i, tc.expect, string(b))
+		}
+
+		var got ChangeEvent
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("#%d: Unexpected error: %+v", i, err)
+		}
+		if !reflect.DeepEqual(got, tc.ev) {
+			t.Errorf("#%d: Unexpected event. want: %v, got: %v", i, tc.ev, got)
+		}
+	}
+}
+
+func TestChangeSubscriberSend(t *testing.T) {
+	ch := make(chan ChangeEvent, 10)
+	s := &changeSubscriber{
+		ch:   ch,
+		sent: map[int64]struct{}{},
+	}
+
+	ctx := context.Background()
+	for _, seq := range []int64{2, 1, 2, changeSubscriberWindow + 3, 1} {
+		if !s.send(ctx, ChangeEvent{Seq: seq}) {
+			t.Fatalf("Unexpected stop. seq: %d", seq)
+		}
+	}
+	close(ch)
+
+	var got []int64
+	for ev := range ch {
+		got = append(got, ev.Seq)
+	}
+
+	// The duplicate is skipped, but the seq out of the window can't be deduplicated
+	expect := []int64{2, 1, changeSubscriberWindow + 3, 1}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Unexpected events. want: %v, got: %v", expect, got)
+	}
+	if s.lastSeq != changeSubscriberWindow+3 {
+		t.Errorf("Unexpected checkpoint. want: %d, got: %d", changeSubscriberWindow+3, s.lastSeq)
+	}
+}
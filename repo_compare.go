@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"golang.org/x/xerrors"
+)
+
+// Compare returns true if the entry has the value of the attribute.
+// The value is normalized by the EQUALITY matching rule of the attribute, then it's compared with attrs_norm.
+// userPassword is verified against the stored hash.
+// It returns false if the entry doesn't have the attribute, not to reveal whether the attribute exists.
+func (r *Repository) Compare(dn *DN, attr, value string) (bool, error) {
+	start := time.Now()
+	matched, err := r.compare(dn, attr, value)
+	r.observe("compare", start, err)
+	return matched, err
+}
+
+func (r *Repository) compare(dn *DN, attr, value string) (bool, error) {
+	s, ok := schemaMap.Get(attr)
+	if !ok {
+		return false, NewUndefinedType(attr)
+	}
+
+	fetchedDN, err := r.FindDNByDNWithLock(nil, dn, false)
+	if err != nil {
+		return false, err
+	}
+
+	sv, err := NewSchemaValue(s.Name, []string{value})
+	if err != nil {
+		return false, err
+	}
+
+	// The password might be hashed, verify it like bind
+	if s.Name == "userPassword" {
+		cred, err := r.FindCredByDN(dn)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range cred.Cred {
+			if matchPassword(value, c) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// The member attributes are stored as the id of the entry
+	if s.IsUseMemberTable || s.IsUseMemberOfTable {
+		valueDN, err := r.server.NormalizeDN(value)
+		if err != nil {
+			return false, NewInvalidPerSyntax(s.Name, 0)
+		}
+		valueFetchedDN, err := r.FindDNByDNWithLock(nil, valueDN, false)
+		if err != nil {
+			var ldapErr *LDAPError
+			if xerrors.As(err, &ldapErr) && ldapErr.IsNoSuchObjectError() {
+				return false, nil
+			}
+			return false, err
+		}
+
+		if s.IsUseMemberOfTable {
+			// memberOf is computed from member/uniqueMember of the group
+			return r.compareByID(compareMemberOfByIDStmt, valueFetchedDN.ID, "", []int64{fetchedDN.ID})
+		}
+		return r.compareByID(compareByIDStmt, fetchedDN.ID, s.Name, []int64{valueFetchedDN.ID})
+	}
+
+	return r.compareByID(compareByIDStmt, fetchedDN.ID, s.Name, sv.Norm())
+}
+
+func (r *Repository) compareByID(stmt *sqlx.NamedStmt, id int64, attr string, value interface{}) (bool, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return false, xerrors.Errorf("Failed to marshal the value for compare. id: %d, attr: %s, err: %w", id, attr, err)
+	}
+
+	var matched bool
+	err = stmt.Get(&matched, map[string]interface{}{
+		"id":    id,
+		"attr":  attr,
+		"value": types.JSONText(b),
+	})
+	if err != nil {
+		if isNoResult(err) {
+			return false, NewNoSuchObject()
+		}
+		return false, NewDBError(xerrors.Errorf("Failed to compare. id: %d, attr: %s, err: %w", id, attr, err))
+	}
+	return matched, nil
+}
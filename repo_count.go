@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx/types"
+	"golang.org/x/xerrors"
+)
+
+// Count returns the number of the entries matching the condition built by SearchWhere, and whether it's estimated.
+// The same condition and params as Search are used, so the count is consistent with the fetched entries.
+// The matching entries are counted in the DB, they aren't fetched.
+// The planner estimate is returned instead if it's equal or greater than the threshold since counting
+// many entries exactly needs to scan all of them. The threshold 0 or exact always counts exactly.
+func (r *Repository) Count(where string, q *Query, exact bool) (int64, bool, error) {
+	params := q.Params
+
+	from := `FROM ldap_entry e WHERE e.deleted_at IS NULL AND (` + where + `)`
+
+	if threshold := r.server.config.CountEstimateThreshold; threshold > 0 && !exact {
+		estimate, err := r.estimate(`SELECT e.id `+from, params)
+		if err != nil {
+			return 0, false, err
+		}
+		if estimate >= int64(threshold) {
+			return estimate, true, nil
+		}
+	}
+
+	stmt, release, err := r.stmtCache.PrepareNamedContext(context.Background(), nil, `SELECT count(e.id) `+from)
+	if err != nil {
+		return 0, false, NewDBError(xerrors.Errorf("Failed to prepare the count query. err: %w", err))
+	}
+	defer release()
+
+	var count int64
+	if err := stmt.Get(&count, params); err != nil {
+		return 0, false, NewDBError(xerrors.Errorf("Failed to count the entries. err: %w", err))
+	}
+	return count, false, nil
+}
+
+// estimate returns the number of the rows estimated by the planner for the query,
+// which is computed from reltuples and the statistics of the table without executing the query.
+func (r *Repository) estimate(query string, params map[string]interface{}) (int64, error) {
+	stmt, release, err := r.stmtCache.PrepareNamedContext(context.Background(), nil, `EXPLAIN (FORMAT JSON) `+query)
+	if err != nil {
+		return 0, NewDBError(xerrors.Errorf("Failed to prepare the estimate query. err: %w", err))
+	}
+	defer release()
+
+	var plan types.JSONText
+	if err := stmt.Get(&plan, params); err != nil {
+		return 0, NewDBError(xerrors.Errorf("Failed to estimate the entries. err: %w", err))
+	}
+	return parsePlanRows(plan)
+}
+
+// parsePlanRows returns the rows of the top plan node in the output of EXPLAIN (FORMAT JSON).
+func parsePlanRows(plan []byte) (int64, error) {
+	var explain []struct {
+		Plan struct {
+			PlanRows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(plan, &explain); err != nil {
+		return 0, xerrors.Errorf("Failed to parse the plan. err: %w", err)
+	}
+	if len(explain) == 0 {
+		return 0, xerrors.Errorf("Empty plan")
+	}
+	return int64(explain[0].Plan.PlanRows), nil
+}
@@ -0,0 +1,23 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePlanRows(t *testing.T) {
+	rows, err := parsePlanRows([]byte(`[{"Plan": {"Node Type": "Seq Scan", "Relation Name": "ldap_entry", "Plan Rows": 12345, "Plan Width": 8}}]`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if rows != 12345 {
+		t.Errorf("Unexpected rows. want: 12345, got: %d", rows)
+	}
+
+	for _, plan := range []string{`[]`, `invalid`} {
+		if _, err := parsePlanRows([]byte(plan)); err == nil {
+			t.Errorf("Expected error for the plan: %s", plan)
+		}
+	}
+}
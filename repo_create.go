@@ -1,123 +1,300 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/xerrors"
 )
 
+const (
+	// The tombstone of the same DN is revived with the new attributes in the same statement,
+	// so re-adding the deleted DN doesn't conflict with it. The live entry is never updated.
+	reviveTombstoneOnConflictSQL = `
+		ON CONFLICT (parent_id, rdn_norm) DO UPDATE SET
+			rdn_orig = EXCLUDED.rdn_orig, attrs_norm = EXCLUDED.attrs_norm, attrs_orig = EXCLUDED.attrs_orig,
+			created_at = EXCLUDED.created_at, creator = EXCLUDED.creator,
+			modified_at = EXCLUDED.modified_at, modifier = EXCLUDED.modifier,
+			pwd_history = '[]', deleted_at = NULL, rev = ldap_entry.rev + 1
+			WHERE ldap_entry.deleted_at IS NOT NULL`
+
+	insertEntryByParentIDSQL = `
+		INSERT INTO ldap_entry (parent_id, rdn_norm, rdn_orig, attrs_norm, attrs_orig, created_at, creator, modified_at, modifier)
+		SELECT :parent_id, :rdn_norm, :rdn_orig, :attrs_norm, :attrs_orig, :created_at, :creator, :modified_at, :modifier
+			WHERE NOT EXISTS (
+				SELECT id FROM ldap_entry WHERE parent_id = :parent_id AND rdn_norm = :rdn_norm AND deleted_at IS NULL
+			)
+		` + reviveTombstoneOnConflictSQL + `
+		RETURNING id, parent_id, rev`
+
+	insertTreeByPathSQL = `
+			INSERT INTO ldap_tree (id, path)
+			SELECT :id, :path::::ltree
+			WHERE NOT EXISTS (
+				SELECT id FROM ldap_tree WHERE id = :id
+			)
+			RETURNING id, path
+	`
+)
+
 func (r *Repository) Insert(entry *AddEntry) (int64, error) {
-	tx := r.db.MustBegin()
-	return r.insertWithTx(tx, entry)
+	return r.InsertContext(context.Background(), entry)
 }
 
-func (r *Repository) insertWithTx(tx *sqlx.Tx, entry *AddEntry) (int64, error) {
-	var err error
+// InsertContext inserts the entry. When the context is canceled, e.g. the client abandons the request,
+// the transaction is rolled back and it returns operations error.
+func (r *Repository) InsertContext(ctx context.Context, entry *AddEntry) (int64, error) {
 	var newID int64
+	err := r.withRetryContext(ctx, "insert", func(tx *sqlx.Tx) error {
+		var err error
+		newID, err = r.insertWithTx(ctx, tx, entry)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newID, nil
+}
 
+func (r *Repository) insertWithTx(ctx context.Context, tx *sqlx.Tx, entry *AddEntry) (int64, error) {
+	var newID, rev int64
+	var err error
 	if entry.dn.IsRoot() {
-		newID, err = r.insertRootEntry(tx, entry)
+		newID, rev, err = r.insertRootEntry(ctx, tx, entry)
 	} else {
-		newID, _, err = r.insertEntryAndTree(tx, entry)
+		newID, rev, err = r.insertEntryAndTree(ctx, tx, entry)
 	}
 	if err != nil {
-		rollback(tx)
 		return 0, err
 	}
+	return newID, r.publishAdd(tx, newID, rev, entry)
+}
 
-	err = tx.Commit()
-	if err != nil {
-		rollback(tx)
-		return 0, NewUnavailable()
-	}
-	return newID, nil
+// publishAdd publishes the new entry. The rev is 1 for the new entry,
+// it's incremented from the tombstone for the revived entry.
+func (r *Repository) publishAdd(tx *sqlx.Tx, id, rev int64, entry *AddEntry) error {
+	return r.publishChange(tx, &ChangeEvent{
+		EntryID: id,
+		DN:      entry.DN().DNOrigStr(),
+		Type:    ChangeTypeAdd,
+		Rev:     rev,
+	})
 }
 
-func (r *Repository) insertEntryAndTree(tx *sqlx.Tx, entry *AddEntry) (int64, int64, error) {
+// insertEntryAndTree inserts the entry and the tree entry of the parent, then returns the new ID and the rev.
+func (r *Repository) insertEntryAndTree(ctx context.Context, tx *sqlx.Tx, entry *AddEntry) (int64, int64, error) {
 	if entry.DN().IsRoot() {
 		return 0, 0, xerrors.Errorf("Invalid entry, it should not be root DN. DN: %v", entry.dn)
 	}
 
-	newID, parentId, err := r.insertEntry(tx, entry)
+	newID, rev, parent, err := r.insertEntry(ctx, tx, entry)
 	if err != nil {
 		return 0, 0, err
 	}
 
 	// Now, the parent entry has a child
 	// Insert tree entry for the parent
-	err = r.insertTree(tx, parentId, entry.ParentDN().IsRoot())
+	err = r.insertTree(ctx, tx, parent.ID, parent.Path, entry.ParentDN().IsRoot())
 	if err != nil {
 		return 0, 0, err
 	}
 
-	return newID, parentId, nil
+	return newID, rev, nil
 }
 
-func (r *Repository) insertEntry(tx *sqlx.Tx, entry *AddEntry) (int64, int64, error) {
+// insertEntry inserts the entry and returns the new ID, the rev and the parent.
+// The path of the parent is resolved only when the DN cache is enabled.
+func (r *Repository) insertEntry(ctx context.Context, tx *sqlx.Tx, entry *AddEntry) (int64, int64, *FetchedDN, error) {
 	if entry.DN().IsRoot() {
-		return 0, 0, xerrors.Errorf("Invalid entry, it should not be root DN. DN: %v", entry.dn)
+		return 0, 0, nil, xerrors.Errorf("Invalid entry, it should not be root DN. DN: %v", entry.dn)
 	}
 
 	dbEntry, err := mapper.AddEntryToDBEntry(tx, entry)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, nil, err
 	}
 
-	params := createFindTreePathByDNParams(entry.ParentDN())
-	params["rdn_norm"] = entry.RDNNorm()
-	params["rdn_orig"] = entry.RDNOrig()
-	params["attrs_norm"] = dbEntry.AttrsNorm
-	params["attrs_orig"] = dbEntry.AttrsOrig
+	var q string
+	var params map[string]interface{}
+	var parent *FetchedDN
 
-	// When inserting new entry, we need to lock the parent DN entry while the processing
-	// because there is a chance other thread deletes the parent DN entry before the inserting if no lock.
-	findParentDNByDN, err := createFindBasePathByDNSQL(entry.ParentDN(), &FindOption{Lock: true})
-	if err != nil {
-		return 0, 0, xerrors.Errorf("Failed to create findTreePathByDN sql, err: %w", err)
-	}
+	if r.dnCache != nil {
+		// Resolve the parent using the cache, the parent is locked in it.
+		parent, err = r.lockParentDN(ctx, tx, entry.ParentDN())
+		if err != nil {
+			return 0, 0, nil, err
+		}
 
-	q := fmt.Sprintf(`
-		INSERT INTO ldap_entry (parent_id, rdn_norm, rdn_orig, attrs_norm, attrs_orig)
-		SELECT p.id AS parent_id, :rdn_norm, :rdn_orig, :attrs_norm, :attrs_orig
+		params = map[string]interface{}{
+			"parent_id": parent.ID,
+		}
+
+		q = insertEntryByParentIDSQL
+	} else {
+		params = createFindTreePathByDNParams(entry.ParentDN())
+
+		// When inserting new entry, we need to lock the parent DN entry while the processing
+		// because there is a chance other thread deletes the parent DN entry before the inserting if no lock.
+		// The lock keeps it correct under all isolation levels when the parent is deleted concurrently:
+		//   - READ COMMITTED: FOR UPDATE waits for the deleting transaction, then the deleted parent isn't
+		//     returned and it returns noSuchObject. Without the lock, the orphan entry can be inserted.
+		//   - REPEATABLE READ: FOR UPDATE fails by serialization failure if the parent was deleted or updated after
+		//     the snapshot, and the whole transaction is retried. The retry returns noSuchObject.
+		//   - SERIALIZABLE: Same as REPEATABLE READ. In addition, the read-write dependencies without the lock,
+		//     e.g. checking the sibling by NOT EXISTS, are detected and retried as serialization failure too.
+		findParentDNByDN, err := createFindBasePathByDNSQL(entry.ParentDN(), &FindOption{Lock: true})
+		if err != nil {
+			return 0, 0, nil, xerrors.Errorf("Failed to create findTreePathByDN sql, err: %w", err)
+		}
+
+		q = fmt.Sprintf(`
+		INSERT INTO ldap_entry (parent_id, rdn_norm, rdn_orig, attrs_norm, attrs_orig, created_at, creator, modified_at, modifier)
+		SELECT p.id AS parent_id, :rdn_norm, :rdn_orig, :attrs_norm, :attrs_orig, :created_at, :creator, :modified_at, :modifier
 			FROM (%s) p
 			WHERE NOT EXISTS (
-				SELECT id FROM ldap_entry WHERE parent_id = p.id AND rdn_norm = :rdn_norm
+				SELECT id FROM ldap_entry WHERE parent_id = p.id AND rdn_norm = :rdn_norm AND deleted_at IS NULL
 			)
-		RETURNING id, parent_id`, findParentDNByDN)
+		%s
+		RETURNING id, parent_id, rev`, findParentDNByDN, reviveTombstoneOnConflictSQL)
+	}
+
+	params["rdn_norm"] = entry.RDNNorm()
+	params["rdn_orig"] = entry.RDNOrig()
+	params["attrs_norm"] = dbEntry.AttrsNorm
+	params["attrs_orig"] = dbEntry.AttrsOrig
+	dbEntry.setOperationalParams(params)
 
-	log.Printf("insert entry query:\n%s\nparams:\n%v", q, params)
+	r.logQuery("Insert entry", q, params)
 
-	stmt, err := tx.PrepareNamed(q)
+	stmt, release, err := r.stmtCache.PrepareNamedContext(ctx, tx, q)
 	if err != nil {
-		return 0, 0, xerrors.Errorf("Failed to prepare insert query. query: %s, err: %w", q, err)
+		return 0, 0, nil, xerrors.Errorf("Failed to prepare insert query. query: %s, err: %w", q, err)
 	}
+	defer release()
 
-	rows, err := tx.NamedStmt(stmt).Queryx(params)
+	rows, err := stmt.QueryxContext(ctx, params)
 	if err != nil {
-		return 0, 0, xerrors.Errorf("Failed to insert entry record. entry: %v, err: %w", entry, err)
+		return 0, 0, nil, xerrors.Errorf("Failed to insert entry record. entry: %v, err: %w", entry, err)
 	}
 	defer rows.Close()
 
 	var id int64
 	var parentId int64
+	var rev int64
 	if rows.Next() {
-		err := rows.Scan(&id, &parentId)
+		err := rows.Scan(&id, &parentId, &rev)
 		if err != nil {
-			return 0, 0, xerrors.Errorf("Failed to scan. entry: %v, err: %w", entry, err)
+			return 0, 0, nil, xerrors.Errorf("Failed to scan. entry: %v, err: %w", entry, err)
 		}
 	} else {
 		log.Printf("debug: The new entry already exists. parentId: %d, rdn_norm: %s", parentId, entry.RDNNorm())
-		return 0, 0, NewAlreadyExists()
+		return 0, 0, nil, NewAlreadyExists()
+	}
+
+	if rev > 1 {
+		log.Printf("info: Revived the tombstone. id: %d, dn: %s", id, entry.DN().DNNormStr())
+	}
+
+	if parent == nil {
+		parent = &FetchedDN{
+			ID: parentId,
+		}
+	}
+
+	return id, rev, parent, nil
+}
+
+// lockParentDN returns the parent entry with lock. It uses the DN cache to avoid resolving the parent
+// by DN in DB. Since the cached parent might be stale, it locks all entries of the cached path
+// with checking their parent_id and rdn_norm. If some of them don't match, which means the ancestor
+// was deleted or renamed/moved by other transaction, it falls back to resolve the parent by DN.
+func (r *Repository) lockParentDN(ctx context.Context, tx *sqlx.Tx, parentDN *DN) (*FetchedDN, error) {
+	if cached, ok := r.dnCache.Get(parentDN); ok {
+		locked, err := r.lockDNByPath(ctx, tx, parentDN, cached.Path)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return cached, nil
+		}
+
+		log.Printf("debug: Detected stale DN cache. dn_norm: %s, path: %s", parentDN.DNNormStr(), cached.Path)
+		r.dnCache.RemoveSubtree(parentDN)
 	}
 
-	return id, parentId, nil
+	fetchedDN, err := r.FindDNByDNWithLockContext(ctx, tx, parentDN, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// It's safe to put since the entries of the path are locked until the end of this transaction.
+	// Deleting or renaming/moving operation for them removes the cache after acquiring the lock.
+	r.dnCache.Put(parentDN, fetchedDN)
+
+	return fetchedDN, nil
 }
 
-func (r *Repository) insertTree(tx *sqlx.Tx, id int64, isRoot bool) error {
+func (r *Repository) lockDNByPath(ctx context.Context, tx *sqlx.Tx, dn *DN, path string) (bool, error) {
+	ids := strings.Split(path, ".")
+	if len(ids) != len(dn.RDNs) {
+		return false, nil
+	}
+
+	key := fmt.Sprintf("LockDNByPath/DEPTH:%d", len(ids))
+
+	stmt, release, err := r.stmtCache.Prepare(ctx, tx, key, func() (string, error) {
+		where := make([]string, len(ids))
+		for i := range ids {
+			if i == 0 {
+				where[i] = "(id = :id0 AND parent_id IS NULL AND rdn_norm = :rdn_norm0 AND deleted_at IS NULL)"
+			} else {
+				where[i] = fmt.Sprintf("(id = :id%d AND parent_id = :id%d AND rdn_norm = :rdn_norm%d AND deleted_at IS NULL)", i, i-1, i)
+			}
+		}
+
+		q := `
+		SELECT count(*) FROM (
+			SELECT id FROM ldap_entry
+			WHERE
+			` + strings.Join(where, " OR\n\t\t\t") + `
+			FOR UPDATE
+		) l`
+		return q, nil
+	})
+	if err != nil {
+		return false, xerrors.Errorf("Failed to prepare lock DN by path query. key: %s, err: %w", key, err)
+	}
+	defer release()
+
+	params := createFindTreePathByDNParams(dn)
+	for i, v := range ids {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return false, xerrors.Errorf("Invalid path: %s, err: %w", path, err)
+		}
+		params["id"+strconv.Itoa(i)] = id
+	}
+
+	var count int
+	err = stmt.GetContext(ctx, &count, params)
+	if err != nil {
+		return false, xerrors.Errorf("Failed to lock DN by path. dn_norm: %s, path: %s, err: %w", dn.DNNormStr(), path, err)
+	}
+
+	return count == len(ids), nil
+}
+
+// insertTree registers the entry as a container.
+// If path is not empty, it's used as the path of the container instead of resolving it from the parent container.
+func (r *Repository) insertTree(ctx context.Context, tx *sqlx.Tx, id int64, path string, isRoot bool) error {
 	var q string
-	if isRoot {
+	if path != "" {
+		q = insertTreeByPathSQL
+	} else if isRoot {
 		q = `
 			INSERT INTO ldap_tree (id, path)
 			SELECT :id, :id as path
@@ -146,28 +323,32 @@ func (r *Repository) insertTree(tx *sqlx.Tx, id int64, isRoot bool) error {
 	}
 	params := map[string]interface{}{}
 	params["id"] = id
+	if path != "" {
+		params["path"] = path
+	}
 
-	log.Printf("insert tree query:\n%s\nparams:\n%v", q, params)
+	r.logQuery("Insert tree entry", q, params)
 
-	stmt, err := tx.PrepareNamed(q)
+	stmt, release, err := r.stmtCache.PrepareNamedContext(ctx, tx, q)
 	if err != nil {
 		return xerrors.Errorf("Failed to prepare insert tree entry query. query: %s, params: %v, err: %w", q, params, err)
 	}
+	defer release()
 
-	rows, err := tx.NamedStmt(stmt).Queryx(params)
+	rows, err := stmt.QueryxContext(ctx, params)
 	if err != nil {
 		return xerrors.Errorf("Failed to insert tree entry record. query: %s, params: %v, err: %w", q, params, err)
 	}
 	defer rows.Close()
 
 	var newTreeID int64
-	var path string
+	var newPath string
 	if rows.Next() {
-		err := rows.Scan(&newTreeID, &path)
+		err := rows.Scan(&newTreeID, &newPath)
 		if err != nil {
 			return xerrors.Errorf("Failed to scan. id: %d, err: %w", id, err)
 		}
-		log.Printf("debug: Inserted new tree entry. id: %d, path: %s", newTreeID, path)
+		log.Printf("debug: Inserted new tree entry. id: %d, path: %s", newTreeID, newPath)
 	} else {
 		log.Printf("debug: The tree entry already exists. id: %d", id)
 	}
@@ -175,14 +356,15 @@ func (r *Repository) insertTree(tx *sqlx.Tx, id int64, isRoot bool) error {
 	return nil
 }
 
-func (r *Repository) insertRootEntry(tx *sqlx.Tx, entry *AddEntry) (int64, error) {
+// insertRootEntry inserts the root entry and returns the new ID and the rev.
+func (r *Repository) insertRootEntry(ctx context.Context, tx *sqlx.Tx, entry *AddEntry) (int64, int64, error) {
 	if !entry.DN().IsRoot() {
-		return 0, xerrors.Errorf("Invalid entry, it should be root DN. DN: %v", entry.dn)
+		return 0, 0, xerrors.Errorf("Invalid entry, it should be root DN. DN: %v", entry.dn)
 	}
 
 	dbEntry, err := mapper.AddEntryToDBEntry(tx, entry)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	params := map[string]interface{}{}
@@ -190,38 +372,58 @@ func (r *Repository) insertRootEntry(tx *sqlx.Tx, entry *AddEntry) (int64, error
 	params["rdn_orig"] = entry.RDNOrig()
 	params["attrs_norm"] = dbEntry.AttrsNorm
 	params["attrs_orig"] = dbEntry.AttrsOrig
+	dbEntry.setOperationalParams(params)
 
+	// ON CONFLICT can't be used with the partial unique index of the root entries, revive the tombstone explicitly.
+	// Both of them see the same snapshot, so the tombstone blocks inserting new one.
+	// The concurrent insert of the same RDN is rejected by the unique index.
 	q := `
-		INSERT INTO ldap_entry (parent_id, rdn_norm, rdn_orig, attrs_norm, attrs_orig)
-		SELECT NULL as parent_id, :rdn_norm, :rdn_orig, :attrs_norm, :attrs_orig
-		WHERE NOT EXISTS (
-			SELECT id FROM ldap_entry WHERE parent_id IS NULL AND rdn_norm = :rdn_norm
+		WITH revived AS (
+			UPDATE ldap_entry SET
+				rdn_orig = :rdn_orig, attrs_norm = :attrs_norm, attrs_orig = :attrs_orig,
+				created_at = :created_at, creator = :creator, modified_at = :modified_at, modifier = :modifier,
+				pwd_history = '[]', deleted_at = NULL, rev = rev + 1
+			WHERE parent_id IS NULL AND rdn_norm = :rdn_norm AND deleted_at IS NOT NULL
+			RETURNING id, rev
+		), inserted AS (
+			INSERT INTO ldap_entry (parent_id, rdn_norm, rdn_orig, attrs_norm, attrs_orig, created_at, creator, modified_at, modifier)
+			SELECT NULL as parent_id, :rdn_norm, :rdn_orig, :attrs_norm, :attrs_orig, :created_at, :creator, :modified_at, :modifier
+			WHERE NOT EXISTS (
+				SELECT id FROM ldap_entry WHERE parent_id IS NULL AND rdn_norm = :rdn_norm
+			)
+			RETURNING id, rev
 		)
-		RETURNING id`
+		SELECT id, rev FROM revived
+		UNION ALL
+		SELECT id, rev FROM inserted`
 
-	log.Printf("insert root entry query:\n%s\nparams:\n%v", q, params)
+	r.logQuery("Insert root entry", q, params)
 
-	stmt, err := tx.PrepareNamed(q)
+	stmt, release, err := r.stmtCache.PrepareNamedContext(ctx, tx, q)
 	if err != nil {
-		return 0, xerrors.Errorf("Failed to prepare insert root query. query: %s, err: %w", q, err)
+		return 0, 0, xerrors.Errorf("Failed to prepare insert root query. query: %s, err: %w", q, err)
 	}
+	defer release()
 
-	rows, err := tx.NamedStmt(stmt).Queryx(params)
+	rows, err := stmt.QueryxContext(ctx, params)
 	if err != nil {
-		return 0, xerrors.Errorf("Failed to insert root entry record. entry: %v, err: %w", entry, err)
+		return 0, 0, NewDBError(xerrors.Errorf("Failed to insert root entry record. entry: %v, err: %w", entry, err))
 	}
 	defer rows.Close()
 
 	var id int64
+	var rev int64
 	if rows.Next() {
-		err := rows.Scan(&id)
+		err := rows.Scan(&id, &rev)
 		if err != nil {
-			return 0, xerrors.Errorf("Failed to scan result of the new root entry. entry: %v, err: %w", entry, err)
+			return 0, 0, xerrors.Errorf("Failed to scan result of the new root entry. entry: %v, err: %w", entry, err)
 		}
+	} else if err := rows.Err(); err != nil {
+		return 0, 0, NewDBError(xerrors.Errorf("Failed to insert root entry record. entry: %v, err: %w", entry, err))
 	} else {
 		log.Printf("debug: The root entry already exists. rdn_norm: %s", entry.RDNNorm())
-		return 0, NewAlreadyExists()
+		return 0, 0, NewAlreadyExists()
 	}
 
-	return id, nil
+	return id, rev, nil
 }
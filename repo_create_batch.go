@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+)
+
+type BatchOption struct {
+	// ContinueOnError continues the batch even if some entries fail.
+	// Only the failed entries are rolled back, the others are committed.
+	ContinueOnError bool
+}
+
+// BatchError holds the errors of the batch in input order. nil means the entry was inserted.
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	count := 0
+	for _, err := range e.Errors {
+		if err != nil {
+			count++
+		}
+	}
+	return fmt.Sprintf("BatchError: %d of %d entries failed", count, len(e.Errors))
+}
+
+// InsertBatch inserts the entries within a single transaction and returns the new IDs in input order.
+// The entries are inserted in order of the depth of the DN, so the parents are always inserted before the children.
+// If some entry fails, the whole batch is rolled back unless ContinueOnError is set.
+// When ContinueOnError is set, it returns *BatchError which holds the error of each entry.
+func (r *Repository) InsertBatch(entries []*AddEntry, opt *BatchOption) ([]int64, error) {
+	if opt == nil {
+		opt = &BatchOption{}
+	}
+
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(entries[order[i]].DN().RDNs) < len(entries[order[j]].DN().RDNs)
+	})
+
+	var ids []int64
+	var errs []error
+	var failed bool
+
+	ctx := context.Background()
+
+	err := r.withRetryContext(ctx, "insert batch", func(tx *sqlx.Tx) error {
+		// Reset the results since the transaction may be retried from scratch
+		ids = make([]int64, len(entries))
+		errs = make([]error, len(entries))
+		failed = false
+
+		b, err := r.newInsertBatch(ctx, tx)
+		if err != nil {
+			return err
+		}
+		defer b.close()
+
+		for _, i := range order {
+			entry := entries[i]
+
+			if opt.ContinueOnError {
+				_, err := tx.Exec("SAVEPOINT insert_batch")
+				if err != nil {
+					return xerrors.Errorf("Failed to create savepoint. err: %w", err)
+				}
+			}
+
+			id, err := b.insert(entry)
+			if err != nil {
+				if !opt.ContinueOnError || isRetryable(err) {
+					return err
+				}
+
+				log.Printf("info: Failed to insert entry in the batch, continue. dn_norm: %s, err: %v", entry.DN().DNNormStr(), err)
+
+				_, rerr := tx.Exec("ROLLBACK TO SAVEPOINT insert_batch")
+				if rerr != nil {
+					return xerrors.Errorf("Failed to rollback to savepoint. err: %w", rerr)
+				}
+				errs[i] = err
+				failed = true
+				continue
+			}
+
+			if opt.ContinueOnError {
+				_, err := tx.Exec("RELEASE SAVEPOINT insert_batch")
+				if err != nil {
+					return xerrors.Errorf("Failed to release savepoint. err: %w", err)
+				}
+			}
+
+			ids[i] = id
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if failed {
+		return ids, &BatchError{Errors: errs}
+	}
+	return ids, nil
+}
+
+type insertBatch struct {
+	ctx        context.Context
+	r          *Repository
+	tx         *sqlx.Tx
+	entryStmt  *sqlx.NamedStmt
+	treeStmt   *sqlx.NamedStmt
+	releases   []func()
+	inserted   map[string]*FetchedDN // dn_norm => inserted entry in this batch
+	containers map[int64]struct{}    // id of the entry which is registered as container in this batch
+}
+
+func (r *Repository) newInsertBatch(ctx context.Context, tx *sqlx.Tx) (*insertBatch, error) {
+	// Bind the stmts to the transaction once, reuse them for all entries of the batch
+	entryStmt, releaseEntry, err := r.stmtCache.PrepareNamedContext(ctx, tx, insertEntryByParentIDSQL)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to prepare insert query. query: %s, err: %w", insertEntryByParentIDSQL, err)
+	}
+	treeStmt, releaseTree, err := r.stmtCache.PrepareNamedContext(ctx, tx, insertTreeByPathSQL)
+	if err != nil {
+		releaseEntry()
+		return nil, xerrors.Errorf("Failed to prepare insert tree entry query. query: %s, err: %w", insertTreeByPathSQL, err)
+	}
+
+	return &insertBatch{
+		ctx:        ctx,
+		r:          r,
+		tx:         tx,
+		entryStmt:  entryStmt,
+		treeStmt:   treeStmt,
+		releases:   []func(){releaseEntry, releaseTree},
+		inserted:   map[string]*FetchedDN{},
+		containers: map[int64]struct{}{},
+	}, nil
+}
+
+// close releases the cached stmts. The stmts bound to the transaction are closed on commit or rollback.
+func (b *insertBatch) close() {
+	for _, release := range b.releases {
+		release()
+	}
+}
+
+func (b *insertBatch) insert(entry *AddEntry) (int64, error) {
+	if entry.DN().IsRoot() {
+		id, rev, err := b.r.insertRootEntry(b.ctx, b.tx, entry)
+		if err != nil {
+			return 0, err
+		}
+		if err := b.r.publishAdd(b.tx, id, rev, entry); err != nil {
+			return 0, err
+		}
+		b.inserted[entry.DN().DNNormStr()] = &FetchedDN{
+			ID:   id,
+			Path: strconv.FormatInt(id, 10),
+		}
+		return id, nil
+	}
+
+	parentDN := entry.ParentDN()
+
+	parent, ok := b.inserted[parentDN.DNNormStr()]
+	if !ok {
+		var err error
+		parent, err = b.r.lockParentDN(b.ctx, b.tx, parentDN)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	dbEntry, err := mapper.AddEntryToDBEntry(b.tx, entry)
+	if err != nil {
+		return 0, err
+	}
+
+	params := map[string]interface{}{
+		"parent_id":  parent.ID,
+		"rdn_norm":   entry.RDNNorm(),
+		"rdn_orig":   entry.RDNOrig(),
+		"attrs_norm": dbEntry.AttrsNorm,
+		"attrs_orig": dbEntry.AttrsOrig,
+	}
+	dbEntry.setOperationalParams(params)
+
+	var id int64
+	var parentID int64
+	var rev int64
+	err = b.entryStmt.QueryRowxContext(b.ctx, params).Scan(&id, &parentID, &rev)
+	if err != nil {
+		if isNoResult(err) {
+			log.Printf("debug: The new entry already exists. parentId: %d, rdn_norm: %s", parent.ID, entry.RDNNorm())
+			return 0, NewAlreadyExists()
+		}
+		return 0, xerrors.Errorf("Failed to insert entry record. entry: %v, err: %w", entry, err)
+	}
+
+	// Insert tree entry for the parent only once per batch
+	if _, ok := b.containers[parent.ID]; !ok {
+		var treeID int64
+		var path string
+		err = b.treeStmt.QueryRowxContext(b.ctx, map[string]interface{}{
+			"id":   parent.ID,
+			"path": parent.Path,
+		}).Scan(&treeID, &path)
+		if err != nil && !isNoResult(err) {
+			return 0, xerrors.Errorf("Failed to insert tree entry record. id: %d, path: %s, err: %w", parent.ID, parent.Path, err)
+		}
+		b.containers[parent.ID] = struct{}{}
+	}
+
+	if err := b.r.publishAdd(b.tx, id, rev, entry); err != nil {
+		return 0, err
+	}
+
+	b.inserted[entry.DN().DNNormStr()] = &FetchedDN{
+		ID:       id,
+		ParentID: parentID,
+		Path:     parent.Path + "." + strconv.FormatInt(id, 10),
+	}
+
+	return id, nil
+}
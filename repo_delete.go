@@ -5,60 +5,297 @@ import (
 	"strconv"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"golang.org/x/xerrors"
 )
 
 func (r Repository) DeleteByDN(dn *DN) error {
-	tx := r.db.MustBegin()
+	return r.withRetry("delete", func(tx *sqlx.Tx) error {
+		return r.deleteByDN(tx, dn)
+	})
+}
 
+func (r *Repository) deleteByDN(tx *sqlx.Tx, dn *DN) error {
 	// First, fetch the target entry with lock
 	fetchedDN, err := r.FindDNByDNWithLock(tx, dn, true)
 	if err != nil {
-		rollback(tx)
 		return err
 	}
 
-	// Not allowed error if the entry has children yet
+	// Not allowed error if the entry has children yet.
+	// The tombstones can remain as children only in soft delete mode, they are purged with the entry later.
 	if fetchedDN.HasSub {
-		rollback(tx)
-		return NewNotAllowedOnNonLeaf()
+		hasLiveSub, err := r.hasLiveSub(tx, fetchedDN.ID)
+		if err != nil {
+			return err
+		}
+		if hasLiveSub || !r.server.config.SoftDelete {
+			return NewNotAllowedOnNonLeaf()
+		}
+	}
+
+	if err := r.checkReferences(tx, []int64{fetchedDN.ID}, []string{dn.DNNormStr()}); err != nil {
+		return err
 	}
 
+	// Remove the cache while holding the lock, other transaction can't cache it again until the end of this transaction
+	r.dnCache.Remove(dn)
+
 	// Delete entry
-	delID, err := r.deleteByID(tx, fetchedDN.ID)
+	var delID, rev int64
+	if r.server.config.SoftDelete {
+		delID, rev, err = r.softDeleteByID(tx, fetchedDN.ID)
+	} else {
+		delID, rev, err = r.deleteByID(tx, fetchedDN.ID)
+	}
 	if err != nil {
-		rollback(tx)
+		return err
+	}
+
+	if err := r.publishChange(tx, &ChangeEvent{
+		EntryID: delID,
+		DN:      dn.DNOrigStr(),
+		Type:    ChangeTypeDelete,
+		Rev:     rev,
+	}); err != nil {
 		return err
 	}
 
 	log.Printf("debug: deleteByID end")
 
-	// Delete tree entry if the parent doesn't have children
-	hasSub, err := r.hasSub(tx, fetchedDN.ParentID)
+	// Delete tree entry if the parent doesn't have children.
+	// The tombstone is still the child, the tree is kept until purging.
+	if !r.server.config.SoftDelete {
+		hasSub, err := r.hasSub(tx, fetchedDN.ParentID)
+		if err != nil {
+			return err
+		}
+		log.Printf("debug: hasSub end")
+		if !hasSub {
+			if err := r.deleteTreeByID(tx, fetchedDN.ParentID); err != nil {
+				return err
+			}
+			log.Printf("debug: deleteTreeByID end")
+		}
+	}
+	log.Printf("debug: removeReferences start")
+
+	// Remove the references if the others have association for the target entry
+	err = r.removeReferences(tx, delID, dn.DNNormStr())
 	if err != nil {
-		rollback(tx)
 		return err
 	}
-	log.Printf("debug: hasSub end")
-	if !hasSub {
-		if err := r.deleteTreeByID(tx, fetchedDN.ParentID); err != nil {
-			rollback(tx)
+	log.Printf("debug: removeReferences end")
+
+	return nil
+}
+
+// DeleteTree deletes the entry and all descendants of the entry in one transaction.
+func (r Repository) DeleteTree(dn *DN) error {
+	return r.withRetry("delete tree", func(tx *sqlx.Tx) error {
+		return r.deleteTree(tx, dn)
+	})
+}
+
+// findDescendantDNs returns dn_orig of the entries by id, whose parent is the container under the path, in one query.
+// The DN of the parent is built from the path like findContainerByPathStmt.
+func (r *Repository) findDescendantDNs(tx *sqlx.Tx, path string, ids []int64) (map[int64]string, error) {
+	var fetched []FetchedDNOrig
+	err := tx.Select(&fetched, tx.Rebind(`
+		SELECT e.id, e.rdn_orig || ',' || p.dn_orig AS dn_orig
+		FROM ldap_entry e
+		JOIN (
+			SELECT t.id, string_agg(pe.rdn_orig, ',' ORDER BY dn.ord DESC) AS dn_orig
+			FROM
+				ldap_tree t
+				JOIN regexp_split_to_table(t.path::text, '[.]') WITH ORDINALITY dn(id, ord) ON true
+				JOIN ldap_entry pe ON pe.id = dn.id::bigint
+			WHERE t.path <@ ?::ltree
+			GROUP BY t.id
+		) p ON p.id = e.parent_id
+		WHERE e.id = ANY(?)`), path, pq.Array(ids))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to fetch the DNs of the descendants. path: %s, err: %w", path, err)
+	}
+
+	dns := make(map[int64]string, len(ids))
+	for _, f := range fetched {
+		dns[f.ID] = f.DNOrig
+	}
+	return dns, nil
+}
+
+func (r *Repository) deleteTree(tx *sqlx.Tx, dn *DN) error {
+	// First, fetch the target entry with lock
+	fetchedDN, err := r.FindDNByDNWithLock(tx, dn, true)
+	if err != nil {
+		return err
+	}
+
+	// Leaf entry, same as normal delete
+	if !fetchedDN.HasSub {
+		return r.deleteByDN(tx, dn)
+	}
+
+	// Lock the target and all descendants. The descendants are the entries whose parent is
+	// the container under the target's path.
+	var ids []int64
+	err = tx.Select(&ids, tx.Rebind(`
+		SELECT id FROM ldap_entry
+		WHERE id = ? OR parent_id IN (
+			SELECT id FROM ldap_tree WHERE path <@ ?::ltree
+		)
+		ORDER BY id
+		FOR UPDATE`), fetchedDN.ID, fetchedDN.Path)
+	if err != nil {
+		return xerrors.Errorf("Failed to lock the subtree. dn_norm: %s, path: %s, err: %w", dn.DNNormStr(), fetchedDN.Path, err)
+	}
+
+	// Guard: the entries outside of the computed set must not be the children,
+	// it can happen if other transaction added a child before locking.
+	var outside int
+	err = tx.Get(&outside, tx.Rebind(`
+		SELECT count(*) FROM ldap_entry
+		WHERE parent_id = ANY(?) AND NOT (id = ANY(?))`), pq.Array(ids), pq.Array(ids))
+	if err != nil {
+		return xerrors.Errorf("Failed to check the children of the subtree. dn_norm: %s, err: %w", dn.DNNormStr(), err)
+	}
+	if outside > 0 {
+		// Reject without retrying, the client can delete the subtree again after the concurrent change
+		log.Printf("warn: Detected %d children outside of the subtree. dn_norm: %s", outside, dn.DNNormStr())
+		return NewUnwillingToPerform("the subtree was changed concurrently while deleting it")
+	}
+
+	// Resolve DNs of the descendants for the change events and the references before deleting
+	dns, err := r.findDescendantDNs(tx, fetchedDN.Path, ids)
+	if err != nil {
+		return err
+	}
+	dns[fetchedDN.ID] = dn.DNOrigStr()
+
+	dnNorms := make([]string, len(ids))
+	for i, id := range ids {
+		if id == fetchedDN.ID {
+			dnNorms[i] = dn.DNNormStr()
+			continue
+		}
+		dnOrig, ok := dns[id]
+		if !ok {
+			return xerrors.Errorf("Failed to resolve the DN of the descendant. id: %d", id)
+		}
+		n, err := NormalizeDN(dnOrig)
+		if err != nil {
+			return xerrors.Errorf("Failed to normalize the DN of the descendant. dn_orig: %s, err: %w", dnOrig, err)
+		}
+		dnNorms[i] = n.DNNormStr()
+	}
+
+	// The references from the subtree itself don't block the deletion
+	if err := r.checkReferences(tx, ids, dnNorms); err != nil {
+		return err
+	}
+
+	// Remove the cache while holding the lock
+	r.dnCache.RemoveSubtree(dn)
+
+	if r.server.config.SoftDelete {
+		return r.softDeleteTree(tx, dn, ids, dns, dnNorms)
+	}
+
+	var deleted []struct {
+		ID        int64 `db:"id"`
+		Rev       int64 `db:"rev"`
+		Tombstone bool  `db:"tombstone"`
+	}
+	err = tx.Select(&deleted, tx.Rebind(`DELETE FROM ldap_entry WHERE id = ANY(?)
+		RETURNING id, rev, deleted_at IS NOT NULL AS tombstone`), pq.Array(ids))
+	if err != nil {
+		return xerrors.Errorf("Failed to delete the subtree. dn_norm: %s, err: %w", dn.DNNormStr(), err)
+	}
+
+	for _, d := range deleted {
+		// The deletion of the tombstone was already published
+		if d.Tombstone {
+			continue
+		}
+		if err := r.publishChange(tx, &ChangeEvent{
+			EntryID: d.ID,
+			DN:      dns[d.ID],
+			Type:    ChangeTypeDelete,
+			Rev:     d.Rev,
+		}); err != nil {
 			return err
 		}
-		log.Printf("debug: deleteTreeByID end")
 	}
-	log.Printf("debug: removeAssociationById start")
 
-	// Remove member and uniqueMember if the others have association for the target entry
-	err = r.removeAssociationById(tx, delID)
+	// Delete tree entries of the target and the descendant containers
+	_, err = tx.Exec(tx.Rebind(`DELETE FROM ldap_tree WHERE path <@ ?::ltree`), fetchedDN.Path)
 	if err != nil {
-		rollback(tx)
-		return err
+		return xerrors.Errorf("Failed to delete tree nodes of the subtree. dn_norm: %s, path: %s, err: %w", dn.DNNormStr(), fetchedDN.Path, err)
+	}
+
+	log.Printf("debug: Deleted the subtree. dn_norm: %s, count: %d", dn.DNNormStr(), len(ids))
+
+	// Delete tree entry of the parent if the parent doesn't have children
+	if !fetchedDN.IsRoot() {
+		hasSub, err := r.hasSub(tx, fetchedDN.ParentID)
+		if err != nil {
+			return err
+		}
+		if !hasSub {
+			if err := r.deleteTreeByID(tx, fetchedDN.ParentID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Remove the references if the others have association for the deleted entries
+	for i, id := range ids {
+		if err := r.removeReferences(tx, id, dnNorms[i]); err != nil {
+			return err
+		}
 	}
-	log.Printf("debug: removeAssociationById end")
 
-	// Commit!
-	return commit(tx)
+	return nil
+}
+
+// softDeleteTree marks the locked subtree as the tombstones. The tree entries are kept until purging.
+func (r *Repository) softDeleteTree(tx *sqlx.Tx, dn *DN, ids []int64, dns map[int64]string, dnNorms []string) error {
+	var deleted []struct {
+		ID  int64 `db:"id"`
+		Rev int64 `db:"rev"`
+	}
+	err := tx.Select(&deleted, tx.Rebind(`UPDATE ldap_entry SET deleted_at = now(), rev = rev + 1
+		WHERE id = ANY(?) AND deleted_at IS NULL
+		RETURNING id, rev`), pq.Array(ids))
+	if err != nil {
+		return xerrors.Errorf("Failed to soft delete the subtree. dn_norm: %s, err: %w", dn.DNNormStr(), err)
+	}
+
+	log.Printf("debug: Soft deleted the subtree. dn_norm: %s, count: %d", dn.DNNormStr(), len(deleted))
+
+	norms := make(map[int64]string, len(ids))
+	for i, id := range ids {
+		norms[id] = dnNorms[i]
+	}
+
+	for _, d := range deleted {
+		if err := r.publishChange(tx, &ChangeEvent{
+			EntryID: d.ID,
+			DN:      dns[d.ID],
+			Type:    ChangeTypeDelete,
+			Rev:     d.Rev,
+		}); err != nil {
+			return err
+		}
+
+		// Remove the references if the others have association for the deleted entries
+		if err := r.removeReferences(tx, d.ID, norms[d.ID]); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (r *Repository) hasSub(tx *sqlx.Tx, id int64) (bool, error) {
@@ -73,27 +310,63 @@ func (r *Repository) hasSub(tx *sqlx.Tx, id int64) (bool, error) {
 	return hasSub, nil
 }
 
-func (r *Repository) deleteByID(tx *sqlx.Tx, id int64) (int64, error) {
-	var delID int64 = -1
+// hasLiveSub returns true if the entry has children except the tombstones.
+func (r *Repository) hasLiveSub(tx *sqlx.Tx, id int64) (bool, error) {
+	var hasSub bool
+	err := tx.NamedStmt(hasLiveSubStmt).Get(&hasSub, map[string]interface{}{
+		"id": id,
+	})
+	if err != nil {
+		return false, xerrors.Errorf("Failed to check existence of live children. id: %d, err: %w", id, err)
+	}
+
+	return hasSub, nil
+}
+
+// softDeleteByID marks the entry as the tombstone and returns the id and the new rev.
+func (r *Repository) softDeleteByID(tx *sqlx.Tx, id int64) (int64, int64, error) {
+	dest := struct {
+		ID  int64 `db:"id"`
+		Rev int64 `db:"rev"`
+	}{}
+
+	err := namedStmt(tx, softDeleteByIDStmt).Get(&dest, map[string]interface{}{
+		"id": id,
+	})
+	if err != nil {
+		if isNoResult(err) {
+			return 0, 0, NewNoSuchObject()
+		}
+		return 0, 0, NewDBError(xerrors.Errorf("Failed to soft delete entry. id: %d, err: %w", id, err))
+	}
+
+	return dest.ID, dest.Rev, nil
+}
+
+func (r *Repository) deleteByID(tx *sqlx.Tx, id int64) (int64, int64, error) {
+	dest := struct {
+		ID  int64 `db:"id"`
+		Rev int64 `db:"rev"`
+	}{ID: -1}
 
-	err := namedStmt(tx, deleteByIDStmt).Get(&delID, map[string]interface{}{
+	err := namedStmt(tx, deleteByIDStmt).Get(&dest, map[string]interface{}{
 		"id": id,
 	})
 
 	if err != nil {
 		if isNoResult(err) {
-			return 0, NewNoSuchObject()
+			return 0, 0, NewNoSuchObject()
 		}
-		return 0, xerrors.Errorf("Failed to exec deleteByID query. query: %s, params: %v, err: %w",
+		return 0, 0, xerrors.Errorf("Failed to exec deleteByID query. query: %s, params: %v, err: %w",
 			deleteByIDStmt.QueryString, deleteByIDStmt.Params, err)
 	}
 
 	// TODO need?
-	if delID == -1 {
-		return 0, NewNoSuchObject()
+	if dest.ID == -1 {
+		return 0, 0, NewNoSuchObject()
 	}
 
-	return delID, nil
+	return dest.ID, dest.Rev, nil
 }
 
 func (r *Repository) deleteTreeByID(tx *sqlx.Tx, id int64) error {
@@ -129,23 +402,23 @@ func (r *Repository) removeAssociationById(tx *sqlx.Tx, id int64) error {
 func (r *Repository) execRemoveAssociatio(tx *sqlx.Tx, id int64, stmt *sqlx.NamedStmt, attrName string) error {
 	idStr := strconv.FormatInt(id, 10)
 
-	var updatedID int64 = -1
-	err := tx.NamedStmt(stmt).Get(&updatedID, map[string]interface{}{
+	var updated []struct {
+		ID  int64 `db:"id"`
+		Rev int64 `db:"rev"`
+	}
+	err := tx.NamedStmt(stmt).Select(&updated, map[string]interface{}{
 		"cond_filter": `$ ? (@ != ` + idStr + `)`,
 		"cond_where":  `$.` + attrName + ` == ` + idStr + ``,
 	})
 	if err != nil {
-		if isNoResult(err) {
-			// Ignore
-			return nil
-		}
 		return xerrors.Errorf("Failed to delete association. query: %s, id: %d, err: %w", stmt.QueryString, id, err)
 	}
 
-	// TODO need?
-	if updatedID == -1 {
-		// Ignore
-		return nil
+	// The groups are modified implicitly
+	for _, u := range updated {
+		if err := r.publishModifyByID(tx, u.ID, u.Rev); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Healthy returns false while the DB can't be reached, then the operations return unavailable.
+// It can be used for a readiness probe.
+func (r *Repository) Healthy() bool {
+	return atomic.LoadInt32(&r.unhealthy) == 0
+}
+
+func (r *Repository) setHealthy(healthy bool) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&r.unhealthy, v) != v {
+		if healthy {
+			log.Printf("info: DB is healthy again")
+		} else {
+			log.Printf("alert: DB is unhealthy, return unavailable until it recovers")
+		}
+	}
+}
+
+// StartHealthCheck pings the DB pool on the interval in background.
+// When the ping fails, the repository is marked unhealthy and it's pinged with exponential backoff up to maxBackoff.
+// The pool opens new connections by itself, so the repository recovers when the ping succeeds.
+func (r *Repository) StartHealthCheck(interval, maxBackoff time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+	r.stopHealthCheck = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		delay := interval
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+
+			if err := r.ping(interval); err != nil {
+				log.Printf("warn: Failed to ping DB. retry after: %v, err: %v", delay, err)
+				r.setHealthy(false)
+
+				delay *= 2
+				if delay > maxBackoff {
+					delay = maxBackoff
+				}
+				continue
+			}
+
+			r.setHealthy(true)
+			delay = interval
+		}
+	}(r.stopHealthCheck)
+}
+
+// StopHealthCheck stops the background health check.
+func (r *Repository) StopHealthCheck() {
+	if r.stopHealthCheck != nil {
+		close(r.stopHealthCheck)
+		r.stopHealthCheck = nil
+	}
+}
+
+func (r *Repository) ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return r.db.PingContext(ctx)
+}
+
+// handleReadiness returns 200 if the repository is healthy, otherwise 503.
+func handleReadiness(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.Repo() == nil || !s.Repo().Healthy() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
@@ -0,0 +1,36 @@
+// +build !integration
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	repo := &Repository{}
+	s := &Server{repo: repo}
+
+	testcases := []struct {
+		Healthy      bool
+		ExpectedCode int
+	}{
+		{true, http.StatusOK},
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+	}
+
+	for i, tc := range testcases {
+		repo.setHealthy(tc.Healthy)
+		if repo.Healthy() != tc.Healthy {
+			t.Errorf("Unexpected health state on %d:\n%v expected, got %v", i, tc.Healthy, repo.Healthy())
+		}
+
+		w := httptest.NewRecorder()
+		handleReadiness(s)(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tc.ExpectedCode {
+			t.Errorf("Unexpected status code on %d:\n%d expected, got %d", i, tc.ExpectedCode, w.Code)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var indexableAttrPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*$`)
+
+// CreateIndexes creates the expression indexes on attrs_norm for the indexed attributes if missing.
+// The indexes are created concurrently not to lock ldap_entry on a live directory.
+// It takes long time on the large table, so the caller should run it in background.
+// The invalid index left by the failed concurrent build is dropped and created again.
+func (r *Repository) CreateIndexes(schemaMap SchemaMap) error {
+	// The schema map contains the aliases too
+	done := map[string]struct{}{}
+	for _, s := range schemaMap {
+		if _, ok := done[s.Name]; ok || !s.IsIndexed() {
+			continue
+		}
+		done[s.Name] = struct{}{}
+
+		if err := r.createIndex(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) createIndex(s *Schema) error {
+	if !indexableAttrPattern.MatchString(s.Name) {
+		return xerrors.Errorf("Invalid attribute name for index. name: %s", s.Name)
+	}
+	name := attrIndexName(s)
+
+	var valid bool
+	err := r.db.Get(&valid, `SELECT i.indisvalid FROM pg_index i WHERE i.indexrelid = to_regclass($1)`, name)
+	if err == nil && valid {
+		return nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return xerrors.Errorf("Failed to find index. name: %s, err: %w", name, err)
+	}
+
+	if err == nil {
+		log.Printf("warn: Drop invalid index to create again. name: %s", name)
+		_, err = r.db.Exec(fmt.Sprintf(`DROP INDEX CONCURRENTLY IF EXISTS %s`, name))
+		if err != nil {
+			return xerrors.Errorf("Failed to drop invalid index. name: %s, err: %w", name, err)
+		}
+	}
+
+	log.Printf("info: Creating index concurrently. name: %s, attr: %s", name, s.Name)
+
+	// CREATE INDEX CONCURRENTLY can't be executed inside a transaction block
+	_, err = r.db.Exec(createIndexSQL(s))
+	if err != nil {
+		return xerrors.Errorf("Failed to create index. name: %s, err: %w", name, err)
+	}
+
+	log.Printf("info: Created index. name: %s", name)
+
+	return nil
+}
+
+func attrIndexName(s *Schema) string {
+	return "idx_ldap_entry_attrs_" + strings.ReplaceAll(strings.ToLower(s.Name), "-", "_")
+}
+
+// createIndexSQL returns the DDL of the expression index.
+// The expression must be the same as the predicate of the query translator to be used by the planner.
+func createIndexSQL(s *Schema) string {
+	return fmt.Sprintf(`CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON ldap_entry USING gin ((attrs_norm->'%s') jsonb_path_ops)`,
+		attrIndexName(s), s.Name)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"golang.org/x/xerrors"
+)
+
+// applyPasswordPolicy enforces the password policy when the modification changes userPassword.
+// self means the user changes the own password, otherwise the password is reset by the other user.
+// It updates pwdChangedTime and pwdReset of newEntry, and records the previous passwords as the history.
+func (r *Repository) applyPasswordPolicy(tx *sqlx.Tx, oldEntry, newEntry *ModifyEntry, self bool) error {
+	passwords := newEntry.ChangedPasswords()
+	if len(passwords) == 0 {
+		return nil
+	}
+
+	c := r.server.config
+	now := time.Now()
+
+	if self && c.PasswordMinAge > 0 {
+		if changed, ok := pwdChangedTime(oldEntry); ok && now.Before(changed.Add(time.Duration(c.PasswordMinAge)*time.Second)) {
+			log.Printf("info: Password is too young to change. dn: %s, pwdChangedTime: %v", oldEntry.GetDNNorm(), changed)
+			return NewPasswordTooYoung()
+		}
+	}
+
+	if c.PasswordHistory > 0 {
+		history, err := r.findPwdHistory(tx, oldEntry.dbEntryID)
+		if err != nil {
+			return err
+		}
+
+		// The current passwords can't be reused too
+		current := oldEntry.GetAttrsOrig()["userPassword"]
+		history = append(append([]string{}, current...), history...)
+
+		for _, p := range passwords {
+			for _, h := range history {
+				if matchPassword(p, h) {
+					log.Printf("info: Password is in history. dn: %s", oldEntry.GetDNNorm())
+					return NewPasswordInHistory()
+				}
+			}
+		}
+
+		if len(history) > c.PasswordHistory {
+			history = history[:c.PasswordHistory]
+		}
+		if err := r.updatePwdHistory(tx, oldEntry.dbEntryID, history); err != nil {
+			return err
+		}
+	}
+
+	if err := newEntry.ReplaceNoCheck("pwdChangedTime", []string{now.In(time.UTC).Format(TIMESTAMP_FORMAT)}); err != nil {
+		return err
+	}
+
+	if c.PasswordMustChange && !self {
+		return newEntry.ReplaceNoCheck("pwdReset", []string{"TRUE"})
+	}
+	if newEntry.HasAttr("pwdReset") {
+		return newEntry.ReplaceNoCheck("pwdReset", []string{})
+	}
+	return nil
+}
+
+func pwdChangedTime(entry *ModifyEntry) (time.Time, bool) {
+	v, ok := entry.GetAttrsOrig()["pwdChangedTime"]
+	if !ok || len(v) == 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(TIMESTAMP_FORMAT, v[0])
+	if err != nil {
+		log.Printf("warn: Invalid pwdChangedTime. dn: %s, value: %s", entry.GetDNNorm(), v[0])
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// matchPassword returns true if the input is the same as the stored password.
+// The pass-through credential isn't matched since it isn't managed by ldap-pg.
+func matchPassword(input, stored string) bool {
+	if input == stored {
+		return true
+	}
+	if !isHashedPassword(stored) || isHashedPassword(input) {
+		return false
+	}
+	ok, err := verifyPassword(input, stored)
+	if err != nil && err != errUnsupportedPasswordScheme {
+		log.Printf("warn: Failed to verify password in history. err: %v", err)
+	}
+	return ok
+}
+
+func (r *Repository) findPwdHistory(tx *sqlx.Tx, id int64) ([]string, error) {
+	var dest types.JSONText
+	err := namedStmt(tx, findPwdHistoryByIdStmt).Get(&dest, map[string]interface{}{
+		"id": id,
+	})
+	if err != nil {
+		return nil, NewDBError(xerrors.Errorf("Failed to find password history. id: %d, err: %w", id, err))
+	}
+
+	var history []string
+	if err := dest.Unmarshal(&history); err != nil {
+		return nil, xerrors.Errorf("Failed to unmarshal password history. id: %d, err: %w", id, err)
+	}
+	return history, nil
+}
+
+func (r *Repository) updatePwdHistory(tx *sqlx.Tx, id int64, history []string) error {
+	b, _ := json.Marshal(history)
+
+	_, err := namedStmt(tx, updatePwdHistoryByIdStmt).Exec(map[string]interface{}{
+		"id":          id,
+		"pwd_history": types.JSONText(b),
+	})
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to update password history. id: %d, err: %w", id, err))
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
@@ -16,12 +18,16 @@ type FetchedDBEntry struct {
 	ParentID        int64          `db:"parent_id"`
 	RDNOrig         string         `db:"rdn_orig"`
 	RawAttrsOrig    types.JSONText `db:"attrs_orig"`
+	Rev             int64          `db:"rev"`
+	CreatedAt       time.Time      `db:"created_at"`
+	Creator         string         `db:"creator"`
+	ModifiedAt      time.Time      `db:"modified_at"`
+	Modifier        string         `db:"modifier"`
 	RawMember       types.JSONText `db:"member"`          // No real column in the table
 	RawUniqueMember types.JSONText `db:"uniquemember"`    // No real column in the table
 	RawMemberOf     types.JSONText `db:"member_of"`       // No real column in the table
 	HasSubordinates string         `db:"hassubordinates"` // No real column in the table
 	DNOrig          string         `db:"dn_orig"`         // No real clumn in t he table
-	Count           int32          `db:"count"`           // No real column in the table
 	ParentDNOrig    string         // No real column in the table
 }
 
@@ -130,8 +136,8 @@ func (e *FetchedDBEntry) Clear() {
 	e.ID = 0
 	e.DNOrig = ""
 	e.RawAttrsOrig = nil
+	e.Rev = 0
 	e.RawMemberOf = nil
-	e.Count = 0
 }
 
 type FetchedDNOrig struct {
@@ -139,31 +145,30 @@ type FetchedDNOrig struct {
 	DNOrig string `db:"dn_orig"`
 }
 
-func (r *Repository) Search(baseDN *DN, scope int, q *Query, reqMemberAttrs []string,
-	reqMemberOf, isHasSubordinatesRequested bool, handler func(entry *SearchEntry) error) (int32, int32, error) {
-
-	fetchedDN, err := r.FindDNByDNWithLock(nil, baseDN, false)
-	if err != nil {
-		log.Printf("debug: Failed to find DN by DN. err: %+v", err)
-		return 0, 0, err
-	}
-
-	// Cache
-	q.IdToDNOrigCache[fetchedDN.ID] = fetchedDN.DNOrig
+// Search fetches the entries in id order for keyset pagination.
+// Only the entries whose id is greater than the "lastID" param are fetched, up to the "pageSize" param.
+// If q.SortKeys is set, the entries are sorted by them and fetched from the "offset" param instead.
+// The condition is built by SearchWhere with the same q.
+// It returns the number of the fetched entries and whether there are more entries after them.
+// Use Count for the number of all matching entries.
+func (r *Repository) Search(where string, q *Query, reqMemberAttrs []string,
+	reqMemberOf, isHasSubordinatesRequested bool, handler func(entry *SearchEntry) error) (int32, bool, error) {
+
+	start := time.Now()
+	count, hasMore, err := r.search(where, q, reqMemberAttrs, reqMemberOf, isHasSubordinatesRequested, handler)
+	r.observe("search", start, err)
+	return count, hasMore, err
+}
 
-	where, err := r.AppenScopeFilter(scope, q, fetchedDN)
-	if err != nil {
-		return 0, 0, err
-	}
-
-	log.Printf("debug: where: %s", where)
+func (r *Repository) search(where string, q *Query, reqMemberAttrs []string,
+	reqMemberOf, isHasSubordinatesRequested bool, handler func(entry *SearchEntry) error) (int32, bool, error) {
 
 	var hasSubordinatesCol string
 	if isHasSubordinatesRequested {
 		hasSubordinatesCol = `,
 			CASE
 			WHEN EXISTS (
-				SELECT 1 FROM ldap_entry sle WHERE sle.parent_id = e.id
+				SELECT 1 FROM ldap_entry sle WHERE sle.parent_id = e.id AND sle.deleted_at IS NULL
 			) THEN 'TRUE' ELSE 'FALSE' END as hassubordinates`
 	}
 
@@ -211,6 +216,7 @@ func (r *Repository) Search(baseDN *DN, scope int, q *Query, reqMemberAttrs []st
 		`)
 		jb.WriteString(`
 			LEFT JOIN ldap_entry mo ON mo.attrs_norm @@ FORMAT('$.member[*] == %s || $.uniquemember[*] == %s', e.id, e.id)::::jsonpath
+				AND mo.deleted_at IS NULL
 		`)
 
 		memberOfCol = cb.String()
@@ -221,28 +227,137 @@ func (r *Repository) Search(baseDN *DN, scope int, q *Query, reqMemberAttrs []st
 		}
 	}
 
+	// Keyset pagination by id, or offset pagination for sorting (See the limitation of sortKeysToOrderBy).
+	// Fetch one more entry to know whether there are more entries.
+	pageSize, _ := q.Params["pageSize"].(int32)
+	q.Params["limit"] = int64(pageSize) + 1
+
+	paging := `AND e.id > :lastID
+		%s
+		ORDER BY e.id
+		LIMIT :limit`
+	if len(q.SortKeys) > 0 {
+		paging = `%s
+		ORDER BY ` + sortKeysToOrderBy(q.SortKeys, q.Params) + `
+		LIMIT :limit OFFSET :offset`
+	}
+
 	searchQuery := fmt.Sprintf(`
 		SELECT
 			e.id, e.parent_id, e.rdn_orig, '' AS dn_orig,
-			e.attrs_orig %s, count(e.id) over() AS count
+			e.attrs_orig, e.rev, e.created_at, e.creator, e.modified_at, e.modifier %s
 			%s
 			%s
 		FROM ldap_entry e 
 		%s
 		%s
-		WHERE %s
-		%s
-		LIMIT :pageSize OFFSET :offset
+		WHERE e.deleted_at IS NULL AND (%s) `+paging+`
 	`, hasSubordinatesCol, memberCol, memberOfCol, memberJoin, memberOfJoin, where, groupBy)
 
-	// Resolve pending params
+	log.Printf("Fetch Query: %s Params: %v", searchQuery, q.Params)
+
+	fetchStmt, release, err := r.stmtCache.PrepareNamedContext(context.Background(), nil, searchQuery)
+	if err != nil {
+		return 0, false, err
+	}
+	defer release()
+
+	var rows *sqlx.Rows
+	rows, err = fetchStmt.Queryx(q.Params)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	dbEntry := FetchedDBEntry{}
+	var count int32 = 0
+	var hasMore bool
+
+	for rows.Next() {
+		if count == pageSize {
+			hasMore = true
+			break
+		}
+
+		err := rows.StructScan(&dbEntry)
+		if err != nil {
+			log.Printf("error: DBEntry struct mapping error: %#v", err)
+			return 0, false, err
+		}
+
+		// Set dn_orig using cache from fetching before phase
+		var dnOrig string
+		var ok bool
+		if dnOrig, ok = q.IdToDNOrigCache[dbEntry.ID]; !ok {
+			parentDNOrig, ok := q.IdToDNOrigCache[dbEntry.ParentID]
+			if !ok {
+				log.Printf("error: Invalid state, failed to retrieve parent by parent_id: %d", dbEntry.ParentID)
+				return 0, false, xerrors.Errorf("Failed to retrieve parent by parent_id: %d", dbEntry.ParentID)
+			}
+
+			dnOrig = dbEntry.RDNOrig + "," + parentDNOrig
+		}
+		dbEntry.DNOrig = dnOrig
+
+		readEntry, err := mapper.FetchedDBEntryToSearchEntry(&dbEntry, q.IdToDNOrigCache)
+		if err != nil {
+			log.Printf("error: Mapper error: %#v", err)
+			return 0, false, err
+		}
+
+		err = handler(readEntry)
+		if err != nil {
+			log.Printf("error: Handler error: %#v", err)
+			return 0, false, err
+		}
+
+		count++
+		dbEntry.Clear()
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Printf("error: Search error: %#v", err)
+		return 0, false, err
+	}
+
+	return count, hasMore, nil
+}
+
+// SearchWhere returns the WHERE condition of the search for the scope and the filter.
+// The params of the condition are set to q. Build it once per request and pass it to Count and Search.
+func (r *Repository) SearchWhere(baseDN *DN, scope int, q *Query) (string, error) {
+	fetchedDN, err := r.FindDNByDNWithLock(nil, baseDN, false)
+	if err != nil {
+		log.Printf("debug: Failed to find DN by DN. err: %+v", err)
+		return "", err
+	}
+
+	// Cache
+	q.IdToDNOrigCache[fetchedDN.ID] = fetchedDN.DNOrig
+
+	where, err := r.AppenScopeFilter(scope, q, fetchedDN)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("debug: where: %s", where)
+
+	if err := r.resolvePendingParams(q); err != nil {
+		return "", err
+	}
+	return where, nil
+}
+
+// resolvePendingParams replaces the pending params of the DN in the filter with the id of the entry.
+func (r *Repository) resolvePendingParams(q *Query) error {
 	if len(q.PendingParams) > 0 {
 		// Create contaner DN cache
 		for k, v := range q.IdToDNOrigCache {
 			dn, err := NormalizeDN(v)
 			if err != nil {
 				log.Printf("error: Failed to normalize DN fetched from DB, err: %s", err)
-				return 0, 0, NewUnavailable()
+				return NewUnavailable()
 			}
 			q.DNNormToIdCache[dn.DNNormStr()] = k
 		}
@@ -298,114 +413,40 @@ func (r *Repository) Search(baseDN *DN, scope int, q *Query, reqMemberAttrs []st
 			}
 		}
 	}
-
-	log.Printf("Fetch Query: %s Params: %v", searchQuery, q.Params)
-
-	var fetchStmt *sqlx.NamedStmt
-	var ok bool
-	if fetchStmt, ok = filterStmtMap.Get(searchQuery); !ok {
-		// cache
-		fetchStmt, err = r.db.PrepareNamed(searchQuery)
-		if err != nil {
-			return 0, 0, err
-		}
-		filterStmtMap.Put(searchQuery, fetchStmt)
-	}
-
-	var rows *sqlx.Rows
-	rows, err = fetchStmt.Queryx(q.Params)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer rows.Close()
-
-	dbEntry := FetchedDBEntry{}
-	var maxCount int32 = 0
-	var count int32 = 0
-
-	for rows.Next() {
-		err := rows.StructScan(&dbEntry)
-		if err != nil {
-			log.Printf("error: DBEntry struct mapping error: %#v", err)
-			return 0, 0, err
-		}
-
-		// Set dn_orig using cache from fetching before phase
-		var dnOrig string
-		if dnOrig, ok = q.IdToDNOrigCache[dbEntry.ID]; !ok {
-			parentDNOrig, ok := q.IdToDNOrigCache[dbEntry.ParentID]
-			if !ok {
-				log.Printf("error: Invalid state, failed to retrieve parent by parent_id: %d", dbEntry.ParentID)
-				return 0, 0, xerrors.Errorf("Failed to retrieve parent by parent_id: %d", dbEntry.ParentID)
-			}
-
-			dnOrig = dbEntry.RDNOrig + "," + parentDNOrig
-		}
-		dbEntry.DNOrig = dnOrig
-
-		readEntry, err := mapper.FetchedDBEntryToSearchEntry(&dbEntry, q.IdToDNOrigCache)
-		if err != nil {
-			log.Printf("error: Mapper error: %#v", err)
-			return 0, 0, err
-		}
-
-		if maxCount == 0 {
-			maxCount = dbEntry.Count
-		}
-
-		err = handler(readEntry)
-		if err != nil {
-			log.Printf("error: Handler error: %#v", err)
-			return 0, 0, err
-		}
-
-		count++
-		dbEntry.Clear()
-	}
-
-	err = rows.Err()
-	if err != nil {
-		log.Printf("error: Search error: %#v", err)
-		return 0, 0, err
-	}
-
-	return maxCount, count, nil
+	return nil
 }
 
 type FindOption struct {
 	Lock       bool
+	LockShare  bool
 	FetchAttrs bool
 	FetchCred  bool
 }
 
-func (r *Repository) PrepareFindDNByDN(dn *DN, opt *FindOption) (*sqlx.NamedStmt, map[string]interface{}, error) {
+// PrepareFindDNByDN returns the cached stmt and the params for finding the DN.
+// The stmt is bound to tx if it isn't nil. The caller must call the release func after using the stmt.
+func (r *Repository) PrepareFindDNByDN(tx *sqlx.Tx, dn *DN, opt *FindOption) (*sqlx.NamedStmt, map[string]interface{}, func(), error) {
 	//  Key for stmt cache
-	key := fmt.Sprintf("PrepareFindDNByDN/LOCK:%v/FETCH_ATTRS:%v/FETCH_CRED:%v/DEPTH:%d",
-		opt.Lock, opt.FetchAttrs, opt.FetchCred, len(dn.RDNs))
+	key := fmt.Sprintf("PrepareFindDNByDN/LOCK:%v/LOCK_SHARE:%v/FETCH_ATTRS:%v/FETCH_CRED:%v/DEPTH:%d",
+		opt.Lock, opt.LockShare, opt.FetchAttrs, opt.FetchCred, len(dn.RDNs))
 
 	// make params
 	params := createFindTreePathByDNParams(dn)
 
-	if stmt, ok := treeStmtCache.Get(key); ok {
-		// Already cached
-		return stmt, params, nil
-	}
-
-	// Not cached yet, create query and params, then cache the stmt
-	q, err := createFindBasePathByDNSQL(dn, opt)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	log.Printf("debug: createFindTreePathByDNSQL: %s\nparams: %v", q, params)
-
-	stmt, err := r.db.PrepareNamed(q)
+	// The query is created only when it's not cached yet
+	stmt, release, err := r.stmtCache.Prepare(context.Background(), tx, key, func() (string, error) {
+		q, err := createFindBasePathByDNSQL(dn, opt)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("debug: createFindTreePathByDNSQL: %s\nparams: %v", q, params)
+		return q, nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
-	treeStmtCache.Put(key, stmt)
 
-	return stmt, params, nil
+	return stmt, params, release, nil
 }
 
 func createFindTreePathByDNParams(baseDN *DN) map[string]interface{} {
@@ -432,12 +473,20 @@ func createFindBasePathByDNSQL(baseDN *DN, opt *FindOption) (string, error) {
 
 	var fetchAttrsCols string
 	if opt.FetchAttrs {
-		fetchAttrsCols = `e0.attrs_orig,`
+		fetchAttrsCols = `e0.attrs_orig, e0.rev,`
 	}
 
 	var fetchCredCols string
 	if opt.FetchCred {
-		fetchCredCols = `e0.attrs_orig->'userPassword' as cred,`
+		fetchCredCols = `e0.attrs_orig->'userPassword' as cred,
+			COALESCE(e0.attrs_norm->'pwdReset' @> '["TRUE"]', false) as pwd_reset,`
+	}
+
+	var lock string
+	if opt.Lock {
+		lock = " for UPDATE"
+	} else if opt.LockShare {
+		lock = " for SHARE"
 	}
 
 	if baseDN.IsRoot() {
@@ -453,7 +502,8 @@ func createFindBasePathByDNSQL(baseDN *DN, opt *FindOption) (string, error) {
 			FROM
 				ldap_entry e0 
 			WHERE
-				e0.rdn_norm = :rdn_norm0 AND e0.parent_id is NULL
+				e0.rdn_norm = :rdn_norm0 AND e0.parent_id is NULL AND e0.deleted_at IS NULL
+			` + lock + `
 		`, nil
 	}
 
@@ -515,17 +565,16 @@ func createFindBasePathByDNSQL(baseDN *DN, opt *FindOption) (string, error) {
 			where2 = append(where2, fmt.Sprintf("e%d.parent_id = e%d.id", index, index-1))
 		}
 	}
+	// The tombstone isn't found, the ancestors of the live entry are always live
+	where2 = append(where2, fmt.Sprintf("e%d.deleted_at IS NULL", lastIndex))
+
 	if opt.FetchAttrs {
-		fetchAttrsCols = `e` + lastIndexStr + `.attrs_orig,`
+		fetchAttrsCols = `e` + lastIndexStr + `.attrs_orig, e` + lastIndexStr + `.rev,`
 	}
 
 	if opt.FetchCred {
-		fetchCredCols = `e` + lastIndexStr + `.attrs_orig->'userPassword' as cred,`
-	}
-
-	var lock string
-	if opt.Lock {
-		lock = " for UPDATE"
+		fetchCredCols = `e` + lastIndexStr + `.attrs_orig->'userPassword' as cred,
+			COALESCE(e` + lastIndexStr + `.attrs_norm->'pwdReset' @> '["TRUE"]', false) as pwd_reset,`
 	}
 
 	sql := `
@@ -551,6 +600,25 @@ func createFindBasePathByDNSQL(baseDN *DN, opt *FindOption) (string, error) {
 	return sql, nil
 }
 
+// FindRootDNs returns the DNs of the live root entries which don't have the parent.
+func (r *Repository) FindRootDNs() ([]*DN, error) {
+	var rdns []string
+	err := findRootRDNsStmt.Select(&rdns, map[string]interface{}{})
+	if err != nil {
+		return nil, NewDBError(xerrors.Errorf("Failed to fetch the root entries. err: %w", err))
+	}
+
+	dns := make([]*DN, 0, len(rdns))
+	for _, rdn := range rdns {
+		dn, err := NormalizeDN(rdn)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to normalize the root DN. rdn_orig: %s, err: %w", rdn, err)
+		}
+		dns = append(dns, dn)
+	}
+	return dns, nil
+}
+
 func (r *Repository) FindDNByID(tx *sqlx.Tx, id int64, lock bool) (*FetchedDNOrig, error) {
 	var dest FetchedDNOrig
 	err := namedStmt(tx, findDNByIDStmt).Get(&dest, map[string]interface{}{
@@ -568,13 +636,39 @@ func (r *Repository) FindDNByID(tx *sqlx.Tx, id int64, lock bool) (*FetchedDNOri
 
 // FindDNByDNWithLock returns FetchedDN object from database by DN search.
 func (r *Repository) FindDNByDNWithLock(tx *sqlx.Tx, dn *DN, lock bool) (*FetchedDN, error) {
-	stmt, params, err := r.PrepareFindDNByDN(dn, &FindOption{Lock: lock})
+	return r.FindDNByDNWithLockContext(context.Background(), tx, dn, lock)
+}
+
+// FindDNByDNWithShareLock returns FetchedDN object from database by DN search with the shared lock.
+// The entry can't be updated or deleted by the others until the transaction ends.
+func (r *Repository) FindDNByDNWithShareLock(tx *sqlx.Tx, dn *DN) (*FetchedDN, error) {
+	stmt, params, release, err := r.PrepareFindDNByDN(tx, dn, &FindOption{LockShare: true})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to prepare FindDNOnlyByDN: %v, err: %w", dn, err)
+	}
+	defer release()
+
+	var dest FetchedDN
+	err = stmt.Get(&dest, params)
+	if err != nil {
+		if isNoResult(err) {
+			return nil, NewNoSuchObject()
+		}
+		return nil, xerrors.Errorf("Failed to fetch FindDNOnlyByDN in %s: %v, err: %w", txLabel(tx), dn, err)
+	}
+
+	return &dest, nil
+}
+
+func (r *Repository) FindDNByDNWithLockContext(ctx context.Context, tx *sqlx.Tx, dn *DN, lock bool) (*FetchedDN, error) {
+	stmt, params, release, err := r.PrepareFindDNByDN(tx, dn, &FindOption{Lock: lock})
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to prepare FindDNOnlyByDN: %v, err: %w", dn, err)
 	}
+	defer release()
 
 	var dest FetchedDN
-	err = namedStmt(tx, stmt).Get(&dest, params)
+	err = stmt.GetContext(ctx, &dest, params)
 	if err != nil {
 		if isNoResult(err) {
 			return nil, NewNoSuchObject()
@@ -587,13 +681,14 @@ func (r *Repository) FindDNByDNWithLock(tx *sqlx.Tx, dn *DN, lock bool) (*Fetche
 
 // FindEntryByDN returns FetchedDBEntry object from database by DN search.
 func (r *Repository) FindEntryByDN(tx *sqlx.Tx, dn *DN, lock bool) (*ModifyEntry, error) {
-	stmt, params, err := r.PrepareFindDNByDN(dn, &FindOption{Lock: lock, FetchAttrs: true})
+	stmt, params, release, err := r.PrepareFindDNByDN(tx, dn, &FindOption{Lock: lock, FetchAttrs: true})
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to prepare FindEntryByDN: %v, err: %w", dn, err)
 	}
+	defer release()
 
 	var dest FetchedEntry
-	err = namedStmt(tx, stmt).Get(&dest, params)
+	err = stmt.Get(&dest, params)
 	if err != nil {
 		if isNoResult(err) {
 			return nil, NewNoSuchObject()
@@ -675,11 +770,18 @@ func (r *Repository) FindIDByParentIDAndRDNNorm(tx *sqlx.Tx, parentId int64, rdn
 	return dest, nil
 }
 
-func (r *Repository) FindCredByDN(dn *DN) ([]string, error) {
-	stmt, params, err := r.PrepareFindDNByDN(dn, &FindOption{FetchCred: true})
+// FetchedCred is the credentials of the bind user.
+type FetchedCred struct {
+	Cred     []string
+	PwdReset bool
+}
+
+func (r *Repository) FindCredByDN(dn *DN) (*FetchedCred, error) {
+	stmt, params, release, err := r.PrepareFindDNByDN(nil, dn, &FindOption{FetchCred: true})
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to prepare FindCredByDN: %v, err: %w", dn, err)
 	}
+	defer release()
 
 	dest := struct {
 		ID       int64          `db:"id"`
@@ -688,6 +790,7 @@ func (r *Repository) FindCredByDN(dn *DN) ([]string, error) {
 		DNOrig   string         `db:"dn_orig"`
 		HasSub   bool           `db:"has_sub"`
 		Cred     types.JSONText `db:"cred"`
+		PwdReset bool           `db:"pwd_reset"`
 	}{}
 
 	err = stmt.Get(&dest, params)
@@ -704,7 +807,10 @@ func (r *Repository) FindCredByDN(dn *DN) ([]string, error) {
 		return nil, xerrors.Errorf("Failed to unmarshal cred array. dn: %s, err: %w", dn.DNOrigStr(), err)
 	}
 
-	return cred, nil
+	return &FetchedCred{
+		Cred:     cred,
+		PwdReset: dest.PwdReset,
+	}, nil
 }
 
 func (r *Repository) AppenScopeFilter(scope int, q *Query, fetchedDN *FetchedDN) (string, error) {
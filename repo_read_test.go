@@ -16,22 +16,22 @@ func TestCreateFindTreePathSQL(t *testing.T) {
 	}{
 		{
 			"ou=Users,dc=example,dc=com",
-			"SELECT e2.rdn_orig || ',' || e1.rdn_orig || ',' || e0.rdn_orig as dn_orig, e2.id, e2.parent_id, e0.id || '.' || e1.id || '.' || e2.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e2.id), false) as has_sub FROM ldap_entry e0, ldap_entry e1, ldap_entry e2 WHERE e0.rdn_norm = :rdn_norm0 AND e1.rdn_norm = :rdn_norm1 AND e2.rdn_norm = :rdn_norm2 AND e0.parent_id is NULL AND e1.parent_id = e0.id AND e2.parent_id = e1.id",
+			"SELECT e2.rdn_orig || ',' || e1.rdn_orig || ',' || e0.rdn_orig as dn_orig, e2.id, e2.parent_id, e0.id || '.' || e1.id || '.' || e2.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e2.id), false) as has_sub FROM ldap_entry e0, ldap_entry e1, ldap_entry e2 WHERE e0.rdn_norm = :rdn_norm0 AND e1.rdn_norm = :rdn_norm1 AND e2.rdn_norm = :rdn_norm2 AND e0.parent_id is NULL AND e1.parent_id = e0.id AND e2.parent_id = e1.id AND e2.deleted_at IS NULL",
 			"",
 		},
 		{
 			"ou=g000001,ou=Group,dc=example,dc=com",
-			"SELECT e3.rdn_orig || ',' || e2.rdn_orig || ',' || e1.rdn_orig || ',' || e0.rdn_orig as dn_orig, e3.id, e3.parent_id, e0.id || '.' || e1.id || '.' || e2.id || '.' || e3.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e3.id), false) as has_sub FROM ldap_entry e0, ldap_entry e1, ldap_entry e2, ldap_entry e3 WHERE e0.rdn_norm = :rdn_norm0 AND e1.rdn_norm = :rdn_norm1 AND e2.rdn_norm = :rdn_norm2 AND e3.rdn_norm = :rdn_norm3 AND e0.parent_id is NULL AND e1.parent_id = e0.id AND e2.parent_id = e1.id AND e3.parent_id = e2.id",
+			"SELECT e3.rdn_orig || ',' || e2.rdn_orig || ',' || e1.rdn_orig || ',' || e0.rdn_orig as dn_orig, e3.id, e3.parent_id, e0.id || '.' || e1.id || '.' || e2.id || '.' || e3.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e3.id), false) as has_sub FROM ldap_entry e0, ldap_entry e1, ldap_entry e2, ldap_entry e3 WHERE e0.rdn_norm = :rdn_norm0 AND e1.rdn_norm = :rdn_norm1 AND e2.rdn_norm = :rdn_norm2 AND e3.rdn_norm = :rdn_norm3 AND e0.parent_id is NULL AND e1.parent_id = e0.id AND e2.parent_id = e1.id AND e3.parent_id = e2.id AND e3.deleted_at IS NULL",
 			"",
 		},
 		{
 			"dc=example,dc=com",
-			"SELECT e1.rdn_orig || ',' || e0.rdn_orig as dn_orig, e1.id, e1.parent_id, e0.id || '.' || e1.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e1.id), false) as has_sub FROM ldap_entry e0, ldap_entry e1 WHERE e0.rdn_norm = :rdn_norm0 AND e1.rdn_norm = :rdn_norm1 AND e0.parent_id is NULL AND e1.parent_id = e0.id",
+			"SELECT e1.rdn_orig || ',' || e0.rdn_orig as dn_orig, e1.id, e1.parent_id, e0.id || '.' || e1.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e1.id), false) as has_sub FROM ldap_entry e0, ldap_entry e1 WHERE e0.rdn_norm = :rdn_norm0 AND e1.rdn_norm = :rdn_norm1 AND e0.parent_id is NULL AND e1.parent_id = e0.id AND e1.deleted_at IS NULL",
 			"",
 		},
 		{
 			"dc=com",
-			"SELECT e0.rdn_orig as dn_orig, e0.id, e0.parent_id, e0.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e0.id), false) as has_sub FROM ldap_entry e0 WHERE e0.rdn_norm = :rdn_norm0 AND e0.parent_id is NULL",
+			"SELECT e0.rdn_orig as dn_orig, e0.id, e0.parent_id, e0.id as path, COALESCE((SELECT true FROM ldap_tree t WHERE t.id = e0.id), false) as has_sub FROM ldap_entry e0 WHERE e0.rdn_norm = :rdn_norm0 AND e0.parent_id is NULL AND e0.deleted_at IS NULL",
 			"",
 		},
 		{
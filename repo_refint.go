@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// refintRemove deletes the references to the deleted entry like OpenLDAP refint overlay
+	refintRemove = "remove"
+	// refintRestrict rejects deleting the entry referenced by the others
+	refintRestrict = "restrict"
+)
+
+// parseRefintMode returns the referential integrity mode of the config. Empty means remove,
+// which is the behavior for member and uniqueMember before the mode was introduced.
+func parseRefintMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", refintRemove:
+		return refintRemove, nil
+	case refintRestrict:
+		return refintRestrict, nil
+	}
+	return "", xerrors.Errorf("Unsupported referential integrity mode: %s", mode)
+}
+
+// refintConds returns the containment conditions of attrs_norm which match the references to the entries.
+// member and uniqueMember are stored as the id, the other DN attributes are stored as the normalized DN
+// so that the case variants are matched too.
+func (r *Repository) refintConds(ids []int64, dnNorms []string) ([]string, error) {
+	conds := []string{}
+	add := func(attr string, value interface{}) error {
+		b, err := json.Marshal(map[string]interface{}{
+			attr: []interface{}{value},
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to marshal the referential integrity condition. attr: %s, err: %w", attr, err)
+		}
+		conds = append(conds, string(b))
+		return nil
+	}
+
+	for i := range ids {
+		for _, attr := range []string{"member", "uniqueMember"} {
+			if err := add(attr, ids[i]); err != nil {
+				return nil, err
+			}
+		}
+		for _, s := range r.server.refintAttrs {
+			if err := add(s.Name, dnNorms[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conds, nil
+}
+
+// checkReferences returns notAllowedOnNonLeaf if the live entries other than the deleting ones reference
+// to the deleting entries in restrict mode. It must be called in the delete transaction after locking the entries.
+func (r *Repository) checkReferences(tx *sqlx.Tx, ids []int64, dnNorms []string) error {
+	if r.refintMode != refintRestrict {
+		return nil
+	}
+
+	conds, err := r.refintConds(ids, dnNorms)
+	if err != nil {
+		return err
+	}
+
+	// The concurrent add and modify of the referencing entries lock the deleting entries by lockReferenced,
+	// so no new reference is created after locking them. Only the first referencing entry is needed.
+	var refs []int64
+	err = tx.Select(&refs, tx.Rebind(`
+		SELECT id FROM ldap_entry
+		WHERE attrs_norm @> ANY(?::jsonb[]) AND deleted_at IS NULL AND NOT (id = ANY(?))
+		ORDER BY id
+		LIMIT 1
+		FOR SHARE`), pq.Array(conds), pq.Array(ids))
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to check the references. ids: %v, err: %w", ids, err))
+	}
+	if len(refs) > 0 {
+		log.Printf("info: Reject deleting the referenced entry. ids: %v, referenced by: %d", ids, refs[0])
+		return NewNotAllowedOnReferenced()
+	}
+
+	return nil
+}
+
+// lockReferenced locks the entries referenced by the configured DN attributes in restrict mode, so they can't be
+// deleted until the transaction ends. values are the DN values written by the operation, keyed by the attribute name.
+// The shared lock is enough since the deleter locks the entry for update, and the writers referencing
+// the same entry don't block each other. The reference to the entry which doesn't exist is rejected
+// since it would be the dangling reference.
+func (r *Repository) lockReferenced(tx *sqlx.Tx, values map[string][]string) error {
+	if r.refintMode != refintRestrict {
+		return nil
+	}
+
+	for _, s := range r.server.refintAttrs {
+		for i, v := range values[s.Name] {
+			dn, err := NormalizeDN(v)
+			if err != nil {
+				return NewInvalidPerSyntax(s.Name, i)
+			}
+			if _, err := r.FindDNByDNWithShareLock(tx, dn); err != nil {
+				var ldapErr *LDAPError
+				if xerrors.As(err, &ldapErr) && ldapErr.IsNoSuchObjectError() {
+					log.Printf("info: Reject the reference to the non-existent entry. attr: %s, dn: %s", s.Name, v)
+					return NewInvalidPerSyntax(s.Name, i)
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeReferences removes member, uniqueMember and the configured DN attributes of the others
+// which reference to the deleted entry.
+func (r *Repository) removeReferences(tx *sqlx.Tx, id int64, dnNorm string) error {
+	if err := r.removeAssociationById(tx, id); err != nil {
+		return err
+	}
+	if len(r.server.refintAttrs) == 0 {
+		return nil
+	}
+
+	conds := make([]string, 0, len(r.server.refintAttrs))
+	for _, s := range r.server.refintAttrs {
+		b, err := json.Marshal(map[string][]string{
+			s.Name: {dnNorm},
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to marshal the referential integrity condition. attr: %s, err: %w", s.Name, err)
+		}
+		conds = append(conds, string(b))
+	}
+
+	var refs []struct {
+		ID        int64          `db:"id"`
+		AttrsNorm types.JSONText `db:"attrs_norm"`
+		AttrsOrig types.JSONText `db:"attrs_orig"`
+	}
+	err := tx.Select(&refs, tx.Rebind(`
+		SELECT id, attrs_norm, attrs_orig FROM ldap_entry
+		WHERE attrs_norm @> ANY(?::jsonb[]) AND id <> ?
+		ORDER BY id
+		FOR UPDATE`), pq.Array(conds), id)
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to find the references. id: %d, err: %w", id, err))
+	}
+
+	for _, ref := range refs {
+		norm := map[string]json.RawMessage{}
+		orig := map[string][]string{}
+		if err := ref.AttrsNorm.Unmarshal(&norm); err != nil {
+			return xerrors.Errorf("Failed to unmarshal attrs_norm. id: %d, err: %w", ref.ID, err)
+		}
+		if err := ref.AttrsOrig.Unmarshal(&orig); err != nil {
+			return xerrors.Errorf("Failed to unmarshal attrs_orig. id: %d, err: %w", ref.ID, err)
+		}
+
+		for _, s := range r.server.refintAttrs {
+			if err := removeReference(norm, orig, s.Name, dnNorm); err != nil {
+				return xerrors.Errorf("Failed to remove the reference. id: %d, attr: %s, err: %w", ref.ID, s.Name, err)
+			}
+		}
+
+		bNorm, _ := json.Marshal(norm)
+		bOrig, _ := json.Marshal(orig)
+
+		var rev int64
+		err = tx.Get(&rev, tx.Rebind(`UPDATE ldap_entry SET attrs_norm = ?, attrs_orig = ?, rev = rev + 1
+			WHERE id = ? RETURNING rev`), types.JSONText(bNorm), types.JSONText(bOrig), ref.ID)
+		if err != nil {
+			return NewDBError(xerrors.Errorf("Failed to remove the references. id: %d, err: %w", ref.ID, err))
+		}
+
+		// The referencing entries are modified implicitly
+		if err := r.publishModifyByID(tx, ref.ID, rev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeReference removes the values of the attribute which are the DN from both of norm and orig.
+// The attribute is removed if no value remains.
+func removeReference(norm map[string]json.RawMessage, orig map[string][]string, attr, dnNorm string) error {
+	raw, ok := norm[attr]
+	if !ok {
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return err
+	}
+
+	// The values of norm and orig are in the same order
+	origValues := orig[attr]
+	newNorm := []string{}
+	newOrig := []string{}
+	for i, v := range values {
+		if v == dnNorm {
+			continue
+		}
+		newNorm = append(newNorm, v)
+		if i < len(origValues) {
+			newOrig = append(newOrig, origValues[i])
+		}
+	}
+
+	if len(newNorm) == 0 {
+		delete(norm, attr)
+		delete(orig, attr)
+		return nil
+	}
+
+	b, err := json.Marshal(newNorm)
+	if err != nil {
+		return err
+	}
+	norm[attr] = b
+	orig[attr] = newOrig
+	return nil
+}
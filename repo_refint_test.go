@@ -0,0 +1,67 @@
+// +build !integration
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseRefintMode(t *testing.T) {
+	testcases := []struct {
+		mode   string
+		expect string
+	}{
+		{"", refintRemove},
+		{"remove", refintRemove},
+		{"Restrict", refintRestrict},
+	}
+
+	for i, tc := range testcases {
+		got, err := parseRefintMode(tc.mode)
+		if err != nil {
+			t.Fatalf("#%d: Unexpected error: %+v", i, err)
+		}
+		if got != tc.expect {
+			t.Errorf("#%d: Unexpected mode. mode: %s, want: %s, got: %s", i, tc.mode, tc.expect, got)
+		}
+	}
+
+	if _, err := parseRefintMode("cascade"); err == nil {
+		t.Errorf("Expected error for unsupported mode")
+	}
+}
+
+func TestRemoveReference(t *testing.T) {
+	norm := map[string]json.RawMessage{
+		"owner":   json.RawMessage(`["uid=user1,dc=example,dc=com","uid=user2,dc=example,dc=com"]`),
+		"seeAlso": json.RawMessage(`["uid=user1,dc=example,dc=com"]`),
+		"cn":      json.RawMessage(`["group1"]`),
+	}
+	orig := map[string][]string{
+		"owner":   {"UID=User1,dc=example,dc=com", "uid=user2,dc=example,dc=com"},
+		"seeAlso": {"uid=user1,dc=example,dc=com"},
+		"cn":      {"group1"},
+	}
+
+	for _, attr := range []string{"owner", "seeAlso", "description"} {
+		if err := removeReference(norm, orig, attr, "uid=user1,dc=example,dc=com"); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+	}
+
+	if string(norm["owner"]) != `["uid=user2,dc=example,dc=com"]` {
+		t.Errorf("Unexpected norm. got: %s", string(norm["owner"]))
+	}
+	expect := map[string][]string{
+		"owner": {"uid=user2,dc=example,dc=com"},
+		"cn":    {"group1"},
+	}
+	if !reflect.DeepEqual(orig, expect) {
+		t.Errorf("Unexpected orig. want: %v, got: %v", expect, orig)
+	}
+	if _, ok := norm["seeAlso"]; ok {
+		t.Errorf("Expected seeAlso to be removed")
+	}
+}
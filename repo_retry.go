@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	ldap "github.com/openstandia/ldapserver"
+	"golang.org/x/xerrors"
+)
+
+func (r *Repository) withRetry(op string, fn func(tx *sqlx.Tx) error) error {
+	return r.withRetryContext(context.Background(), op, fn)
+}
+
+// withRetryContext runs fn in a new transaction and commits it.
+// When the transaction fails by the transient error like serialization failure or deadlock,
+// the whole transaction is retried from scratch with exponential backoff
+// since the rolled-back transaction can't be reused.
+// fn must not commit or rollback the transaction.
+// When the context is canceled, the transaction is rolled back and it returns operations error without retrying.
+// The metrics of the operation are recorded with the latency including all attempts and the commit.
+func (r *Repository) withRetryContext(ctx context.Context, op string, fn func(tx *sqlx.Tx) error) (err error) {
+	start := time.Now()
+	defer func() {
+		r.observe(op, start, err)
+	}()
+
+	maxAttempts := r.server.config.DBRetryMaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	if !r.Healthy() {
+		return NewUnavailable()
+	}
+
+	for attempt := 1; ; attempt++ {
+		tx, err := r.db.BeginTxx(ctx, r.txOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return NewOperationsError(ctx.Err())
+			}
+			return NewDBError(xerrors.Errorf("Failed to begin transaction. err: %w", err))
+		}
+		r.metrics.TxBegan()
+
+		err = fn(tx)
+		if err != nil {
+			rollback(tx)
+		} else {
+			err = commit(tx)
+		}
+		r.metrics.TxEnded()
+
+		// The transaction was rolled back by the canceled context
+		if err != nil && ctx.Err() != nil {
+			log.Printf("info: Canceled %s operation. err: %v", op, err)
+			return NewOperationsError(ctx.Err())
+		}
+
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= maxAttempts {
+			log.Printf("warn: Give up retrying %s operation. attempts: %d, err: %v", op, attempt, err)
+			// Return busy so that the client can distinguish it from the other errors
+			return NewDBError(err)
+		}
+
+		delay := r.retryDelay(attempt)
+		log.Printf("debug: Retry %s operation by transient error. attempt: %d/%d, delay: %v, err: %v",
+			op, attempt, maxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return NewOperationsError(ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay returns base * 2^(attempt-1) with jitter to avoid conflicting again at the same time.
+func (r *Repository) retryDelay(attempt int) time.Duration {
+	delay := time.Duration(r.server.config.DBRetryBaseDelay) * time.Millisecond << uint(attempt-1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetryable returns true if the error is transient and the transaction can be retried.
+// The LDAP errors like alreadyExists aren't retried.
+func isRetryable(err error) bool {
+	return NewDBError(err).Code == ldap.LDAPResultBusy
+}
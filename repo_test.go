@@ -0,0 +1,36 @@
+// +build !integration
+
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestParseIsolationLevel(t *testing.T) {
+	testcases := []struct {
+		level  string
+		expect sql.IsolationLevel
+	}{
+		{"", sql.LevelReadCommitted},
+		{"read-committed", sql.LevelReadCommitted},
+		{"READ COMMITTED", sql.LevelReadCommitted},
+		{"repeatable-read", sql.LevelRepeatableRead},
+		{"repeatable_read", sql.LevelRepeatableRead},
+		{"Serializable", sql.LevelSerializable},
+	}
+
+	for i, tc := range testcases {
+		got, err := parseIsolationLevel(tc.level)
+		if err != nil {
+			t.Fatalf("#%d: Unexpected error: %+v", i, err)
+		}
+		if got != tc.expect {
+			t.Errorf("#%d: Unexpected isolation level. level: %s, want: %v, got: %v", i, tc.level, tc.expect, got)
+		}
+	}
+
+	if _, err := parseIsolationLevel("read-uncommitted"); err == nil {
+		t.Errorf("Expected error for unsupported isolation level")
+	}
+}
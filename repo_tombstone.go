@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+// Undelete restores the tombstone of the DN in soft delete mode. The parent must be live,
+// so the subtree deleted by the tree delete control needs to be restored from the top.
+// The associations of member/uniqueMember removed by the deletion aren't restored.
+func (r *Repository) Undelete(dn *DN) error {
+	return r.withRetry("undelete", func(tx *sqlx.Tx) error {
+		return r.undelete(tx, dn)
+	})
+}
+
+func (r *Repository) undelete(tx *sqlx.Tx, dn *DN) error {
+	var tombstone struct {
+		ID  int64 `db:"id"`
+		Rev int64 `db:"rev"`
+	}
+
+	var err error
+	if dn.IsRoot() {
+		err = tx.Get(&tombstone, tx.Rebind(`
+			SELECT id, rev FROM ldap_entry
+			WHERE parent_id IS NULL AND rdn_norm = ? AND deleted_at IS NOT NULL
+				AND NOT EXISTS (
+					SELECT 1 FROM ldap_entry WHERE parent_id IS NULL AND rdn_norm = ? AND deleted_at IS NULL
+				)
+			ORDER BY deleted_at DESC
+			LIMIT 1
+			FOR UPDATE`), dn.RDNNormStr(), dn.RDNNormStr())
+	} else {
+		// Lock the parent like inserting
+		parent, err := r.FindDNByDNWithLock(tx, dn.ParentDN(), true)
+		if err != nil {
+			return err
+		}
+		// The unique index guarantees there is no live entry of the same DN
+		err = tx.Get(&tombstone, tx.Rebind(`
+			SELECT id, rev FROM ldap_entry
+			WHERE parent_id = ? AND rdn_norm = ? AND deleted_at IS NOT NULL
+			FOR UPDATE`), parent.ID, dn.RDNNormStr())
+	}
+	if err != nil {
+		if isNoResult(err) {
+			return NewNoSuchObject()
+		}
+		return NewDBError(xerrors.Errorf("Failed to find the tombstone. dn_norm: %s, err: %w", dn.DNNormStr(), err))
+	}
+
+	var rev int64
+	err = tx.Get(&rev, tx.Rebind(`UPDATE ldap_entry SET deleted_at = NULL, rev = rev + 1
+		WHERE id = ? RETURNING rev`), tombstone.ID)
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to undelete. dn_norm: %s, err: %w", dn.DNNormStr(), err))
+	}
+
+	log.Printf("info: Undeleted the tombstone. id: %d, dn_norm: %s", tombstone.ID, dn.DNNormStr())
+
+	return r.publishChange(tx, &ChangeEvent{
+		EntryID: tombstone.ID,
+		DN:      dn.DNOrigStr(),
+		Type:    ChangeTypeAdd,
+		Rev:     rev,
+	})
+}
+
+// Purge hard-deletes the tombstones deleted before olderThan ago, and returns the number of them.
+// The tree entries which don't have any children after purging are deleted too.
+func (r *Repository) Purge(olderThan time.Duration) (int64, error) {
+	var purged int64
+	err := r.withRetry("purge", func(tx *sqlx.Tx) error {
+		var err error
+		purged, err = r.purge(tx, time.Now().Add(-olderThan))
+		return err
+	})
+	return purged, err
+}
+
+func (r *Repository) purge(tx *sqlx.Tx, before time.Time) (int64, error) {
+	// The descendants of the tombstone are deleted at the same time or before it,
+	// so the purged set includes all of them
+	var tombstones []struct {
+		ID       int64         `db:"id"`
+		ParentID sql.NullInt64 `db:"parent_id"`
+	}
+	err := tx.Select(&tombstones, tx.Rebind(`
+		SELECT id, parent_id FROM ldap_entry
+		WHERE deleted_at < ?
+		ORDER BY id
+		FOR UPDATE`), before)
+	if err != nil {
+		return 0, NewDBError(xerrors.Errorf("Failed to lock the tombstones. err: %w", err))
+	}
+	if len(tombstones) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]int64, len(tombstones))
+	parentIDs := []int64{}
+	for i, t := range tombstones {
+		ids[i] = t.ID
+		if t.ParentID.Valid {
+			parentIDs = append(parentIDs, t.ParentID.Int64)
+		}
+	}
+
+	// Lock the parents like deleting not to conflict with inserting the new child
+	_, err = tx.Exec(tx.Rebind(`SELECT id FROM ldap_entry WHERE id = ANY(?) ORDER BY id FOR UPDATE`), pq.Array(parentIDs))
+	if err != nil {
+		return 0, NewDBError(xerrors.Errorf("Failed to lock the parents of the tombstones. err: %w", err))
+	}
+
+	_, err = tx.Exec(tx.Rebind(`DELETE FROM ldap_entry WHERE id = ANY(?)`), pq.Array(ids))
+	if err != nil {
+		return 0, NewDBError(xerrors.Errorf("Failed to purge the tombstones. err: %w", err))
+	}
+
+	// Delete the tree entries of the purged containers and the parents which don't have any children now
+	_, err = tx.Exec(tx.Rebind(`
+		DELETE FROM ldap_tree t
+		WHERE t.id = ANY(?) OR (
+			t.id = ANY(?) AND NOT EXISTS (SELECT 1 FROM ldap_entry e WHERE e.parent_id = t.id)
+		)`), pq.Array(ids), pq.Array(parentIDs))
+	if err != nil {
+		return 0, NewDBError(xerrors.Errorf("Failed to delete the tree entries of the tombstones. err: %w", err))
+	}
+
+	log.Printf("info: Purged the tombstones. count: %d", len(ids))
+
+	return int64(len(ids)), nil
+}
+
+// purgeTombstone hard-deletes the tombstone of the DN with its descendants, which are tombstones too.
+// The unique index of (parent_id, rdn_norm) covers the tombstones, and adding the root DN revives its tombstone,
+// so renaming onto the DN of the tombstone needs to purge it in advance. The parent must be locked by the caller.
+// parentID is ignored for the root DN.
+func (r *Repository) purgeTombstone(tx *sqlx.Tx, dn *DN, parentID int64) error {
+	cond, args := `parent_id = ? AND rdn_norm = ?`, []interface{}{parentID, dn.RDNNormStr()}
+	if dn.IsRoot() {
+		cond, args = `parent_id IS NULL AND rdn_norm = ?`, []interface{}{dn.RDNNormStr()}
+	}
+
+	var ids []int64
+	err := tx.Select(&ids, tx.Rebind(`
+		WITH RECURSIVE t AS (
+			SELECT id FROM ldap_entry WHERE `+cond+` AND deleted_at IS NOT NULL
+			UNION ALL
+			SELECT e.id FROM ldap_entry e JOIN t ON e.parent_id = t.id
+		)
+		SELECT id FROM t`), args...)
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to find the tombstone. dn_norm: %s, err: %w", dn.DNNormStr(), err))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(tx.Rebind(`SELECT id FROM ldap_entry WHERE id = ANY(?) ORDER BY id FOR UPDATE`), pq.Array(ids))
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to lock the tombstone. ids: %v, err: %w", ids, err))
+	}
+	_, err = tx.Exec(tx.Rebind(`DELETE FROM ldap_entry WHERE id = ANY(?)`), pq.Array(ids))
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to purge the tombstone. ids: %v, err: %w", ids, err))
+	}
+	_, err = tx.Exec(tx.Rebind(`DELETE FROM ldap_tree WHERE id = ANY(?)`), pq.Array(ids))
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to delete the tree entries of the tombstone. ids: %v, err: %w", ids, err))
+	}
+
+	log.Printf("info: Purged the tombstone to reuse the DN. dn_norm: %s, count: %d", dn.DNNormStr(), len(ids))
+
+	return nil
+}
+
+// StartTombstonePurge purges the tombstones older than the retention in background.
+func (r *Repository) StartTombstonePurge(retention time.Duration) {
+	if !r.server.config.SoftDelete || retention <= 0 {
+		return
+	}
+	r.stopTombstonePurge = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		interval := retention / 10
+		if interval > time.Hour {
+			interval = time.Hour
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+
+			if _, err := r.Purge(retention); err != nil {
+				log.Printf("warn: Failed to purge the tombstones. err: %v", err)
+			}
+		}
+	}(r.stopTombstonePurge)
+}
+
+// StopTombstonePurge stops the background purging.
+func (r *Repository) StopTombstonePurge() {
+	if r.stopTombstonePurge != nil {
+		close(r.stopTombstonePurge)
+		r.stopTombstonePurge = nil
+	}
+}
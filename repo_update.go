@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
+	ldap "github.com/openstandia/ldapserver"
 	"golang.org/x/xerrors"
 )
 
@@ -17,32 +20,162 @@ func (r *Repository) Update(tx *sqlx.Tx, oldEntry, newEntry *ModifyEntry) error
 		return err
 	}
 
-	_, err = tx.NamedStmt(updateAttrsByIdStmt).Exec(map[string]interface{}{
+	params := map[string]interface{}{
 		"id":         dbEntry.ID,
-		"updated":    dbEntry.Updated,
 		"attrs_norm": dbEntry.AttrsNorm,
 		"attrs_orig": dbEntry.AttrsOrig,
-	})
+	}
+	dbEntry.setOperationalParams(params)
+
+	var rev int64
+	err = tx.NamedStmt(updateAttrsByIdStmt).Get(&rev, params)
 	if err != nil {
 		return xerrors.Errorf("Failed to update entry. entry: %v, err: %w", newEntry, err)
 	}
 
-	return nil
+	return r.publishChange(tx, &ChangeEvent{
+		EntryID: newEntry.dbEntryID,
+		DN:      newEntry.GetDNOrig(),
+		Type:    ChangeTypeModify,
+		Rev:     rev,
+	})
 }
 
-func (r *Repository) UpdateDN(oldDN, newDN *DN, oldRDN *RelativeDN) error {
-	tx := r.db.MustBegin()
+// Modification is a change of the modify request.
+type Modification struct {
+	Op     int
+	Attr   string
+	Values []string
+}
+
+// ModifyWithExpectedRev applies the modifications to the entry in one transaction.
+// If expectedRev is greater than 0, the entry is updated only if the stored rev matches it,
+// otherwise it returns the conflict error. The rev is incremented by every modification.
+// requester is the authenticated DN, it's used for the password policy.
+func (r *Repository) ModifyWithExpectedRev(dn *DN, mods []*Modification, expectedRev int64, requester *DN) error {
+	return r.withRetry("modify", func(tx *sqlx.Tx) error {
+		oldEntry, err := r.FindEntryByDN(tx, dn, true)
+		if err != nil {
+			return xerrors.Errorf("Failed to fetch the current entry for modification. dn: %s, err: %w", dn.DNNormStr(), err)
+		}
+
+		if expectedRev > 0 && oldEntry.dbRev != expectedRev {
+			log.Printf("info: Conflict the entry revision. dn: %s, expected: %d, actual: %d", dn.DNNormStr(), expectedRev, oldEntry.dbRev)
+			return NewRevisionConflict(expectedRev, oldEntry.dbRev)
+		}
+
+		newEntry := oldEntry.Clone()
+		newEntry.SetModifier(requester)
+
+		for _, mod := range mods {
+			var err error
+
+			switch mod.Op {
+			case ldap.ModifyRequestChangeOperationAdd:
+				err = newEntry.Add(mod.Attr, mod.Values)
+
+			case ldap.ModifyRequestChangeOperationDelete:
+				err = newEntry.Delete(mod.Attr, mod.Values)
+
+			case ldap.ModifyRequestChangeOperationReplace:
+				err = newEntry.Replace(mod.Attr, mod.Values)
+			}
 
-	err := r.updateDN(tx, oldDN, newDN, oldRDN)
+			if err != nil {
+				return xerrors.Errorf("Failed to modify the entry. dn: %s, err: %w", dn.DNNormStr(), err)
+			}
+		}
+
+		self := requester != nil && requester.Equal(dn)
+		if err := r.applyPasswordPolicy(tx, oldEntry, newEntry, self); err != nil {
+			return xerrors.Errorf("Failed to modify the password. dn: %s, err: %w", dn.DNNormStr(), err)
+		}
+
+		log.Printf("Update entry. oldEntry: %v, newEntry: %v", oldEntry, newEntry)
+
+		if expectedRev > 0 {
+			return r.updateWithRev(tx, newEntry, expectedRev)
+		}
+
+		err = r.Update(tx, oldEntry, newEntry)
+		if err != nil {
+			// TODO error code
+			return xerrors.Errorf("Failed to modify the entry. dn: %s, entry: %v, err: %w", dn.DNNormStr(), newEntry, err)
+		}
+		return nil
+	})
+}
+
+// updateWithRev updates the attributes and increments the rev only if the stored rev matches.
+func (r *Repository) updateWithRev(tx *sqlx.Tx, newEntry *ModifyEntry, expectedRev int64) error {
+	dbEntry, err := mapper.ModifyEntryToDBEntry(tx, newEntry)
 	if err != nil {
-		rollback(tx)
 		return err
 	}
 
-	return commit(tx)
+	params := map[string]interface{}{
+		"id":         newEntry.dbEntryID,
+		"rev":        expectedRev,
+		"attrs_norm": dbEntry.AttrsNorm,
+		"attrs_orig": dbEntry.AttrsOrig,
+	}
+	dbEntry.setOperationalParams(params)
+
+	var rev int64
+	err = namedStmt(tx, updateAttrsByIdAndRevStmt).Get(&rev, params)
+	if err != nil {
+		if isNoResult(err) {
+			return NewRevisionConflict(expectedRev, 0)
+		}
+		return NewDBError(xerrors.Errorf("Failed to update entry with rev. dn: %s, err: %w", newEntry.GetDNNorm(), err))
+	}
+
+	return r.publishChange(tx, &ChangeEvent{
+		EntryID: newEntry.dbEntryID,
+		DN:      newEntry.GetDNOrig(),
+		Type:    ChangeTypeModify,
+		Rev:     rev,
+	})
 }
 
-func (r *Repository) updateDN(tx *sqlx.Tx, oldDN, newDN *DN, oldRDN *RelativeDN) error {
+// ModDN renames the entry and/or moves it onto the new parent in one transaction.
+// newParentDN can be nil, which means the parent isn't changed.
+// When moving, the paths of the entry and all descendants are rewritten.
+// requester is the authenticated DN, it's stored as modifiersName.
+func (r *Repository) ModDN(oldDN *DN, newRDN string, newParentDN *DN, deleteOldRDN bool, requester *DN) error {
+	newRDNDN, err := ParseDN(newRDN)
+	if err != nil || len(newRDNDN.RDNs) != 1 {
+		log.Printf("info: Invalid newrdn. dn: %s newrdn: %s err: %v", oldDN.DNNormStr(), newRDN, err)
+		return NewInvalidDNSyntax()
+	}
+
+	newDN, _, err := oldDN.ModifyRDN(newRDN, deleteOldRDN)
+	if err != nil {
+		return NewInvalidDNSyntax()
+	}
+
+	if newParentDN != nil {
+		// Reject the move onto the entry itself or its descendant, it creates a cycle
+		if newParentDN.Equal(oldDN) || strings.HasSuffix(newParentDN.DNNormStr(), ","+oldDN.DNNormStr()) {
+			return NewUnwillingToPerform("newSuperior is the entry or its subordinate")
+		}
+
+		newDN, err = newDN.Move(newParentDN)
+		if err != nil {
+			return NewInvalidDNSyntax()
+		}
+	}
+
+	return r.UpdateDN(oldDN, newDN, deleteOldRDN, requester)
+}
+
+func (r *Repository) UpdateDN(oldDN, newDN *DN, deleteOldRDN bool, requester *DN) error {
+	return r.withRetry("modrdn", func(tx *sqlx.Tx) error {
+		return r.updateDN(tx, oldDN, newDN, deleteOldRDN, requester)
+	})
+}
+
+func (r *Repository) updateDN(tx *sqlx.Tx, oldDN, newDN *DN, deleteOldRDN bool, requester *DN) error {
 	// Lock the entry
 	oldEntry, err := r.FindEntryByDN(tx, oldDN, true)
 	if err != nil {
@@ -50,72 +183,111 @@ func (r *Repository) updateDN(tx *sqlx.Tx, oldDN, newDN *DN, oldRDN *RelativeDN)
 		return NewNoSuchObject()
 	}
 
+	// Remove the cache of the entry and the descendants while holding the lock
+	r.dnCache.RemoveSubtree(oldDN)
+
+	newEntry, err := oldEntry.ModifyRDN(newDN, deleteOldRDN)
+	if err != nil {
+		return err
+	}
+	newEntry.SetModifier(requester)
+
 	if !oldDN.ParentDN().Equal(newDN.ParentDN()) {
 		// Move or copy onto the new parent case
-		return r.updateDNOntoNewParent(tx, oldDN, newDN, oldRDN, oldEntry)
+		return r.updateDNOntoNewParent(tx, oldDN, newDN, oldEntry, newEntry)
 	} else {
 		// Update rdn only case
-		return r.updateRDN(tx, oldDN, newDN, oldRDN, oldEntry)
+		return r.updateRDN(tx, oldDN, newDN, oldEntry, newEntry)
 	}
 }
 
-func (r *Repository) updateDNOntoNewParent(tx *sqlx.Tx, oldDN, newDN *DN, oldRDN *RelativeDN, oldEntry *ModifyEntry) error {
+// checkSibling returns alreadyExists if other entry has the same RDN under the parent.
+// The tombstones aren't checked, purge them by purgeTombstone before updating.
+func (r *Repository) checkSibling(tx *sqlx.Tx, parentID int64, newDN *DN, entryID int64) error {
+	id, err := r.FindIDByParentIDAndRDNNorm(tx, parentID, newDN.RDNNormStr())
+	if err != nil {
+		var ldapErr *LDAPError
+		if xerrors.As(err, &ldapErr) && ldapErr.IsNoSuchObjectError() {
+			return nil
+		}
+		return err
+	}
+	if id != entryID {
+		log.Printf("debug: The new DN already exists. dn_norm: %s", newDN.DNNormStr())
+		return NewAlreadyExists()
+	}
+	return nil
+}
+
+// checkRootSibling returns alreadyExists if other root entry has the same RDN.
+// It can't block the concurrent insert or rename onto the same RDN since the row doesn't exist yet,
+// the partial unique index idx_ldap_entry_root_rdn_norm rejects it on updating.
+func (r *Repository) checkRootSibling(tx *sqlx.Tx, newDN *DN, entryID int64) error {
+	var ids []int64
+	err := tx.Select(&ids, tx.Rebind(`
+		SELECT id FROM ldap_entry
+		WHERE parent_id IS NULL AND rdn_norm = ? AND deleted_at IS NULL AND id <> ?
+		FOR UPDATE`), newDN.RDNNormStr(), entryID)
+	if err != nil {
+		return NewDBError(xerrors.Errorf("Failed to find the root entry. rdn_norm: %s, err: %w", newDN.RDNNormStr(), err))
+	}
+	if len(ids) > 0 {
+		log.Printf("debug: The new root DN already exists. dn_norm: %s", newDN.DNNormStr())
+		return NewAlreadyExists()
+	}
+	return nil
+}
+
+func (r *Repository) updateDNOntoNewParent(tx *sqlx.Tx, oldDN, newDN *DN, oldEntry, newEntry *ModifyEntry) error {
 	oldParentDN := oldDN.ParentDN()
 	newParentDN := newDN.ParentDN()
 
-	newParentID := oldEntry.dbParentID
-	var oldParentID int64 = -1
-
-	if !oldParentDN.Equal(newParentDN) {
-		// Lock the old/new parent entry
-		newParentFetchedDN, err := r.FindDNByDNWithLock(tx, newParentDN, true)
-		if err != nil {
-			log.Printf("debug: Failed to fetch the new parent by DN: %s, err: %v", newParentDN.DNOrigStr(), err)
-			return NewNoSuchObject()
-		}
-		oldParentFetchedDN, err := r.FindDNByDNWithLock(tx, oldParentDN, true)
-		if err != nil {
-			log.Printf("debug: Failed to fetch the old parent by DN: %s, err: %v", oldParentDN.DNOrigStr(), err)
-			return NewNoSuchObject()
-		}
+	// Lock the old/new parent entry like inserting
+	newParentFetchedDN, err := r.FindDNByDNWithLock(tx, newParentDN, true)
+	if err != nil {
+		log.Printf("debug: Failed to fetch the new parent by DN: %s, err: %v", newParentDN.DNOrigStr(), err)
+		return NewNoSuchObject()
+	}
+	oldParentFetchedDN, err := r.FindDNByDNWithLock(tx, oldParentDN, true)
+	if err != nil {
+		log.Printf("debug: Failed to fetch the old parent by DN: %s, err: %v", oldParentDN.DNOrigStr(), err)
+		return NewNoSuchObject()
+	}
 
-		newParentID = newParentFetchedDN.ID
-		oldParentID = oldParentFetchedDN.ID
+	// Guard the cycle by the path too
+	if strings.HasPrefix(newParentFetchedDN.Path+".", oldEntry.path+".") {
+		return NewUnwillingToPerform("newSuperior is the entry or its subordinate")
+	}
 
-		if !newParentFetchedDN.HasSub {
-			// If the parent doesn't have any sub, need to insert tree entry first.
-			// Also, need to lock the parent entry of the parent before it.
-			newGrandParentDN := newParentDN.ParentDN()
-			if newGrandParentDN != nil {
-				_, err := r.FindDNByDNWithLock(tx, newParentDN.ParentDN(), true)
-				if err != nil {
-					return NewNoSuchObject()
-				}
-			}
+	if err := r.checkSibling(tx, newParentFetchedDN.ID, newDN, oldEntry.dbEntryID); err != nil {
+		return err
+	}
+	if err := r.purgeTombstone(tx, newDN, newParentFetchedDN.ID); err != nil {
+		return err
+	}
 
-			// Register as container
-			err = r.insertTree(tx, newParentFetchedDN.ID, newParentFetchedDN.IsRoot())
+	if !newParentFetchedDN.HasSub {
+		// If the parent doesn't have any sub, need to insert tree entry first.
+		// Also, need to lock the parent entry of the parent before it.
+		newGrandParentDN := newParentDN.ParentDN()
+		if newGrandParentDN != nil {
+			_, err := r.FindDNByDNWithLock(tx, newGrandParentDN, true)
 			if err != nil {
-				return err
+				return NewNoSuchObject()
 			}
 		}
 
-		// Move tree if the operation is for tree which means the old entry has children
-		if oldEntry.hasSub {
-			if err := r.moveTree(tx, oldEntry.path, newParentFetchedDN.Path); err != nil {
-				return err
-			}
+		// Register as container
+		err = r.insertTree(context.Background(), tx, newParentFetchedDN.ID, newParentFetchedDN.Path, newParentFetchedDN.IsRoot())
+		if err != nil {
+			return err
 		}
 	}
 
-	newEntry := oldEntry.ModifyRDN(newDN)
-
-	if oldRDN != nil {
-		for _, attr := range oldRDN.Attributes {
-			if err := newEntry.Add(attr.TypeOrig, []string{attr.ValueOrig}); err != nil {
-				log.Printf("warn: Failed to remain old RDN, err: %s", err)
-				return err
-			}
+	// Move tree if the operation is for tree which means the old entry has children
+	if oldEntry.hasSub {
+		if err := r.moveTree(tx, oldEntry.path, newParentFetchedDN.Path); err != nil {
+			return err
 		}
 	}
 
@@ -124,67 +296,91 @@ func (r *Repository) updateDNOntoNewParent(tx *sqlx.Tx, oldDN, newDN *DN, oldRDN
 		return err
 	}
 
-	_, err = tx.NamedStmt(updateDNByIdStmt).Exec(map[string]interface{}{
+	params := map[string]interface{}{
 		"id":           oldEntry.dbEntryID,
-		"parent_id":    newParentID,
+		"parent_id":    newParentFetchedDN.ID,
 		"new_rdn_norm": newDN.RDNNormStr(),
 		"new_rdn_orig": newDN.RDNOrigStr(),
 		"attrs_norm":   dbEntry.AttrsNorm,
 		"attrs_orig":   dbEntry.AttrsOrig,
-	})
+	}
+	dbEntry.setOperationalParams(params)
+
+	var rev int64
+	err = tx.NamedStmt(updateDNByIdStmt).Get(&rev, params)
 	if err != nil {
-		return xerrors.Errorf("Failed to update entry DN. oldDN: %s, newDN: %s, err: %w", oldDN.DNNormStr(), newDN.DNNormStr(), err)
+		return NewDBError(xerrors.Errorf("Failed to update entry DN. oldDN: %s, newDN: %s, err: %w", oldDN.DNNormStr(), newDN.DNNormStr(), err))
 	}
 
-	if !oldParentDN.Equal(newParentDN) {
-		// Check if the old parent entry still has children
-		hasSub, err := r.hasSub(tx, oldParentID)
-		if err != nil {
-			return err
-		}
+	// Check if the old parent entry still has children
+	hasSub, err := r.hasSub(tx, oldParentFetchedDN.ID)
+	if err != nil {
+		return err
+	}
 
-		// Delete the tree entry if the old parent doesn't have any children now
-		if !hasSub {
-			if err := r.deleteTreeByID(tx, oldParentID); err != nil {
-				return err
-			}
+	// Delete the tree entry if the old parent doesn't have any children now
+	if !hasSub {
+		if err := r.deleteTreeByID(tx, oldParentFetchedDN.ID); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return r.publishModDN(tx, oldDN, newDN, oldEntry.dbEntryID, rev)
 }
 
-func (r *Repository) updateRDN(tx *sqlx.Tx, oldDN, newDN *DN, oldRDN *RelativeDN, oldEntry *ModifyEntry) error {
-	// Update the entry even if it's same RDN to update modifyTimestamp
-	newEntry := oldEntry.ModifyRDN(newDN)
-
-	if oldRDN != nil {
-		for _, attr := range oldRDN.Attributes {
-			if err := newEntry.Add(attr.TypeOrig, []string{attr.ValueOrig}); err != nil {
-				log.Printf("info: Schema error but ignore it. err: %s", err)
-			}
+func (r *Repository) updateRDN(tx *sqlx.Tx, oldDN, newDN *DN, oldEntry, newEntry *ModifyEntry) error {
+	if !oldDN.IsRoot() {
+		// Lock the parent entry like inserting
+		if _, err := r.FindDNByDNWithLock(tx, oldDN.ParentDN(), true); err != nil {
+			return NewNoSuchObject()
+		}
+		if err := r.checkSibling(tx, oldEntry.dbParentID, newDN, oldEntry.dbEntryID); err != nil {
+			return err
 		}
+	} else {
+		if err := r.checkRootSibling(tx, newDN, oldEntry.dbEntryID); err != nil {
+			return err
+		}
+	}
+	if err := r.purgeTombstone(tx, newDN, oldEntry.dbParentID); err != nil {
+		return err
 	}
 
+	// Update the entry even if it's same RDN to update modifyTimestamp
 	dbEntry, err := mapper.ModifyEntryToDBEntry(tx, newEntry)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.NamedStmt(updateRDNByIdStmt).Exec(map[string]interface{}{
+	params := map[string]interface{}{
 		"id":           oldEntry.dbEntryID,
 		"new_rdn_norm": newDN.RDNNormStr(),
 		"new_rdn_orig": newDN.RDNOrigStr(),
 		"attrs_norm":   dbEntry.AttrsNorm,
 		"attrs_orig":   dbEntry.AttrsOrig,
-	})
+	}
+	dbEntry.setOperationalParams(params)
+
+	var rev int64
+	err = tx.NamedStmt(updateRDNByIdStmt).Get(&rev, params)
 
 	if err != nil {
-		return xerrors.Errorf("Failed to update entry DN. oldDN: %s, newDN: %s, err: %w", oldDN.DNNormStr(), newDN.DNNormStr(), err)
+		return NewDBError(xerrors.Errorf("Failed to update entry DN. oldDN: %s, newDN: %s, err: %w", oldDN.DNNormStr(), newDN.DNNormStr(), err))
 	}
 
-	return nil
+	return r.publishModDN(tx, oldDN, newDN, oldEntry.dbEntryID, rev)
+}
 
+// publishModDN publishes the rename of the entry. The descendants are renamed implicitly,
+// the subscribers need to handle them by OldDN.
+func (r *Repository) publishModDN(tx *sqlx.Tx, oldDN, newDN *DN, id, rev int64) error {
+	return r.publishChange(tx, &ChangeEvent{
+		EntryID: id,
+		DN:      newDN.DNOrigStr(),
+		OldDN:   oldDN.DNOrigStr(),
+		Type:    ChangeTypeModDN,
+		Rev:     rev,
+	})
 }
 
 func (r *Repository) moveTree(tx *sqlx.Tx, sourcePath, newParentPath string) error {
@@ -23,6 +23,19 @@ func (s SchemaMap) Put(k string, schema *Schema) {
 // TODO
 var mergedSchema string = ""
 
+// OID_LDAP_PG is the arc of ldap-pg's own definitions. It's the UUID-based OID of ITU-T X.667
+// (2.25.<UUID cac43937-c00d-4ad5-84b8-8262b2825cee as integer>), which doesn't need the registration.
+// Attribute types are under .1.
+const OID_LDAP_PG = "2.25.269522905847159370286706736692841307374"
+
+// SCHEMA_LDAP_PG defines the operational attributes provided by ldap-pg itself and its password policy.
+// The password policy attributes use the OIDs of draft-behera-ldap-password-policy as OpenLDAP does.
+var SCHEMA_LDAP_PG string = `
+attributeTypes: ( ` + OID_LDAP_PG + `.1.1 NAME 'entryRev' DESC 'ldap-pg: revision of the entry which is incremented on every modification' EQUALITY integerMatch ORDERING integerOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 SINGLE-VALUE NO-USER-MODIFICATION USAGE directoryOperation )
+attributeTypes: ( 1.3.6.1.4.1.42.2.27.8.1.16 NAME 'pwdChangedTime' DESC 'The time the password was last changed' EQUALITY generalizedTimeMatch ORDERING generalizedTimeOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.24 SINGLE-VALUE NO-USER-MODIFICATION USAGE directoryOperation )
+attributeTypes: ( 1.3.6.1.4.1.42.2.27.8.1.22 NAME 'pwdReset' DESC 'The indication that the password has been reset' EQUALITY booleanMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.7 SINGLE-VALUE USAGE directoryOperation )
+`
+
 func (s SchemaMap) Dump() string {
 	return mergedSchema
 }
@@ -88,7 +101,7 @@ type Schema struct {
 func InitSchemaMap(server *Server) SchemaMap {
 	m := SchemaMap{}
 
-	mergedSchema = mergeSchema(SCHEMA_OPENLDAP24, customSchema)
+	mergedSchema = mergeSchema(SCHEMA_OPENLDAP24+SCHEMA_LDAP_PG, customSchema)
 	parseSchema(server, m, mergedSchema)
 
 	err := m.resolve()
@@ -131,7 +144,7 @@ func parseSchema(server *Server, m SchemaMap, schemaDef string) {
 
 			s := &Schema{
 				server:      server,
-				IndexType:   "", // TODO configurable
+				IndexType:   "", // Configured by indexed-attrs
 				SingleValue: false,
 			}
 			s.Oid = oid
@@ -570,6 +583,15 @@ func (s *Schema) UseIndependentColumn(c string) {
 	s.ColumnName = c
 }
 
+// IsIndexed returns true if the attribute has the expression index on attrs_norm.
+func (s *Schema) IsIndexed() bool {
+	return s.IndexType != ""
+}
+
+func (s *Schema) UseIndex(t string) {
+	s.IndexType = t
+}
+
 func (s *Schema) UseMemberTable(use bool) {
 	s.IsUseMemberTable = use
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+type ObjectClassKind int
+
+const (
+	ObjectClassStructural ObjectClassKind = iota
+	ObjectClassAuxiliary
+	ObjectClassAbstract
+)
+
+type ObjectClass struct {
+	Name  string
+	AName []string
+	Oid   string
+	Sup   []string
+	Kind  ObjectClassKind
+	Must  []string
+	May   []string
+}
+
+type ObjectClassMap map[string]*ObjectClass
+
+func (m ObjectClassMap) Get(k string) (*ObjectClass, bool) {
+	oc, ok := m[strings.ToLower(k)]
+	return oc, ok
+}
+
+func (m ObjectClassMap) Put(k string, oc *ObjectClass) {
+	m[strings.ToLower(k)] = oc
+}
+
+// InitObjectClassMap parses objectClasses of the merged schema.
+func InitObjectClassMap(schemaDef string) ObjectClassMap {
+	m := ObjectClassMap{}
+
+	for _, line := range strings.Split(strings.TrimSuffix(schemaDef, "\n"), "\n") {
+		if !strings.HasPrefix(line, "objectClasses") {
+			continue
+		}
+		_, oid := parseOid(line)
+		name := parseName(line)
+
+		if oid == "" || len(name) == 0 {
+			log.Printf("warn: Unsupported objectClass schema. %s", line)
+			continue
+		}
+
+		oc := &ObjectClass{
+			Name: name[0],
+			Oid:  oid,
+			Sup:  parseOIDList(line, "SUP"),
+			Must: parseOIDList(line, "MUST"),
+			May:  parseOIDList(line, "MAY"),
+		}
+		if len(name) > 1 {
+			oc.AName = name[1:]
+		}
+
+		// STRUCTURAL is the default kind, see https://tools.ietf.org/html/rfc4512#section-4.1.1
+		if strings.Contains(line, " AUXILIARY") {
+			oc.Kind = ObjectClassAuxiliary
+		} else if strings.Contains(line, " ABSTRACT") {
+			oc.Kind = ObjectClassAbstract
+		}
+
+		m.Put(oc.Name, oc)
+		for _, v := range oc.AName {
+			m.Put(v, oc)
+		}
+	}
+
+	return m
+}
+
+var oidListPatterns = map[string]*regexp.Regexp{
+	"SUP":  regexp.MustCompile(` SUP (\( .*? \)|\S+)`),
+	"MUST": regexp.MustCompile(` MUST (\( .*? \)|\S+)`),
+	"MAY":  regexp.MustCompile(` MAY (\( .*? \)|\S+)`),
+}
+
+// parseOIDList parses "KEYWORD oid" or "KEYWORD ( oid $ oid )" form.
+func parseOIDList(line, keyword string) []string {
+	g := oidListPatterns[keyword].FindStringSubmatch(line)
+	if g == nil {
+		return nil
+	}
+	v := strings.TrimSuffix(strings.TrimPrefix(g[1], "( "), " )")
+
+	list := []string{}
+	for _, s := range strings.Split(v, "$") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// superClasses returns the object classes and all of their super classes.
+func (m ObjectClassMap) superClasses(names []string) (map[string]*ObjectClass, error) {
+	result := map[string]*ObjectClass{}
+
+	var walk func(name string) error
+	walk = func(name string) error {
+		oc, ok := m.Get(name)
+		if !ok {
+			return NewObjectClassViolationUnrecognized(name)
+		}
+		if _, ok := result[oc.Name]; ok {
+			return nil
+		}
+		result[oc.Name] = oc
+		for _, sup := range oc.Sup {
+			if err := walk(sup); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range names {
+		if err := walk(name); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// isSubClassOf returns true if the object class inherits the super class.
+func (m ObjectClassMap) isSubClassOf(oc *ObjectClass, sup *ObjectClass) bool {
+	for _, v := range oc.Sup {
+		parent, ok := m.Get(v)
+		if !ok {
+			continue
+		}
+		if parent == sup || m.isSubClassOf(parent, sup) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateObjectClass checks the entry has exactly one structural object class chain,
+// all MUST attributes of the object classes and only the attributes permitted by them.
+// Operational attributes are not checked.
+func (j *AddEntry) ValidateObjectClass(m ObjectClassMap) error {
+	ocs, ok := j.attributes["objectClass"]
+	if !ok {
+		return NewObjectClassViolation()
+	}
+
+	classes, err := m.superClasses(ocs.Orig())
+	if err != nil {
+		return err
+	}
+
+	// Find the most specific structural object class
+	var structural *ObjectClass
+	for _, oc := range classes {
+		if oc.Kind != ObjectClassStructural {
+			continue
+		}
+		if structural == nil || m.isSubClassOf(oc, structural) {
+			structural = oc
+			continue
+		}
+		if !m.isSubClassOf(structural, oc) {
+			return NewObjectClassViolationInvalidStructural(structural.Name, oc.Name)
+		}
+	}
+	if structural == nil {
+		return NewObjectClassViolationNoStructural()
+	}
+
+	_, extensible := classes["extensibleObject"]
+
+	allowed := map[string]struct{}{}
+	for _, oc := range classes {
+		for _, v := range oc.Must {
+			s, ok := j.schemaMap.Get(v)
+			if !ok {
+				log.Printf("warn: Not found MUST attribute '%s' of objectClass '%s' in schema", v, oc.Name)
+				continue
+			}
+			if _, ok := j.attributes[s.Name]; !ok {
+				return NewObjectClassViolationRequiresAttr(oc.Name, s.Name)
+			}
+			allowed[s.Name] = struct{}{}
+		}
+		for _, v := range oc.May {
+			if s, ok := j.schemaMap.Get(v); ok {
+				allowed[s.Name] = struct{}{}
+			}
+		}
+	}
+
+	if extensible {
+		return nil
+	}
+
+	for k, sv := range j.attributes {
+		if sv.schema.IsOperationalAttribute() {
+			continue
+		}
+		if _, ok := allowed[k]; !ok {
+			return NewObjectClassViolationNotAllowed(k)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateObjectClass(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+	m := InitObjectClassMap(mergedSchema)
+
+	testcases := []struct {
+		DN           string
+		Attrs        map[string][]string
+		ExpectedCode int
+	}{
+		{
+			"uid=user1,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"inetOrgPerson"}, "cn": {"user1"}, "sn": {"user1"}},
+			0,
+		},
+		{
+			"uid=user1,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"top", "person", "organizationalPerson", "inetOrgPerson"}, "cn": {"user1"}, "sn": {"user1"}},
+			0,
+		},
+		{
+			// Missing MUST attribute of person
+			"uid=user1,ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"inetOrgPerson"}, "cn": {"user1"}},
+			65,
+		},
+		{
+			// No structural object class
+			"dc=example,dc=com",
+			map[string][]string{"objectClass": {"top", "dcObject"}},
+			65,
+		},
+		{
+			"dc=example,dc=com",
+			map[string][]string{"objectClass": {"top", "dcObject", "organization"}, "o": {"example"}},
+			0,
+		},
+		{
+			// Multiple structural object classes
+			"cn=group1,ou=Groups,dc=example,dc=com",
+			map[string][]string{"objectClass": {"groupOfNames", "person"}, "sn": {"group1"}, "member": {"uid=user1,ou=Users,dc=example,dc=com"}},
+			65,
+		},
+		{
+			// Not allowed attribute
+			"ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"organizationalUnit"}, "mail": {"user1@example.com"}},
+			65,
+		},
+		{
+			"ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"organizationalUnit", "extensibleObject"}, "mail": {"user1@example.com"}},
+			0,
+		},
+		{
+			"ou=Users,dc=example,dc=com",
+			map[string][]string{"objectClass": {"organizationalUnit", "unknownObjectClass"}},
+			65,
+		},
+	}
+
+	for i, tc := range testcases {
+		dn, err := NormalizeDN(tc.DN)
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+		entry := NewAddEntry(dn)
+		for k, v := range tc.Attrs {
+			if err := entry.Add(k, v); err != nil {
+				t.Errorf("Unexpected error on %d: %+v", i, err)
+			}
+		}
+		if err := entry.Validate(); err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+
+		err = entry.ValidateObjectClass(m)
+		if tc.ExpectedCode == 0 {
+			if err != nil {
+				t.Errorf("Unexpected error on %d: %+v", i, err)
+			}
+			continue
+		}
+		ldapErr, ok := err.(*LDAPError)
+		if !ok || ldapErr.Code != tc.ExpectedCode {
+			t.Errorf("Unexpected error on %d:\n%d expected, got %v", i, tc.ExpectedCode, err)
+		}
+	}
+}
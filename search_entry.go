@@ -1,6 +1,7 @@
 package main
 
 type SearchEntry struct {
+	dbEntryID  int64
 	dn         *DN
 	attributes map[string][]string
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	_ "database/sql"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -21,32 +23,65 @@ import (
 
 	_ "github.com/lib/pq"
 	ldap "github.com/openstandia/ldapserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	schemaMap SchemaMap
-	mapper    *Mapper
+	schemaMap      SchemaMap
+	objectClassMap ObjectClassMap
+	mapper         *Mapper
 )
 
 type ServerConfig struct {
-	DBHostName        string
-	DBPort            int
-	DBName            string
-	DBSchema          string
-	DBUser            string
-	DBPassword        string
-	DBMaxOpenConns    int
-	DBMaxIdleConns    int
-	Suffix            string
-	RootDN            string
-	RootPW            string
-	PassThroughConfig *PassThroughConfig
-	BindAddress       string
-	LogLevel          string
-	PProfServer       string
-	GoMaxProcs        int
-	MigrationEnabled  bool
-	QueryTranslator   string
+	DBHostName              string
+	DBPort                  int
+	DBName                  string
+	DBSchema                string
+	DBUser                  string
+	DBPassword              string
+	DBMaxOpenConns          int
+	DBMaxIdleConns          int
+	DNCacheSize             int
+	DNCacheTTL              int
+	StmtCacheSize           int
+	DBRetryMaxAttempts      int
+	DBRetryBaseDelay        int
+	DBHealthCheckInterval   int
+	DBHealthCheckMaxBackoff int
+	DBIsolationLevel        string
+	HealthServer            string
+	MetricsServer           string
+	Suffix                  string
+	RootDN                  string
+	RootPW                  string
+	PassThroughConfig       *PassThroughConfig
+	BindAddress             string
+	LogLevel                string
+	RepoLogLevel            string
+	LogRedactAttrs          string
+	PProfServer             string
+	GoMaxProcs              int
+	MigrationEnabled        bool
+	SchemaCheckEnabled      bool
+	QueryTranslator         string
+	IndexedAttrs            string
+	PasswordHashScheme      string
+	PasswordBcryptCost      int
+	PasswordArgon2Time      int
+	PasswordArgon2Memory    int
+	PasswordArgon2Threads   int
+	PasswordPBKDF2Iter      int
+	PasswordHistory         int
+	PasswordMinAge          int
+	PasswordMustChange      bool
+	ChangelogRetention      int
+	SoftDelete              bool
+	SoftDeleteRetention     int
+	RefintMode              string
+	RefintAttrs             string
+	NormalizationRules      string
+	CountEstimateThreshold  int
 }
 
 type Server struct {
@@ -56,6 +91,10 @@ type Server struct {
 	suffixOrig []string
 	suffixNorm []string
 	repo       *Repository
+	cookieKey  []byte
+
+	// The DN attributes maintained by the referential integrity in addition to member and uniqueMember
+	refintAttrs []*Schema
 }
 
 func NewServer(c *ServerConfig) *Server {
@@ -73,10 +112,17 @@ func NewServer(c *ServerConfig) *Server {
 		sn[i] = strings.ToLower(so[i])
 	}
 
+	// The key for signing paged results cookies, they are valid only while the server is running
+	cookieKey := make([]byte, 32)
+	if _, err := rand.Read(cookieKey); err != nil {
+		log.Fatalf("Initialize cookie key error: %+v", err)
+	}
+
 	return &Server{
 		config:     c,
 		suffixOrig: sn,
 		suffixNorm: sn,
+		cookieKey:  cookieKey,
 	}
 }
 
@@ -143,9 +189,48 @@ func (s *Server) Start() {
 	}
 	s.repo = repo // TODO Remove bidirectional dependency
 
+	repo.StartHealthCheck(time.Duration(s.config.DBHealthCheckInterval)*time.Second,
+		time.Duration(s.config.DBHealthCheckMaxBackoff)*time.Second)
+	repo.StartChangelogPruning(time.Duration(s.config.ChangelogRetention) * time.Second)
+	repo.StartTombstonePurge(time.Duration(s.config.SoftDeleteRetention) * time.Second)
+
+	// Launch metrics server
+	if s.config.MetricsServer != "" {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		metrics, err := NewPrometheusMetrics(reg)
+		if err != nil {
+			log.Fatalf("alert: Failed to register the metrics: %+v", err)
+		}
+		repo.SetMetrics(metrics)
+
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+			log.Println(http.ListenAndServe(s.config.MetricsServer, mux))
+		}()
+	}
+
+	// Launch health check server
+	if s.config.HealthServer != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/readyz", handleReadiness(s))
+			log.Println(http.ListenAndServe(s.config.HealthServer, mux))
+		}()
+	}
+
 	// Init schema map
 	s.LoadSchema()
 
+	// Create the indexes of the indexed attributes in background not to block serving by the long build.
+	// The searches work without the indexes meanwhile.
+	go func(schemaMap SchemaMap) {
+		if err := repo.CreateIndexes(schemaMap); err != nil {
+			log.Printf("warn: Failed to create indexes, the searches are executed without them. err: %+v", err)
+		}
+	}(schemaMap)
+
 	// Init mapper
 	mapper = NewMapper(s, schemaMap)
 
@@ -155,6 +240,13 @@ func (s *Server) Start() {
 		log.Fatalf("alert: Invalid root-dn format: %s, err: %s", s.config.RootDN, err)
 	}
 
+	if !isSupportedPasswordScheme(s.config.PasswordHashScheme) {
+		log.Fatalf("alert: Invalid password-hash-scheme: %s", s.config.PasswordHashScheme)
+	}
+	if err := validatePasswordHashConfig(s.config); err != nil {
+		log.Fatalf("alert: Invalid password hash parameters: %v", err)
+	}
+
 	//Create a new LDAP Server
 	server := ldap.NewServer()
 	s.internal = server
@@ -164,7 +256,7 @@ func (s *Server) Start() {
 	routes.NotFound(handleNotFound)
 	routes.Abandon(handleAbandon)
 	routes.Bind(NewHandler(s, handleBind))
-	routes.Compare(handleCompare)
+	routes.Compare(NewHandler(s, handleCompare))
 	routes.Add(NewHandler(s, handleAdd))
 	routes.Delete(NewHandler(s, handleDelete))
 	routes.Modify(NewHandler(s, handleModify))
@@ -189,10 +281,10 @@ func (s *Server) Start() {
 		Scope(ldap.SearchRequestScopeBaseObject).
 		Label("Search - root DN")
 
+	// Clients find the schema by (objectClass=subschema) too, the handler evaluates the filter
 	routes.Search(handleSearchSubschema).
 		BaseDn("cn=Subschema").
 		Scope(ldap.SearchRequestScopeBaseObject).
-		Filter("(objectclass=*)").
 		Label("Search - Subschema")
 
 	routes.Search(NewHandler(s, handleSearch)).Label("Search - Generic")
@@ -210,16 +302,20 @@ func (s *Server) Start() {
 
 	// When CTRL+C, SIGINT and SIGTERM signal occurs
 	// Then stop server gracefully
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 	close(ch)
 
 	server.Stop()
+	repo.StopHealthCheck()
+	repo.StopChangelogPruning()
+	repo.StopTombstonePurge()
 }
 
 func (s *Server) LoadSchema() {
 	schemaMap = InitSchemaMap(s)
+	objectClassMap = InitObjectClassMap(mergedSchema)
 	if s, ok := schemaMap.Get("entryUUID"); ok {
 		s.UseIndependentColumn("uuid")
 	}
@@ -239,10 +335,56 @@ func (s *Server) LoadSchema() {
 	if s, ok := schemaMap.Get("memberOf"); ok {
 		s.UseMemberOfTable(true)
 	}
+	if err := s.applyNormalizationRules(schemaMap); err != nil {
+		log.Fatalf("alert: Invalid normalization-rules: %v", err)
+	}
+	for _, v := range strings.Split(s.config.IndexedAttrs, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		as, ok := schemaMap.Get(v)
+		if !ok {
+			log.Printf("warn: Ignore unknown indexed attribute: %s", v)
+			continue
+		}
+		if as.IsIndependentColumn() || as.IsUseMemberTable || as.IsUseMemberOfTable {
+			log.Printf("warn: Ignore indexed attribute which isn't stored in attrs_norm: %s", v)
+			continue
+		}
+		as.UseIndex("gin")
+	}
+	s.refintAttrs = nil
+	for _, v := range strings.Split(s.config.RefintAttrs, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		as, ok := schemaMap.Get(v)
+		if !ok {
+			log.Printf("warn: Ignore unknown referential integrity attribute: %s", v)
+			continue
+		}
+		if as.IsUseMemberTable {
+			// Always maintained
+			continue
+		}
+		if as.IsIndependentColumn() || as.IsUseMemberOfTable ||
+			(as.Equality != "distinguishedNameMatch" && as.Equality != "uniqueMemberMatch") {
+			log.Printf("warn: Ignore referential integrity attribute which isn't DN stored in attrs_norm: %s", v)
+			continue
+		}
+		s.refintAttrs = append(s.refintAttrs, as)
+	}
 }
 
 func (s *Server) Stop() {
 	s.internal.Stop()
+	if s.repo != nil {
+		s.repo.StopHealthCheck()
+		s.repo.StopChangelogPruning()
+		s.repo.StopTombstonePurge()
+	}
 }
 
 func (s *Server) SuffixOrigStr() string {
@@ -259,10 +401,63 @@ func (s *Server) SuffixNorm() []string {
 
 func NewHandler(s *Server, handler func(s *Server, w ldap.ResponseWriter, r *ldap.Message)) func(w ldap.ResponseWriter, r *ldap.Message) {
 	return func(w ldap.ResponseWriter, r *ldap.Message) {
+		if !s.Repo().Healthy() {
+			responseUnavailable(w, r)
+			return
+		}
+		// The user must change the password after it's reset, other operations are rejected
+		if isPasswordResetRequired(r) && r.ProtocolOpType() != ldap.ApplicationBindRequest &&
+			r.ProtocolOpType() != ldap.ApplicationModifyRequest {
+			responseResult(w, r, ldap.LDAPResultInsufficientAccessRights, passwordResetRequiredMsg)
+			return
+		}
 		handler(s, w, r)
 	}
 }
 
+// responseUnavailable returns unavailable with the response type of the request.
+func responseUnavailable(w ldap.ResponseWriter, r *ldap.Message) {
+	responseResult(w, r, ldap.LDAPResultUnavailable, "")
+}
+
+// responseResult returns the result code and the diagnostic message with the response type of the request.
+func responseResult(w ldap.ResponseWriter, r *ldap.Message, code int, msg string) {
+	switch r.ProtocolOpType() {
+	case ldap.ApplicationBindRequest:
+		res := ldap.NewBindResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationSearchRequest:
+		res := ldap.NewSearchResultDoneResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationAddRequest:
+		res := ldap.NewAddResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationDelRequest:
+		res := ldap.NewDeleteResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationModifyRequest:
+		res := ldap.NewModifyResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationModifyDNRequest:
+		res := ldap.NewModifyDNResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	case ldap.ApplicationCompareRequest:
+		res := ldap.NewCompareResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	default:
+		res := ldap.NewResponse(code)
+		res.SetDiagnosticMessage(msg)
+		w.Write(res)
+	}
+}
+
 func handleNotFound(w ldap.ResponseWriter, r *ldap.Message) {
 	switch r.ProtocolOpType() {
 	case ldap.ApplicationBindRequest:
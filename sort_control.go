@@ -0,0 +1,246 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/openstandia/goldap/message"
+	ldap "github.com/openstandia/ldapserver"
+	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// https://tools.ietf.org/html/rfc2891
+const (
+	sortRequestControlOID  = "1.2.840.113556.1.4.473"
+	sortResponseControlOID = "1.2.840.113556.1.4.474"
+)
+
+type sortValueKind int
+
+const (
+	sortByNorm sortValueKind = iota
+	sortByNormIgnoreCase
+	sortByOrig
+	sortByNumeric
+	sortByNumericString
+)
+
+// sortMatchingRules are the supported matching rules for sorting, keyed by the lower name and the OID.
+var sortMatchingRules = map[string]sortValueKind{}
+
+func init() {
+	for _, v := range []struct {
+		name string
+		oid  string
+		kind sortValueKind
+	}{
+		{"caseIgnoreMatch", "2.5.13.2", sortByNormIgnoreCase},
+		{"caseIgnoreOrderingMatch", "2.5.13.3", sortByNormIgnoreCase},
+		{"caseExactMatch", "2.5.13.5", sortByOrig},
+		{"caseExactOrderingMatch", "2.5.13.6", sortByOrig},
+		{"numericStringOrderingMatch", "2.5.13.9", sortByNumericString},
+		{"integerMatch", "2.5.13.14", sortByNumeric},
+		{"integerOrderingMatch", "2.5.13.15", sortByNumeric},
+		{"octetStringOrderingMatch", "2.5.13.18", sortByOrig},
+		{"generalizedTimeOrderingMatch", "2.5.13.28", sortByNorm},
+	} {
+		sortMatchingRules[strings.ToLower(v.name)] = v.kind
+		sortMatchingRules[v.oid] = v.kind
+	}
+}
+
+// SortKey is a key of the server side sorting request control.
+type SortKey struct {
+	AttributeType string
+	OrderingRule  string
+	Reverse       bool
+	schema        *Schema
+	kind          sortValueKind
+}
+
+// SortKeyError is returned when the sort keys can't be used for sorting.
+// Code is the sortResult code for the response control.
+type SortKeyError struct {
+	Code          int
+	AttributeType string
+	Msg           string
+}
+
+func (e *SortKeyError) Error() string {
+	return e.Msg
+}
+
+// getSortControl returns the sort request control of the message if it exists.
+func getSortControl(m *ldap.Message) (*message.Control, bool) {
+	if m.Controls() == nil {
+		return nil, false
+	}
+	for _, con := range *m.Controls() {
+		if string(con.ControlType()) == sortRequestControlOID {
+			c := con
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// parseSortKeys parses the value of the sort request control.
+//
+//   SortKeyList ::= SEQUENCE OF SEQUENCE {
+//      attributeType   AttributeDescription,
+//      orderingRule    [0] MatchingRuleId OPTIONAL,
+//      reverseOrder    [1] BOOLEAN DEFAULT FALSE }
+func parseSortKeys(value string) ([]*SortKey, error) {
+	packet, err := ber.DecodePacketErr([]byte(value))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to decode sort control value. err: %w", err)
+	}
+	if len(packet.Children) == 0 {
+		return nil, xerrors.Errorf("Empty sort key list")
+	}
+
+	keys := make([]*SortKey, len(packet.Children))
+	for i, child := range packet.Children {
+		if len(child.Children) == 0 {
+			return nil, xerrors.Errorf("Invalid sort key at %d", i)
+		}
+		key := &SortKey{
+			AttributeType: child.Children[0].Data.String(),
+		}
+		for _, v := range child.Children[1:] {
+			if v.ClassType != ber.ClassContext {
+				return nil, xerrors.Errorf("Invalid sort key element at %d", i)
+			}
+			switch v.Tag {
+			case 0:
+				key.OrderingRule = v.Data.String()
+			case 1:
+				key.Reverse = len(v.Data.Bytes()) > 0 && v.Data.Bytes()[0] != 0
+			default:
+				return nil, xerrors.Errorf("Invalid sort key tag %d at %d", v.Tag, i)
+			}
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// resolveSortKeys resolves the attribute types and the matching rules of the sort keys.
+// The ordering rule of the attribute is used if the key doesn't have it.
+func resolveSortKeys(schemaMap SchemaMap, keys []*SortKey) error {
+	for _, key := range keys {
+		s, ok := schemaMap.Get(key.AttributeType)
+		if !ok {
+			return &SortKeyError{
+				Code:          ldap.LDAPResultNoSuchAttribute,
+				AttributeType: key.AttributeType,
+				Msg:           "unknown sort attribute: " + key.AttributeType,
+			}
+		}
+		key.schema = s
+
+		rule := key.OrderingRule
+		if rule == "" {
+			rule = s.Ordering
+			if rule == "" {
+				rule = s.Equality
+			}
+			// Fall back to the normalized value for the attribute without known rules
+			key.kind = sortMatchingRules[strings.ToLower(rule)]
+			continue
+		}
+
+		kind, ok := sortMatchingRules[strings.ToLower(rule)]
+		if !ok {
+			return &SortKeyError{
+				Code:          ldap.LDAPResultUnwillingToPerform,
+				AttributeType: key.AttributeType,
+				Msg:           "unsupported ordering rule: " + rule,
+			}
+		}
+		key.kind = kind
+	}
+	return nil
+}
+
+// sortKeysToOrderBy returns the ORDER BY expressions for the sort keys and sets the params.
+// Multi-valued attribute is sorted by the least value, or the greatest one if reversed.
+// The entry without the attribute sorts last.
+//
+// Known limitation: the sorted entries are paged by OFFSET, not by the keyset like the unsorted ones,
+// since VLV needs the offset and the keys can be mixed with the reverse order.
+// So the deep pages of the sorted paged results and VLV cost the scan of all the previous entries.
+func sortKeysToOrderBy(keys []*SortKey, params map[string]interface{}) string {
+	exprs := make([]string, 0, len(keys)+1)
+	for i, key := range keys {
+		paramKey := "sort_attr_" + strconv.Itoa(i)
+		params[paramKey] = key.schema.Name
+
+		col := "e.attrs_norm"
+		if key.kind == sortByOrig {
+			col = "e.attrs_orig"
+		}
+
+		var value string
+		switch key.kind {
+		case sortByNormIgnoreCase:
+			value = `lower(s.v) COLLATE "C"`
+		case sortByNumeric:
+			value = `s.v::::numeric`
+		case sortByNumericString:
+			// Compare as the number not to sort "10" before "9", the invalid value sorts last
+			value = `CASE WHEN s.v ~ '^[0-9]+$' THEN s.v::::numeric END`
+		default:
+			value = `s.v COLLATE "C"`
+		}
+
+		agg, order := "min", "ASC"
+		if key.Reverse {
+			agg, order = "max", "DESC"
+		}
+
+		exprs = append(exprs, "(SELECT "+agg+"("+value+") FROM jsonb_array_elements_text("+col+"->:"+paramKey+") AS s(v)) "+order+" NULLS LAST")
+	}
+	// Make the order stable for paging
+	exprs = append(exprs, "e.id")
+
+	return strings.Join(exprs, ", ")
+}
+
+// newSortResultControl returns the sort response control.
+//
+//   SortResult ::= SEQUENCE {
+//      sortResult  ENUMERATED,
+//      attributeType [0] AttributeDescription OPTIONAL }
+func newSortResultControl(code int, attr string) (message.Control, error) {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortResult")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "sortResult"))
+	if attr != "" {
+		value.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, attr, "attributeType"))
+	}
+
+	return newResponseControl(sortResponseControlOID, value.Bytes())
+}
+
+// newResponseControl builds the control by decoding the dummy message
+// since goldap doesn't provide the constructor for arbitrary control.
+func newResponseControl(oid string, value []byte) (message.Control, error) {
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, oid, "controlType"))
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value), "controlValue"))
+
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	controls.AppendChild(control)
+
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAPMessage")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(1), "messageID"))
+	packet.AppendChild(ber.Encode(ber.ClassApplication, ber.TypePrimitive, ldap.ApplicationUnbindRequest, nil, "UnbindRequest"))
+	packet.AppendChild(controls)
+
+	m, err := message.ReadLDAPMessage(message.NewBytes(0, packet.Bytes()))
+	if err != nil {
+		return message.Control{}, xerrors.Errorf("Failed to build control: %s, err: %w", oid, err)
+	}
+	return (*m.Controls())[0], nil
+}
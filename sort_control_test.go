@@ -0,0 +1,138 @@
+// +build !integration
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ldap "github.com/openstandia/ldapserver"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+func encodeSortKeys(keys []*SortKey) string {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeyList")
+	for _, k := range keys {
+		key := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKey")
+		key.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k.AttributeType, "attributeType"))
+		if k.OrderingRule != "" {
+			key.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, k.OrderingRule, "orderingRule"))
+		}
+		if k.Reverse {
+			key.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, true, "reverseOrder"))
+		}
+		packet.AppendChild(key)
+	}
+	return string(packet.Bytes())
+}
+
+func TestParseSortKeys(t *testing.T) {
+	expected := []*SortKey{
+		{AttributeType: "sn"},
+		{AttributeType: "cn", OrderingRule: "caseIgnoreOrderingMatch", Reverse: true},
+	}
+
+	keys, err := parseSortKeys(encodeSortKeys(expected))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected sort keys:\n%v expected, got %v", expected, keys)
+	}
+
+	if _, err := parseSortKeys("invalid"); err == nil {
+		t.Errorf("Expected error for invalid value, but got nil")
+	}
+}
+
+func TestResolveSortKeys(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+
+	testcases := []struct {
+		Key          *SortKey
+		ExpectedCode int
+		ExpectedKind sortValueKind
+	}{
+		{&SortKey{AttributeType: "cn"}, 0, sortByNormIgnoreCase},
+		{&SortKey{AttributeType: "uidNumber"}, 0, sortByNumeric},
+		{&SortKey{AttributeType: "cn", OrderingRule: "caseExactOrderingMatch"}, 0, sortByOrig},
+		{&SortKey{AttributeType: "cn", OrderingRule: "2.5.13.3"}, 0, sortByNormIgnoreCase},
+		{&SortKey{AttributeType: "employeeNumber", OrderingRule: "numericStringOrderingMatch"}, 0, sortByNumericString},
+		{&SortKey{AttributeType: "cn", OrderingRule: "unknownMatch"}, ldap.LDAPResultUnwillingToPerform, 0},
+		{&SortKey{AttributeType: "unknownAttr"}, ldap.LDAPResultNoSuchAttribute, 0},
+	}
+
+	for i, tc := range testcases {
+		err := resolveSortKeys(schemaMap, []*SortKey{tc.Key})
+		if tc.ExpectedCode != 0 {
+			sortErr, ok := err.(*SortKeyError)
+			if !ok || sortErr.Code != tc.ExpectedCode {
+				t.Errorf("Unexpected error on %d:\n%d expected, got %v", i, tc.ExpectedCode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error on %d: %+v", i, err)
+			continue
+		}
+		if tc.Key.kind != tc.ExpectedKind {
+			t.Errorf("Unexpected kind on %d:\n%d expected, got %d", i, tc.ExpectedKind, tc.Key.kind)
+		}
+	}
+}
+
+func TestSortKeysToOrderBy(t *testing.T) {
+	server := NewServer(&ServerConfig{
+		Suffix: "dc=example,dc=com",
+	})
+	schemaMap = InitSchemaMap(server)
+
+	keys := []*SortKey{
+		{AttributeType: "SN"},
+		{AttributeType: "uidNumber", Reverse: true},
+		{AttributeType: "employeeNumber", OrderingRule: "numericStringOrderingMatch"},
+	}
+	if err := resolveSortKeys(schemaMap, keys); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	params := map[string]interface{}{}
+	orderBy := sortKeysToOrderBy(keys, params)
+
+	expected := `(SELECT min(lower(s.v) COLLATE "C") FROM jsonb_array_elements_text(e.attrs_norm->:sort_attr_0) AS s(v)) ASC NULLS LAST, ` +
+		`(SELECT max(s.v::::numeric) FROM jsonb_array_elements_text(e.attrs_norm->:sort_attr_1) AS s(v)) DESC NULLS LAST, ` +
+		`(SELECT min(CASE WHEN s.v ~ '^[0-9]+$' THEN s.v::::numeric END) FROM jsonb_array_elements_text(e.attrs_norm->:sort_attr_2) AS s(v)) ASC NULLS LAST, e.id`
+	if orderBy != expected {
+		t.Errorf("Unexpected order by:\n%s expected, got %s", expected, orderBy)
+	}
+	if !reflect.DeepEqual(params, map[string]interface{}{"sort_attr_0": "sn", "sort_attr_1": "uidNumber", "sort_attr_2": "employeeNumber"}) {
+		t.Errorf("Unexpected params: %v", params)
+	}
+}
+
+func TestNewSortResultControl(t *testing.T) {
+	control, err := newSortResultControl(ldap.LDAPResultUnwillingToPerform, "cn")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if string(control.ControlType()) != sortResponseControlOID {
+		t.Errorf("Unexpected control type: %s", control.ControlType())
+	}
+
+	packet, err := ber.DecodePacketErr([]byte(*control.ControlValue()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if len(packet.Children) != 2 {
+		t.Fatalf("Unexpected sort result: %v", packet.Children)
+	}
+	if code := packet.Children[0].Value.(int64); code != ldap.LDAPResultUnwillingToPerform {
+		t.Errorf("Unexpected sort result code: %d", code)
+	}
+	if attr := packet.Children[1].Data.String(); attr != "cn" {
+		t.Errorf("Unexpected sort result attribute: %s", attr)
+	}
+}
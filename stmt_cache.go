@@ -0,0 +1,244 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"log"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Exposed via /debug/vars when the pprof server is enabled.
+var stmtCacheMetrics = expvar.NewMap("stmtCache")
+
+// StmtCache is a LRU cache of the prepared statements for the generated queries.
+// The statements are prepared on the DB, not on the transaction. Since the prepared statement is
+// session-scoped in PostgreSQL, database/sql prepares it again on the connection of the transaction
+// when it's bound by tx.NamedStmt unless it's already prepared on that connection, and it forgets
+// the closed connections. So the statement is never executed on the backend which doesn't have it.
+// The evicted statement is closed after all users release it. Size 0 disables the cache,
+// the statement is closed soon after it's released.
+//
+// Preparing on the DB needs a connection of the pool. In the transaction, which already holds one,
+// it could wait forever when all the connections are held by the transactions waiting the same.
+// So the cache miss in the transaction is prepared on the connection of the transaction, and the
+// statement for the cache is prepared on the DB in background.
+type StmtCache struct {
+	mu        sync.Mutex
+	db        *sqlx.DB
+	size      int
+	ll        *list.List
+	items     map[string]*list.Element
+	preparing map[string]struct{}
+}
+
+type stmtCacheItem struct {
+	key     string
+	stmt    *sqlx.NamedStmt
+	refs    int
+	evicted bool
+}
+
+func NewStmtCache(db *sqlx.DB, size int) *StmtCache {
+	if size < 0 {
+		size = 0
+	}
+	return &StmtCache{
+		db:        db,
+		size:      size,
+		ll:        list.New(),
+		items:     make(map[string]*list.Element, size),
+		preparing: map[string]struct{}{},
+	}
+}
+
+// PrepareNamedContext returns the cached statement keyed by the query, or prepares and caches it.
+// The statement is bound to tx if it isn't nil.
+// The caller must call the returned release func after using the statement, including the rows.
+func (c *StmtCache) PrepareNamedContext(ctx context.Context, tx *sqlx.Tx, query string) (*sqlx.NamedStmt, func(), error) {
+	return c.Prepare(ctx, tx, query, func() (string, error) {
+		return query, nil
+	})
+}
+
+// Prepare is same as PrepareNamedContext, but the query is built only when it isn't cached.
+// The key must identify the query.
+func (c *StmtCache) Prepare(ctx context.Context, tx *sqlx.Tx, key string, build func() (string, error)) (*sqlx.NamedStmt, func(), error) {
+	if stmt, release, ok := c.acquire(key); ok {
+		stmtCacheMetrics.Add("hits", 1)
+		return namedStmtContext(ctx, tx, stmt), release, nil
+	}
+	stmtCacheMetrics.Add("misses", 1)
+
+	q, err := build()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tx != nil {
+		stmt, err := tx.PrepareNamedContext(ctx, q)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.prepareInBackground(key, q)
+
+		// The statement of the transaction is closed on commit or rollback
+		return stmt, func() {}, nil
+	}
+
+	// Prepare without holding the lock, the concurrent preparing of the same query is resolved when putting
+	stmt, err := c.db.PrepareNamedContext(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item := c.put(key, stmt, 1)
+	return item.stmt, c.releaseFunc(item), nil
+}
+
+// prepareInBackground prepares the query on the DB and caches it if no one is preparing it.
+func (c *StmtCache) prepareInBackground(key, q string) {
+	if c.size == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if _, ok := c.preparing[key]; ok {
+		c.mu.Unlock()
+		return
+	}
+	c.preparing[key] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.preparing, key)
+			c.mu.Unlock()
+		}()
+
+		stmt, err := c.db.PrepareNamedContext(context.Background(), q)
+		if err != nil {
+			log.Printf("warn: Failed to prepare the statement for the cache. err: %v", err)
+			return
+		}
+		c.put(key, stmt, 0)
+	}()
+}
+
+// put caches the statement with the references and returns the cached item.
+// If the other goroutine already cached the same key, the statement is closed and the cached item is returned.
+func (c *StmtCache) put(key string, stmt *sqlx.NamedStmt, refs int) *stmtCacheItem {
+	c.mu.Lock()
+
+	if e, ok := c.items[key]; ok {
+		// Discard ours since the other goroutine cached it while preparing
+		item := e.Value.(*stmtCacheItem)
+		item.refs += refs
+		c.ll.MoveToFront(e)
+		c.mu.Unlock()
+
+		closeStmt(stmt)
+		return item
+	}
+
+	item := &stmtCacheItem{
+		key:  key,
+		stmt: stmt,
+		refs: refs,
+	}
+	c.items[key] = c.ll.PushFront(item)
+
+	var evicted []*sqlx.NamedStmt
+	for c.ll.Len() > c.size {
+		if s := c.evict(c.ll.Back()); s != nil {
+			evicted = append(evicted, s)
+		}
+		stmtCacheMetrics.Add("evictions", 1)
+	}
+
+	c.mu.Unlock()
+
+	for _, s := range evicted {
+		closeStmt(s)
+	}
+	return item
+}
+
+// Len returns the number of the cached statements.
+func (c *StmtCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *StmtCache) acquire(key string) (*sqlx.NamedStmt, func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, nil, false
+	}
+	item := e.Value.(*stmtCacheItem)
+	item.refs++
+	c.ll.MoveToFront(e)
+
+	return item.stmt, c.releaseFunc(item), true
+}
+
+func (c *StmtCache) releaseFunc(item *stmtCacheItem) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			item.refs--
+			closable := item.evicted && item.refs == 0
+			c.mu.Unlock()
+
+			if closable {
+				closeStmt(item.stmt)
+			}
+		})
+	}
+}
+
+// evict removes the element and returns the statement if it can be closed now.
+func (c *StmtCache) evict(e *list.Element) *sqlx.NamedStmt {
+	item := e.Value.(*stmtCacheItem)
+	c.ll.Remove(e)
+	delete(c.items, item.key)
+	item.evicted = true
+
+	if item.refs == 0 {
+		return item.stmt
+	}
+	return nil
+}
+
+func closeStmt(stmt *sqlx.NamedStmt) {
+	if err := stmt.Close(); err != nil {
+		log.Printf("warn: Failed to close the prepared statement. err: %v", err)
+	}
+}
+
+func stmtCacheHitRatio() interface{} {
+	var hits, misses int64
+	if v, ok := stmtCacheMetrics.Get("hits").(*expvar.Int); ok {
+		hits = v.Value()
+	}
+	if v, ok := stmtCacheMetrics.Get("misses").(*expvar.Int); ok {
+		misses = v.Value()
+	}
+	if hits+misses == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func init() {
+	stmtCacheMetrics.Set("hitRatio", expvar.Func(stmtCacheHitRatio))
+}
@@ -0,0 +1,176 @@
+// +build !integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/xerrors"
+)
+
+// The stub driver counts preparing and closing of the statements.
+type stubStmtDriver struct {
+	prepared int32
+	closed   int32
+}
+
+func (d *stubStmtDriver) Connect(ctx context.Context) (driver.Conn, error) { return &stubStmtConn{d}, nil }
+func (d *stubStmtDriver) Driver() driver.Driver                             { return nil }
+
+type stubStmtConn struct {
+	d *stubStmtDriver
+}
+
+func (c *stubStmtConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt32(&c.d.prepared, 1)
+	return &stubStmt{c.d}, nil
+}
+func (c *stubStmtConn) Close() error              { return nil }
+func (c *stubStmtConn) Begin() (driver.Tx, error) { return stubTx{}, nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+	d *stubStmtDriver
+}
+
+func (s *stubStmt) Close() error {
+	atomic.AddInt32(&s.d.closed, 1)
+	return nil
+}
+func (s *stubStmt) NumInput() int { return -1 }
+func (s *stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, xerrors.New("not supported")
+}
+func (s *stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, xerrors.New("not supported")
+}
+
+func TestStmtCache(t *testing.T) {
+	d := &stubStmtDriver{}
+	db := sqlx.NewDb(sql.OpenDB(d), "postgres")
+	defer db.Close()
+
+	ctx := context.Background()
+	prepare := func(c *StmtCache, q string) (*sqlx.NamedStmt, func()) {
+		stmt, release, err := c.PrepareNamedContext(ctx, nil, q)
+		if err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		return stmt, release
+	}
+	assertCount := func(prepared, closed int32) {
+		t.Helper()
+		if p := atomic.LoadInt32(&d.prepared); p != prepared {
+			t.Errorf("Unexpected prepared count. want: %d, got: %d", prepared, p)
+		}
+		if c := atomic.LoadInt32(&d.closed); c != closed {
+			t.Errorf("Unexpected closed count. want: %d, got: %d", closed, c)
+		}
+	}
+
+	c := NewStmtCache(db, 2)
+
+	// Reuse the cached stmt
+	s1, release1 := prepare(c, "SELECT 1")
+	s2, release2 := prepare(c, "SELECT 1")
+	if s1 != s2 {
+		t.Errorf("Expected the cached stmt")
+	}
+	release1()
+	release2()
+	assertCount(1, 0)
+
+	// The least recently used stmt is evicted and closed
+	_, release := prepare(c, "SELECT 2")
+	release()
+	_, release = prepare(c, "SELECT 3")
+	release()
+	if c.Len() != 2 {
+		t.Errorf("Unexpected cache size. want: 2, got: %d", c.Len())
+	}
+	assertCount(3, 1)
+
+	// The evicted stmt is closed after releasing it
+	_, release2 = prepare(c, "SELECT 2")
+	_, release = prepare(c, "SELECT 4")
+	release()
+	_, release = prepare(c, "SELECT 5")
+	release()
+	assertCount(5, 2)
+	release2()
+	release2()
+	assertCount(5, 3)
+
+	// Size 0 disables the cache
+	c = NewStmtCache(db, 0)
+	_, release = prepare(c, "SELECT 1")
+	if c.Len() != 0 {
+		t.Errorf("Unexpected cache size. want: 0, got: %d", c.Len())
+	}
+	assertCount(6, 3)
+	release()
+	assertCount(6, 4)
+}
+
+func TestStmtCacheInTx(t *testing.T) {
+	d := &stubStmtDriver{}
+	db := sqlx.NewDb(sql.OpenDB(d), "postgres")
+	defer db.Close()
+
+	// The transaction holds the only connection of the pool
+	db.SetMaxOpenConns(1)
+
+	c := NewStmtCache(db, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	// The cache miss is prepared on the connection of the transaction without waiting for the pool
+	_, release, err := c.PrepareNamedContext(ctx, tx, "SELECT 1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	release()
+	if c.Len() != 0 {
+		t.Errorf("Unexpected cache size. want: 0, got: %d", c.Len())
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	// The statement for the cache is prepared in background after the connection is released
+	for i := 0; i < 100 && c.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("Unexpected cache size. want: 1, got: %d", c.Len())
+	}
+
+	tx, err = db.Beginx()
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	defer tx.Rollback()
+
+	_, release, err = c.PrepareNamedContext(ctx, tx, "SELECT 1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	release()
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/jsimonetti/pwscheme/ssha512"
 	_ "github.com/lib/pq"
 	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
 )
 
 func IntegrationTestRunner(m *testing.M) int {
@@ -206,7 +207,7 @@ type ModifyDN struct {
 	delOld        bool
 	newSup        string
 	moveContainer bool
-	assert        *AssertRename
+	assert        RenameAssert
 }
 
 type Delete struct {
@@ -250,6 +251,167 @@ func (s Search) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
 	return conn, nil
 }
 
+type SearchWithPaging struct {
+	baseDN   string
+	filter   string
+	scope    int
+	attrs    []string
+	pageSize uint32
+	assert   *AssertEntries
+}
+
+func (s SearchWithPaging) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	search := ldap.NewSearchRequest(
+		s.baseDN,
+		s.scope,
+		ldap.NeverDerefAliases,
+		0, // Size Limit
+		0, // Time Limit
+		false,
+		"("+s.filter+")", // The filter to apply
+		s.attrs,          // A list attributes to retrieve
+		nil,
+	)
+	sr, err := conn.SearchWithPaging(search, s.pageSize)
+	if err != nil {
+		return conn, err
+	}
+
+	if s.assert != nil {
+		err = s.assert.AssertEntries(conn, err, sr)
+		if err != nil {
+			return conn, err
+		}
+	}
+
+	return conn, nil
+}
+
+type SearchWithSort struct {
+	baseDN   string
+	filter   string
+	scope    int
+	sortKeys []string // "-" prefix means reverse order, ":<rule>" suffix means the ordering rule
+	expect   []string // rdn in order, under the baseDN
+}
+
+func (s SearchWithSort) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	search := ldap.NewSearchRequest(
+		s.baseDN,
+		s.scope,
+		ldap.NeverDerefAliases,
+		0, // Size Limit
+		0, // Time Limit
+		false,
+		"("+s.filter+")", // The filter to apply
+		nil,              // A list attributes to retrieve
+		[]ldap.Control{sortControl(s.sortKeys...)},
+	)
+	sr, err := conn.Search(search)
+	if err != nil {
+		return conn, err
+	}
+
+	if len(sr.Entries) != len(s.expect) {
+		return conn, xerrors.Errorf("Unexpected entry size. want = [%d] got = %d", len(s.expect), len(sr.Entries))
+	}
+	for i, v := range sr.Entries {
+		want := strings.ToLower(s.expect[i] + "," + s.baseDN)
+		if strings.ToLower(v.DN) != want {
+			return conn, xerrors.Errorf("Unexpected sorted entry at %d. want = %s got = %s", i, want, v.DN)
+		}
+	}
+
+	return conn, nil
+}
+
+func sortControl(keys ...string) ldap.Control {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeyList")
+	for _, k := range keys {
+		key := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKey")
+		attr := strings.SplitN(strings.TrimPrefix(k, "-"), ":", 2)
+		key.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attr[0], "attributeType"))
+		if len(attr) == 2 {
+			key.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, attr[1], "orderingRule"))
+		}
+		if strings.HasPrefix(k, "-") {
+			key.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, true, "reverseOrder"))
+		}
+		packet.AppendChild(key)
+	}
+	return ldap.NewControlString("1.2.840.113556.1.4.473", true, string(packet.Bytes()))
+}
+
+// SearchWithVLV fetches the window of the sorted entries by the virtual list view control.
+type SearchWithVLV struct {
+	baseDN       string
+	filter       string
+	sortKeys     []string
+	before       int64
+	after        int64
+	offset       int64
+	contentCount int64
+	expect       []string // rdn in order, under the baseDN
+	expectTarget int64
+	expectCount  int64
+}
+
+func (s SearchWithVLV) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	search := ldap.NewSearchRequest(
+		s.baseDN,
+		ldap.ScopeSingleLevel,
+		ldap.NeverDerefAliases,
+		0, // Size Limit
+		0, // Time Limit
+		false,
+		"("+s.filter+")", // The filter to apply
+		nil,              // A list attributes to retrieve
+		[]ldap.Control{sortControl(s.sortKeys...), vlvControl(s.before, s.after, s.offset, s.contentCount)},
+	)
+	sr, err := conn.Search(search)
+	if err != nil {
+		return conn, err
+	}
+
+	if len(sr.Entries) != len(s.expect) {
+		return conn, xerrors.Errorf("Unexpected entry size. want = [%d] got = %d", len(s.expect), len(sr.Entries))
+	}
+	for i, v := range sr.Entries {
+		want := strings.ToLower(s.expect[i] + "," + s.baseDN)
+		if strings.ToLower(v.DN) != want {
+			return conn, xerrors.Errorf("Unexpected entry at %d. want = %s got = %s", i, want, v.DN)
+		}
+	}
+
+	control, ok := ldap.FindControl(sr.Controls, "2.16.840.1.113730.3.4.10").(*ldap.ControlString)
+	if !ok {
+		return conn, xerrors.Errorf("No VLV response control")
+	}
+	packet := ber.DecodePacket([]byte(control.ControlValue))
+	if len(packet.Children) < 3 {
+		return conn, xerrors.Errorf("Invalid VLV response control")
+	}
+	if target := packet.Children[0].Value.(int64); target != s.expectTarget {
+		return conn, xerrors.Errorf("Unexpected target position. want = %d got = %d", s.expectTarget, target)
+	}
+	if count := packet.Children[1].Value.(int64); count != s.expectCount {
+		return conn, xerrors.Errorf("Unexpected content count. want = %d got = %d", s.expectCount, count)
+	}
+
+	return conn, nil
+}
+
+func vlvControl(before, after, offset, contentCount int64) ldap.Control {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewRequest")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, before, "beforeCount"))
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, after, "afterCount"))
+	target := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "byOffset")
+	target.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, offset, "offset"))
+	target.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, contentCount, "contentCount"))
+	packet.AppendChild(target)
+	return ldap.NewControlString("2.16.840.1.113730.3.4.9", true, string(packet.Bytes()))
+}
+
 func resolveDN(rdn, baseDN string) string {
 	dn := rdn
 	if baseDN != "" {
@@ -315,6 +477,80 @@ func (m ModifyReplace) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
 	return conn, err
 }
 
+// ModifyReplaceWithRev replaces the attributes only if the entryRev matches.
+type ModifyReplaceWithRev struct {
+	rdn    string
+	baseDN string
+	rev    string
+	attrs  map[string][]string
+	assert Assert
+}
+
+func (m ModifyReplaceWithRev) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	dn := resolveDN(m.rdn, m.baseDN)
+
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Delete("entryRev", []string{m.rev})
+	for k, v := range m.attrs {
+		modify.Replace(k, v)
+	}
+
+	log.Printf("info: Exec modify(replace with rev) operation: %v", modify)
+
+	err := conn.Modify(modify)
+
+	if m.assert != nil {
+		err = m.assert.AssertEntry(conn, err, m.rdn, m.baseDN, m.attrs)
+	}
+	return conn, err
+}
+
+// ModifyPassword replaces userPassword.
+type ModifyPassword struct {
+	rdn      string
+	baseDN   string
+	password string
+	assert   *AssertResponse
+}
+
+func (m ModifyPassword) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	dn := resolveDN(m.rdn, m.baseDN)
+
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace("userPassword", []string{m.password})
+
+	log.Printf("info: Exec modify(password) operation: %v", dn)
+
+	err := conn.Modify(modify)
+	err = m.assert.AssertResponse(conn, err)
+	return conn, err
+}
+
+type Compare struct {
+	rdn    string
+	baseDN string
+	attr   string
+	value  string
+	expect bool
+	assert *AssertResponse
+}
+
+func (c Compare) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	dn := resolveDN(c.rdn, c.baseDN)
+
+	log.Printf("info: Exec compare operation: %v, attr: %s", dn, c.attr)
+
+	matched, err := conn.Compare(dn, c.attr, c.value)
+	if err := c.assert.AssertResponse(conn, err); err != nil {
+		return conn, err
+	}
+	if err == nil && matched != c.expect {
+		return conn, xerrors.Errorf("Unexpected compare result. dn: %s, attr: %s, value: %s, want: %v, got: %v",
+			dn, c.attr, c.value, c.expect, matched)
+	}
+	return conn, nil
+}
+
 func (m ModifyDelete) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
 	dn := resolveDN(m.rdn, m.baseDN)
 
@@ -367,6 +603,164 @@ func (d Delete) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
 	return conn, err
 }
 
+type DeleteWithError struct {
+	rdn    string
+	baseDN string
+	expect uint16 // The expected LDAP result code
+}
+
+func (d DeleteWithError) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	dn := resolveDN(d.rdn, d.baseDN)
+
+	log.Printf("info: Exec delete operation expecting error: %v", dn)
+
+	err := conn.Del(ldap.NewDelRequest(dn, nil))
+	if !ldap.IsErrorWithCode(err, d.expect) {
+		return conn, xerrors.Errorf("Unexpected delete result. want: %d got: %w", d.expect, err)
+	}
+	return conn, nil
+}
+
+type DeleteTree struct {
+	rdn    string
+	baseDN string
+	assert *AssertNoEntry
+}
+
+func (d DeleteTree) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	dn := resolveDN(d.rdn, d.baseDN)
+
+	del := ldap.NewDelRequest(dn, []ldap.Control{
+		ldap.NewControlString("1.2.840.113556.1.4.805", true, ""),
+	})
+
+	log.Printf("info: Exec delete tree operation: %v", del)
+
+	err := conn.Del(del)
+
+	if d.assert != nil {
+		err = d.assert.AssertNoEntry(conn, err, d.rdn, d.baseDN)
+	}
+	return conn, err
+}
+
+type Undelete struct {
+	rdn    string
+	baseDN string
+	expect int // The expected LDAP result code, 0 is success
+}
+
+func (u Undelete) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	dn, err := server.NormalizeDN(resolveDN(u.rdn, u.baseDN))
+	if err != nil {
+		return conn, err
+	}
+
+	log.Printf("info: Exec undelete: %v", dn.DNOrigStr())
+
+	err = server.Repo().Undelete(dn)
+	if u.expect == 0 {
+		return conn, err
+	}
+	var ldapErr *LDAPError
+	if !xerrors.As(err, &ldapErr) || ldapErr.Code != u.expect {
+		return conn, xerrors.Errorf("Unexpected undelete result. want: %d got: %w", u.expect, err)
+	}
+	return conn, nil
+}
+
+type Purge struct {
+	olderThan time.Duration
+	expect    int64
+}
+
+func (p Purge) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	log.Printf("info: Exec purge: %v", p.olderThan)
+
+	purged, err := server.Repo().Purge(p.olderThan)
+	if err != nil {
+		return conn, err
+	}
+	if purged != p.expect {
+		return conn, xerrors.Errorf("Unexpected purged count. want: %d, got: %d", p.expect, purged)
+	}
+	return conn, nil
+}
+
+type SetRefintMode struct {
+	mode string
+}
+
+func (s SetRefintMode) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	log.Printf("info: Set refint mode: %s", s.mode)
+
+	server.Repo().refintMode = s.mode
+	return conn, nil
+}
+
+type InsertBatch struct {
+	entries         []Add
+	continueOnError bool
+	// Index of the entries which are expected to fail.
+	// Without continueOnError, non-empty means the whole batch is expected to fail.
+	expectFailed []int
+}
+
+func (b InsertBatch) Run(t *testing.T, conn *ldap.Conn) (*ldap.Conn, error) {
+	entries := make([]*AddEntry, len(b.entries))
+	for i, a := range b.entries {
+		dn, err := NormalizeDN(resolveDN(a.rdn, a.baseDN))
+		if err != nil {
+			return conn, err
+		}
+		entry := NewAddEntry(dn)
+		for k, v := range a.attrs {
+			if err := entry.Add(k, v); err != nil {
+				return conn, err
+			}
+		}
+		if err := entry.Validate(); err != nil {
+			return conn, err
+		}
+		entries[i] = entry
+	}
+
+	log.Printf("info: Exec insert batch: %d entries", len(entries))
+
+	ids, err := server.Repo().InsertBatch(entries, &BatchOption{ContinueOnError: b.continueOnError})
+	if err != nil {
+		if !b.continueOnError {
+			if len(b.expectFailed) == 0 {
+				return conn, xerrors.Errorf("Unexpected error: %w", err)
+			}
+			return conn, nil
+		}
+		var batchErr *BatchError
+		if !xerrors.As(err, &batchErr) {
+			return conn, xerrors.Errorf("Unexpected error: %w", err)
+		}
+		failed := []int{}
+		for i, e := range batchErr.Errors {
+			if e != nil {
+				failed = append(failed, i)
+			}
+		}
+		if !reflect.DeepEqual(failed, b.expectFailed) {
+			return conn, xerrors.Errorf("Unexpected failed entries. want = %v got = %v, err: %w", b.expectFailed, failed, err)
+		}
+		return conn, nil
+	}
+	if len(b.expectFailed) > 0 {
+		return conn, xerrors.Errorf("Unexpected success. want failed = %v", b.expectFailed)
+	}
+	for i, id := range ids {
+		if id == 0 {
+			return conn, xerrors.Errorf("Unexpected id of the entry: %d", i)
+		}
+	}
+	return conn, nil
+}
+
 type AssertResponse struct {
 	expect uint16
 }
@@ -500,6 +894,18 @@ func (s AssertSearchOne) AssertSearch(conn *ldap.Conn, err error) error {
 	return nil
 }
 
+type RenameAssert interface {
+	AssertRename(conn *ldap.Conn, err error, oldRDN, newRDN, baseDN string, delOld bool, newSup string, moveContainer bool) error
+}
+
+func (a AssertLDAPError) AssertRename(conn *ldap.Conn, err error, oldRDN, newRDN, baseDN string, delOld bool, newSup string, moveContainer bool) error {
+	if ldap.IsErrorWithCode(err, a.expectErrorCode) {
+		return nil
+	}
+	return xerrors.Errorf("Unexpected LDAP error response when previous operation. rdn: %s, want: %d  err: %w",
+		oldRDN, a.expectErrorCode, err)
+}
+
 type AssertRename struct {
 }
 
@@ -671,22 +1077,28 @@ var testPGPort int = 35432
 func setupLDAPServer() *Server {
 	go func() {
 		server = NewServer(&ServerConfig{
-			DBHostName:      "localhost",
-			DBPort:          testPGPort,
-			DBName:          "ldap",
-			DBSchema:        "public",
-			DBUser:          "dev",
-			DBPassword:      "dev",
-			DBMaxOpenConns:  2,
-			DBMaxIdleConns:  1,
-			Suffix:          "dc=example,dc=com",
-			RootDN:          "cn=Manager,dc=example,dc=com",
-			RootPW:          "secret",
-			BindAddress:     "127.0.0.1:8389",
-			LogLevel:        "warn",
-			PProfServer:     "127.0.0.1:10000",
-			GoMaxProcs:      0,
-			QueryTranslator: "default",
+			DBHostName:         "localhost",
+			DBPort:             testPGPort,
+			DBName:             "ldap",
+			DBSchema:           "public",
+			DBUser:             "dev",
+			DBPassword:         "dev",
+			DBMaxOpenConns:     2,
+			DBMaxIdleConns:     1,
+			DNCacheSize:        100,
+			DNCacheTTL:         60,
+			DBRetryMaxAttempts: 3,
+			DBRetryBaseDelay:   10,
+			Suffix:             "dc=example,dc=com",
+			RootDN:             "cn=Manager,dc=example,dc=com",
+			RootPW:             "secret",
+			BindAddress:        "127.0.0.1:8389",
+			LogLevel:           "warn",
+			RepoLogLevel:       "warn",
+			LogRedactAttrs:     "userPassword",
+			PProfServer:        "127.0.0.1:10000",
+			GoMaxProcs:         0,
+			QueryTranslator:    "default",
 		})
 		server.Start()
 	}()
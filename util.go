@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	enchex "encoding/hex"
 	"errors"
@@ -58,15 +59,20 @@ func requiredAuthz(m *ldap.Message, operation string, targetDN *DN) bool {
 	return false
 }
 
-func getPageSession(m *ldap.Message) map[string]int32 {
-	session := getSession(m)
-	if pageSession, ok := session["page"]; ok {
-		return pageSession.(map[string]int32)
-	} else {
-		pageSession := map[string]int32{}
-		session["page"] = pageSession
-		return pageSession
+// requiredReadAttrAuthz returns true if the requester can read the attribute of the target entry.
+// userPassword can be read only by the owner or the root DN, others need to verify it by bind.
+func requiredReadAttrAuthz(s *Server, m *ldap.Message, targetDN *DN, attr string) bool {
+	if !requiredAuthz(m, "compare", targetDN) {
+		return false
+	}
+
+	as, ok := schemaMap.Get(attr)
+	if !ok || as.Name != "userPassword" {
+		return true
 	}
+
+	requester := getAuthSession(m)["dn"]
+	return requester.Equal(targetDN) || requester.Equal(s.rootDN)
 }
 
 func isOperationalAttributesRequested(r message.SearchRequest) bool {
@@ -208,51 +214,6 @@ func arrayDiff(a, b []string) []string {
 	return diff
 }
 
-func normalize(s *Schema, value string) (string, error) {
-	switch s.Equality {
-	case "caseExactMatch":
-		return normalizeSpace(value), nil
-	case "caseIgnoreMatch":
-		return strings.ToLower(normalizeSpace(value)), nil
-	case "distinguishedNameMatch":
-		return normalizeDistinguishedName(value)
-	case "caseExactIA5Match":
-		return normalizeSpace(value), nil
-	case "caseIgnoreIA5Match":
-		return strings.ToLower(normalizeSpace(value)), nil
-	case "generalizedTimeMatch":
-		return normalizeGeneralizedTime(value)
-	case "objectIdentifierMatch":
-		return strings.ToLower(value), nil
-	case "numericStringMatch":
-		return removeAllSpace(value), nil
-	case "integerMatch":
-		return value, nil
-	case "UUIDMatch":
-		return normalizeUUID(value)
-	case "uniqueMemberMatch":
-		nv, err := normalizeDistinguishedName(value)
-		if err != nil {
-			// fallback
-			return strings.ToLower(normalizeSpace(value)), nil
-		}
-		return nv, nil
-	}
-
-	switch s.Substr {
-	case "caseExactSubstringsMatch":
-		return normalizeSpace(value), nil
-	case "caseIgnoreSubstringsMatch":
-		return strings.ToLower(normalizeSpace(value)), nil
-	case "caseExactIA5SubstringsMatch":
-		return normalizeSpace(value), nil
-	case "caseIgnoreIA5SubstringsMatch":
-		return strings.ToLower(normalizeSpace(value)), nil
-	}
-
-	return value, nil
-}
-
 var SPACE_PATTERN = regexp.MustCompile(`\s+`)
 
 func normalizeSpace(value string) string {
@@ -443,6 +404,27 @@ func namedStmt(tx *sqlx.Tx, stmt *sqlx.NamedStmt) *sqlx.NamedStmt {
 	return stmt
 }
 
+// abandonContext returns the context which is canceled when the client abandons the request.
+func abandonContext(m *ldap.Message) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-m.Done:
+			log.Printf("info: Abandoned the request. messageID: %d", m.MessageID())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func namedStmtContext(ctx context.Context, tx *sqlx.Tx, stmt *sqlx.NamedStmt) *sqlx.NamedStmt {
+	if tx != nil {
+		return tx.NamedStmtContext(ctx, stmt)
+	}
+	return stmt
+}
+
 func txLabel(tx *sqlx.Tx) string {
 	if tx == nil {
 		return "non-tx"
@@ -462,6 +444,7 @@ func commit(tx *sqlx.Tx) error {
 	if err != nil {
 		log.Printf("warn: Detect error when commit, do rollback. err: %v", err)
 		rollback(tx)
+		return NewDBError(err)
 	}
-	return err
+	return nil
 }
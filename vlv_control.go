@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/openstandia/goldap/message"
+	ldap "github.com/openstandia/ldapserver"
+	"golang.org/x/xerrors"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+// https://tools.ietf.org/html/draft-ietf-ldapext-ldapv3-vlv-09
+const (
+	vlvRequestControlOID  = "2.16.840.1.113730.3.4.9"
+	vlvResponseControlOID = "2.16.840.1.113730.3.4.10"
+)
+
+// The codes of virtualListViewResult, they are also used as the result code of the search.
+const (
+	vlvResultSortControlMissing = 60
+	vlvResultOffsetRangeError   = 61
+)
+
+// VLVRequest is the value of the virtual list view request control.
+// Only byOffset target is supported, so GreaterThanOrEqual is kept just for rejecting it.
+type VLVRequest struct {
+	BeforeCount        int64
+	AfterCount         int64
+	Offset             int64
+	ContentCount       int64
+	GreaterThanOrEqual bool
+	ContextID          string
+}
+
+// getVLVControl returns the virtual list view request control of the message if it exists.
+func getVLVControl(m *ldap.Message) (*message.Control, bool) {
+	if m.Controls() == nil {
+		return nil, false
+	}
+	for _, con := range *m.Controls() {
+		if string(con.ControlType()) == vlvRequestControlOID {
+			c := con
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// parseVLVRequest parses the value of the virtual list view request control.
+//
+//   VirtualListViewRequest ::= SEQUENCE {
+//      beforeCount    INTEGER (0..maxInt),
+//      afterCount     INTEGER (0..maxInt),
+//      target       CHOICE {
+//         byOffset        [0] SEQUENCE {
+//            offset          INTEGER (1 .. maxInt),
+//            contentCount    INTEGER (0 .. maxInt) },
+//         greaterThanOrEqual [1] AssertionValue },
+//      contextID     OCTET STRING OPTIONAL }
+func parseVLVRequest(value string) (*VLVRequest, error) {
+	packet, err := ber.DecodePacketErr([]byte(value))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to decode VLV control value. err: %w", err)
+	}
+	if len(packet.Children) < 3 {
+		return nil, xerrors.Errorf("Invalid VLV request, the elements are missing")
+	}
+
+	req := &VLVRequest{}
+	for i, dest := range []*int64{&req.BeforeCount, &req.AfterCount} {
+		v, ok := packet.Children[i].Value.(int64)
+		if !ok || v < 0 {
+			return nil, xerrors.Errorf("Invalid VLV request, the count at %d must be non-negative integer", i)
+		}
+		*dest = v
+	}
+
+	target := packet.Children[2]
+	if target.ClassType != ber.ClassContext {
+		return nil, xerrors.Errorf("Invalid VLV request target")
+	}
+	switch target.Tag {
+	case 0:
+		if len(target.Children) != 2 {
+			return nil, xerrors.Errorf("Invalid VLV request, byOffset requires offset and contentCount")
+		}
+		for i, dest := range []*int64{&req.Offset, &req.ContentCount} {
+			v, err := ber.ParseInt64(target.Children[i].Data.Bytes())
+			if err != nil || v < 0 {
+				return nil, xerrors.Errorf("Invalid VLV request, byOffset at %d must be non-negative integer", i)
+			}
+			*dest = v
+		}
+	case 1:
+		req.GreaterThanOrEqual = true
+	default:
+		return nil, xerrors.Errorf("Invalid VLV request target tag %d", target.Tag)
+	}
+
+	if len(packet.Children) > 3 {
+		req.ContextID = packet.Children[3].Data.String()
+	}
+	return req, nil
+}
+
+// window returns the 1-origin position of the target entry in the content, and the 0-origin offset and
+// the limit of the entries to return. The offset of the client is scaled by the ratio of the content counts
+// if the client's count is different from the server's one.
+func (v *VLVRequest) window(total int64) (int64, int64, int64, error) {
+	if v.Offset < 1 {
+		return 0, 0, 0, xerrors.Errorf("Invalid VLV offset: %d", v.Offset)
+	}
+
+	target := v.Offset
+	if v.ContentCount > 0 && v.ContentCount != total {
+		switch {
+		case v.Offset == 1:
+			target = 1
+		case v.Offset >= v.ContentCount:
+			target = total
+		default:
+			target = (v.Offset*total + v.ContentCount/2) / v.ContentCount
+		}
+	}
+	if target > total {
+		target = total
+	}
+	if target < 1 {
+		// The content is empty
+		return 0, 0, 0, nil
+	}
+
+	start := target - v.BeforeCount
+	if start < 1 {
+		start = 1
+	}
+	end := target + v.AfterCount
+	if end > total || end < target {
+		end = total
+	}
+	return target, start - 1, end - start + 1, nil
+}
+
+// newVLVResponseControl returns the virtual list view response control.
+//
+//   VirtualListViewResponse ::= SEQUENCE {
+//      targetPosition    INTEGER (0 .. maxInt),
+//      contentCount     INTEGER (0 .. maxInt),
+//      virtualListViewResult ENUMERATED {...},
+//      contextID     OCTET STRING OPTIONAL }
+func newVLVResponseControl(target, count int64, code int, contextID string) (message.Control, error) {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewResponse")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, target, "targetPosition"))
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, count, "contentCount"))
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "virtualListViewResult"))
+	if contextID != "" {
+		value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, contextID, "contextID"))
+	}
+
+	return newResponseControl(vlvResponseControlOID, value.Bytes())
+}
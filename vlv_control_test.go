@@ -0,0 +1,104 @@
+// +build !integration
+
+package main
+
+import (
+	"testing"
+
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+func TestParseVLVRequest(t *testing.T) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewRequest")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(1), "beforeCount"))
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(2), "afterCount"))
+	target := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "byOffset")
+	target.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(30), "offset"))
+	target.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(100), "contentCount"))
+	packet.AppendChild(target)
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "ctx", "contextID"))
+
+	req, err := parseVLVRequest(string(packet.Bytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	expect := VLVRequest{BeforeCount: 1, AfterCount: 2, Offset: 30, ContentCount: 100, ContextID: "ctx"}
+	if *req != expect {
+		t.Errorf("Unexpected request. want: %+v, got: %+v", expect, *req)
+	}
+
+	// greaterThanOrEqual
+	packet = ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "VirtualListViewRequest")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "beforeCount"))
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "afterCount"))
+	packet.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, "abc", "greaterThanOrEqual"))
+
+	req, err = parseVLVRequest(string(packet.Bytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if !req.GreaterThanOrEqual {
+		t.Errorf("Expected greaterThanOrEqual target")
+	}
+
+	if _, err := parseVLVRequest("invalid"); err == nil {
+		t.Errorf("Expected error for invalid value")
+	}
+}
+
+func TestVLVRequestWindow(t *testing.T) {
+	testcases := []struct {
+		req    VLVRequest
+		total  int64
+		target int64
+		offset int64
+		limit  int64
+	}{
+		{VLVRequest{BeforeCount: 1, AfterCount: 1, Offset: 3}, 5, 3, 1, 3},
+		{VLVRequest{BeforeCount: 2, AfterCount: 1, Offset: 1}, 5, 1, 0, 2},
+		// Beyond the last entry
+		{VLVRequest{BeforeCount: 1, AfterCount: 1, Offset: 10}, 5, 5, 3, 2},
+		// Scaled by the content count of the client
+		{VLVRequest{Offset: 50, ContentCount: 100}, 10, 5, 4, 1},
+		{VLVRequest{BeforeCount: 1, Offset: 100, ContentCount: 100}, 10, 10, 8, 2},
+		{VLVRequest{AfterCount: 1, Offset: 1, ContentCount: 100}, 10, 1, 0, 2},
+		// Empty content
+		{VLVRequest{BeforeCount: 1, AfterCount: 1, Offset: 1}, 0, 0, 0, 0},
+	}
+
+	for i, tc := range testcases {
+		target, offset, limit, err := tc.req.window(tc.total)
+		if err != nil {
+			t.Fatalf("#%d: Unexpected error: %+v", i, err)
+		}
+		if target != tc.target || offset != tc.offset || limit != tc.limit {
+			t.Errorf("#%d: Unexpected window. want: (%d, %d, %d), got: (%d, %d, %d)",
+				i, tc.target, tc.offset, tc.limit, target, offset, limit)
+		}
+	}
+
+	if _, _, _, err := (&VLVRequest{Offset: 0}).window(5); err == nil {
+		t.Errorf("Expected error for offset 0")
+	}
+}
+
+func TestNewVLVResponseControl(t *testing.T) {
+	control, err := newVLVResponseControl(3, 5, 0, "ctx")
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+	if string(control.ControlType()) != vlvResponseControlOID {
+		t.Errorf("Unexpected control type: %s", control.ControlType())
+	}
+
+	packet := ber.DecodePacket([]byte(*control.ControlValue()))
+	if len(packet.Children) != 4 {
+		t.Fatalf("Unexpected elements: %d", len(packet.Children))
+	}
+	if packet.Children[0].Value.(int64) != 3 || packet.Children[1].Value.(int64) != 5 || packet.Children[2].Value.(int64) != 0 {
+		t.Errorf("Unexpected response: %v, %v, %v", packet.Children[0].Value, packet.Children[1].Value, packet.Children[2].Value)
+	}
+	if packet.Children[3].Value.(string) != "ctx" {
+		t.Errorf("Unexpected contextID: %v", packet.Children[3].Value)
+	}
+}